@@ -0,0 +1,284 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audit operations recorded in the audit log.
+const (
+	AuditAdd    = "add"
+	AuditModify = "modify"
+	AuditRemove = "remove"
+	// AuditRotate is recorded when the agent providing a known service
+	// reconnects with a new session, or the service's credentials are
+	// re-issued.
+	AuditRotate = "rotate"
+)
+
+// redactedValue replaces the value of any annotation whose key looks
+// like it holds a credential.
+const redactedValue = "[REDACTED]"
+
+var sensitiveAnnotationWords = []string{
+	"token",
+	"password",
+	"passwd",
+	"secret",
+	"credential",
+	"apikey",
+	"api-key",
+	"api_key",
+	"authorization",
+}
+
+// AuditEvent is one line in the audit log.
+type AuditEvent struct {
+	Time            time.Time         `json:"time"`
+	Operation       string            `json:"operation"`
+	AgentName       string            `json:"agentName"`
+	Session         string            `json:"session,omitempty"`
+	PreviousSession string            `json:"previousSession,omitempty"`
+	Name            string            `json:"name"`
+	Type            string            `json:"type"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	Changes         *AnnotationDiff   `json:"changes,omitempty"`
+}
+
+// AnnotationDiff describes how a service's annotations changed.
+type AnnotationDiff struct {
+	Added   map[string]string           `json:"added,omitempty"`
+	Removed map[string]string           `json:"removed,omitempty"`
+	Changed map[string]AnnotationChange `json:"changed,omitempty"`
+}
+
+// AnnotationChange holds the old and new value of a changed annotation.
+type AnnotationChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// AuditLog appends AuditEvents as JSON lines to a file, rotating it
+// when it grows beyond the configured size.  A nil *AuditLog discards
+// all events, so callers need not check if auditing is enabled.
+type AuditLog struct {
+	lock       sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+	f          *os.File
+	size       int64
+	now        func() time.Time
+}
+
+// NewAuditLog opens, or creates, the audit log file described by conf.
+func NewAuditLog(conf AuditConfig) (*AuditLog, error) {
+	conf.applyDefaults()
+	a := &AuditLog{
+		path:       conf.Path,
+		maxBytes:   int64(conf.MaxSizeMB) * 1024 * 1024,
+		maxBackups: conf.MaxBackups,
+		now:        time.Now,
+	}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *AuditLog) open() error {
+	f, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("opening audit log: %v", err)
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("opening audit log: %v", err)
+	}
+	a.f = f
+	a.size = st.Size()
+	return nil
+}
+
+// Record writes the event, setting its Time if not already set.
+// Errors are logged rather than returned, as a failure to audit
+// should not stop service discovery.
+func (a *AuditLog) Record(event AuditEvent) {
+	if a == nil {
+		return
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if event.Time.IsZero() {
+		event.Time = a.now().UTC()
+	}
+	d, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("marshalling audit event: %v", err)
+		return
+	}
+	d = append(d, '\n')
+
+	if a.f == nil {
+		if err := a.open(); err != nil {
+			log.Printf("%v", err)
+			return
+		}
+	}
+	if a.size > 0 && a.size+int64(len(d)) > a.maxBytes {
+		if err := a.rotate(); err != nil {
+			log.Printf("rotating audit log: %v", err)
+			return
+		}
+	}
+	n, err := a.f.Write(d)
+	a.size += int64(n)
+	if err != nil {
+		log.Printf("writing audit log: %v", err)
+	}
+}
+
+// rotate renames the current file to path.1, shifting older backups
+// up by one and removing any beyond maxBackups.
+func (a *AuditLog) rotate() error {
+	if err := a.f.Close(); err != nil {
+		log.Printf("closing audit log: %v", err)
+	}
+	a.f = nil
+	for i := a.maxBackups; i > 0; i-- {
+		src := a.path
+		if i > 1 {
+			src = fmt.Sprintf("%s.%d", a.path, i-1)
+		}
+		dst := fmt.Sprintf("%s.%d", a.path, i)
+		if err := os.Rename(src, dst); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return a.open()
+}
+
+// Close closes the underlying file.
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+func isSensitiveAnnotation(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range sensitiveAnnotationWords {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactAnnotations(annotations map[string]string) map[string]string {
+	if len(annotations) == 0 {
+		return nil
+	}
+	ret := make(map[string]string, len(annotations))
+	for k, v := range annotations {
+		if isSensitiveAnnotation(k) {
+			v = redactedValue
+		}
+		ret[k] = v
+	}
+	return ret
+}
+
+func diffAnnotations(before map[string]string, after map[string]string) *AnnotationDiff {
+	diff := &AnnotationDiff{
+		Added:   map[string]string{},
+		Removed: map[string]string{},
+		Changed: map[string]AnnotationChange{},
+	}
+	for k, v := range after {
+		oldValue, found := before[k]
+		switch {
+		case !found:
+			diff.Added[k] = v
+		case oldValue != v:
+			diff.Changed[k] = AnnotationChange{Old: oldValue, New: v}
+		}
+	}
+	for k, v := range before {
+		if _, found := after[k]; !found {
+			diff.Removed[k] = v
+		}
+	}
+	for k := range diff.Changed {
+		if isSensitiveAnnotation(k) {
+			diff.Changed[k] = AnnotationChange{Old: redactedValue, New: redactedValue}
+		}
+	}
+	diff.Added = redactAnnotations(diff.Added)
+	diff.Removed = redactAnnotations(diff.Removed)
+	if len(diff.Changed) == 0 {
+		diff.Changed = nil
+	}
+	return diff
+}
+
+func auditEventFor(operation string, s controllerService) AuditEvent {
+	return AuditEvent{
+		Operation: operation,
+		AgentName: s.AgentName,
+		Session:   s.Session,
+		Name:      s.Name,
+		Type:      s.Type,
+	}
+}
+
+func (a *AuditLog) recordAdd(s controllerService) {
+	event := auditEventFor(AuditAdd, s)
+	event.Annotations = redactAnnotations(s.Annotations)
+	a.Record(event)
+}
+
+func (a *AuditLog) recordModify(before controllerService, after controllerService) {
+	event := auditEventFor(AuditModify, after)
+	event.Changes = diffAnnotations(before.Annotations, after.Annotations)
+	a.Record(event)
+}
+
+func (a *AuditLog) recordRemove(s controllerService) {
+	a.Record(auditEventFor(AuditRemove, s))
+}
+
+func (a *AuditLog) recordRotate(before controllerService, after controllerService) {
+	event := auditEventFor(AuditRotate, after)
+	event.PreviousSession = before.Session
+	a.Record(event)
+}
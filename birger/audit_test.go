@@ -0,0 +1,141 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readAuditEvents(t *testing.T, path string) []AuditEvent {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	ret := []AuditEvent{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event AuditEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		ret = append(ret, event)
+	}
+	return ret
+}
+
+func Test_diffAnnotations(t *testing.T) {
+	got := diffAnnotations(
+		map[string]string{"description": "old", "removed": "gone", "apiToken": "abc", "same": "x"},
+		map[string]string{"description": "new", "added": "here", "apiToken": "def", "same": "x"},
+	)
+	require.Equal(t, &AnnotationDiff{
+		Added:   map[string]string{"added": "here"},
+		Removed: map[string]string{"removed": "gone"},
+		Changed: map[string]AnnotationChange{
+			"description": {Old: "old", New: "new"},
+			"apiToken":    {Old: redactedValue, New: redactedValue},
+		},
+	}, got)
+}
+
+func Test_redactAnnotations(t *testing.T) {
+	got := redactAnnotations(map[string]string{
+		"description":   "demo",
+		"Password":      "hunter2",
+		"client-secret": "shh",
+	})
+	require.Equal(t, map[string]string{
+		"description":   "demo",
+		"Password":      redactedValue,
+		"client-secret": redactedValue,
+	}, got)
+}
+
+func TestAuditLog_Record(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := NewAuditLog(AuditConfig{Path: path})
+	require.NoError(t, err)
+	a.now = func() time.Time { return time.Unix(1662067531, 0) }
+
+	svc := controllerService{
+		AgentName:   "smith",
+		Session:     "session-one",
+		Name:        "argo",
+		Type:        "argocd",
+		Annotations: map[string]string{"description": "demo", "token": "abc"},
+	}
+	a.recordAdd(svc)
+	rotated := svc
+	rotated.Session = "session-two"
+	a.recordRotate(svc, rotated)
+	a.recordRemove(rotated)
+	require.NoError(t, a.Close())
+
+	events := readAuditEvents(t, path)
+	require.Len(t, events, 3)
+	require.Equal(t, AuditAdd, events[0].Operation)
+	require.Equal(t, time.Unix(1662067531, 0).UTC(), events[0].Time)
+	require.Equal(t, map[string]string{"description": "demo", "token": redactedValue}, events[0].Annotations)
+	require.Equal(t, AuditRotate, events[1].Operation)
+	require.Equal(t, "session-two", events[1].Session)
+	require.Equal(t, "session-one", events[1].PreviousSession)
+	require.Equal(t, AuditRemove, events[2].Operation)
+
+	var nilLog *AuditLog
+	nilLog.recordAdd(svc)
+	require.NoError(t, nilLog.Close())
+}
+
+func TestAuditLog_rotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := NewAuditLog(AuditConfig{Path: path, MaxBackups: 2})
+	require.NoError(t, err)
+	a.maxBytes = 1
+
+	for _, name := range []string{"one", "two", "three", "four"} {
+		a.recordRemove(controllerService{AgentName: "smith", Name: name, Type: "argocd"})
+	}
+	require.NoError(t, a.Close())
+
+	require.Equal(t, "four", readAuditEvents(t, path)[0].Name)
+	require.Equal(t, "three", readAuditEvents(t, path+".1")[0].Name)
+	require.Equal(t, "two", readAuditEvents(t, path+".2")[0].Name)
+	_, err = os.Stat(path + ".3")
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestAuditLog_rotateNegativeMaxBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := NewAuditLog(AuditConfig{Path: path, MaxBackups: -1})
+	require.NoError(t, err)
+	require.Equal(t, 1, a.maxBackups)
+	a.maxBytes = 1
+
+	for _, name := range []string{"one", "two", "three"} {
+		a.recordRemove(controllerService{AgentName: "smith", Name: name, Type: "argocd"})
+	}
+	require.NoError(t, a.Close())
+
+	// the current file is rotated rather than growing without bound.
+	require.Len(t, readAuditEvents(t, path), 1)
+	require.Equal(t, "three", readAuditEvents(t, path)[0].Name)
+	require.Equal(t, "two", readAuditEvents(t, path+".1")[0].Name)
+	_, err = os.Stat(path + ".2")
+	require.True(t, os.IsNotExist(err))
+}
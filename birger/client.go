@@ -0,0 +1,190 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/OpsMx/go-app-base/util"
+)
+
+// maxAgentStatisticsBytes limits the size of the agent statistics, which
+// grows with the number of connected agents.
+const maxAgentStatisticsBytes = 64 << 20
+
+// Client makes single requests to the controller.  The ControllerManager
+// uses one to poll, and it can be used directly when debugging.
+type Client struct {
+	conf Config
+
+	// tlsClient is created on first use, and shared by all requests so
+	// connections are reused.
+	tlsOnce   sync.Once
+	tlsClient *http.Client
+	tlsErr    error
+}
+
+// NewClient returns a Client for the controller described by conf.
+func NewClient(conf Config) *Client {
+	conf.applyDefaults()
+	return &Client{conf: conf}
+}
+
+// AgentStatistics is the controller's description of the connected agents.
+// ServerTime is the controller's clock, in milliseconds since the epoch,
+// and Version is the controller's version.
+type AgentStatistics struct {
+	ServerTime      int64   `json:"serverTime,omitempty"`
+	Version         string  `json:"version,omitempty"`
+	ConnectedAgents []Agent `json:"connectedAgents,omitempty"`
+}
+
+// Agent is one connected agent session.  The same agent may appear more
+// than once if it has several sessions, in which case the most recently
+// connected is used.
+type Agent struct {
+	Name           string            `json:"name,omitempty"`
+	Session        string            `json:"session,omitempty"`
+	ConnectionType string            `json:"connectionType,omitempty"`
+	Hostname       string            `json:"hostname,omitempty"`
+	Version        string            `json:"version,omitempty"`
+	Annotations    map[string]string `json:"annotations,omitempty"`
+	Endpoints      []AgentEndpoint   `json:"endpoints,omitempty"`
+	ConnectedAt    int64             `json:"connectedAt,omitempty"`
+	LastPing       int64             `json:"lastPing,omitempty"`
+}
+
+// AgentEndpoint is a service offered by an agent.  Only those which are
+// Configured can be used.
+type AgentEndpoint struct {
+	Name        string            `json:"name,omitempty"`
+	Type        string            `json:"type,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Configured  bool              `json:"configured,omitempty"`
+}
+
+type controllerServiceCredentialsRequest struct {
+	AgentName string `json:"agentName,omitempty"`
+	Type      string `json:"type,omitempty"`
+	Name      string `json:"name,omitempty"`
+}
+
+type controllerServiceCredentialResponse struct {
+	AgentName      string `json:"agentName,omitempty"`
+	Name           string `json:"name,omitempty"`
+	Type           string `json:"type,omitempty"`
+	CredentialType string `json:"credentialType,omitempty"`
+	Credential     struct {
+		Password string `json:"password,omitempty"`
+	} `json:"credential,omitempty"`
+	URL string `json:"url,omitempty"`
+}
+
+// getTLSClient returns a client which requires TLS 1.3, and otherwise
+// uses the global TLS configuration so any custom CA roots are trusted.
+// It is created once, using the global configuration at that time.
+func (c *Client) getTLSClient() (*http.Client, error) {
+	c.tlsOnce.Do(func() {
+		tlsConfig, err := httputil.MergeDefaultTLSConfig(httputil.TLSOverlay{
+			MinVersion: tls.VersionTLS13,
+		})
+		if err != nil {
+			c.tlsErr = err
+			return
+		}
+		c.tlsClient = httputil.NewClient(httputil.WithTLSConfig(tlsConfig))
+	})
+	return c.tlsClient, c.tlsErr
+}
+
+// ServiceCredentials has the controller issue a new credential for one
+// agent's service.
+func (c *Client) ServiceCredentials(ctx context.Context, agentName string, name string, serviceType string) (Credential, error) {
+	url, err := url.JoinPath(c.conf.URL, "/api/v1/generateServiceCredentials")
+	if err != nil {
+		return Credential{}, fmt.Errorf("joining url: %v", err)
+	}
+
+	client, err := c.getTLSClient()
+	if err != nil {
+		return Credential{}, fmt.Errorf("making TLS client: %w", err)
+	}
+
+	credentialsRequest := controllerServiceCredentialsRequest{
+		AgentName: agentName,
+		Name:      name,
+		Type:      serviceType,
+	}
+	resp, err := httputil.CallJSON[controllerServiceCredentialsRequest, controllerServiceCredentialResponse](
+		ctx, client, http.MethodPost, url, credentialsRequest, httputil.CallOptions{Token: c.conf.Token})
+	if err != nil {
+		return Credential{}, fmt.Errorf("fetching service credentials: %w", err)
+	}
+
+	return Credential{
+		URL:      resp.Body.URL,
+		Token:    util.NewSecret(resp.Body.Credential.Password),
+		IssuedAt: time.Now(),
+	}, nil
+}
+
+// AgentStatistics returns the agents currently connected to the controller.
+func (c *Client) AgentStatistics(ctx context.Context) (AgentStatistics, error) {
+	data, _, _, err := c.fetchAgentStatistics(ctx, "")
+	if err != nil {
+		return AgentStatistics{}, err
+	}
+	var stats AgentStatistics
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return AgentStatistics{}, fmt.Errorf("cannot decode connected agent JSON: %v", err)
+	}
+	return stats, nil
+}
+
+// fetchAgentStatistics returns the raw agent statistics.  If etag is not
+// empty, it is sent as If-None-Match, and notModified will be true if
+// the controller replies that nothing has changed.
+func (c *Client) fetchAgentStatistics(ctx context.Context, etag string) (data []byte, newETag string, notModified bool, err error) {
+	url, err := url.JoinPath(c.conf.URL, "/api/v1/getAgentStatistics")
+	if err != nil {
+		return nil, "", false, fmt.Errorf("joining url: %v", err)
+	}
+
+	client, err := c.getTLSClient()
+	if err != nil {
+		return nil, "", false, fmt.Errorf("making TLS client: %w", err)
+	}
+
+	opts := httputil.CallOptions{Token: c.conf.Token, MaxResponseBytes: maxAgentStatisticsBytes}
+	if etag != "" {
+		opts.Header = http.Header{"If-None-Match": {etag}}
+	}
+	resp, err := httputil.GetJSON[json.RawMessage](ctx, client, url, opts)
+	if err != nil {
+		return nil, "", false, fmt.Errorf("fetching connected agents: %w", err)
+	}
+	if resp.NotModified {
+		return nil, etag, true, nil
+	}
+	return resp.Body, resp.Header.Get("etag"), false, nil
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/OpsMx/go-app-base/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	fc := &fakeController{
+		etag:       `"v1"`,
+		failAgents: map[string]bool{"bad": true},
+		agents: []Agent{
+			{Name: "smith", Version: "v3.4.6", Endpoints: []AgentEndpoint{{Name: "argo", Type: "argocd", Configured: true}}},
+		},
+	}
+	var connections int32
+	server := httptest.NewUnstartedServer(fc)
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+	c := NewClient(Config{URL: server.URL, Token: util.NewSecret("abc")})
+	ctx := context.Background()
+
+	t.Run("AgentStatistics", func(t *testing.T) {
+		stats, err := c.AgentStatistics(ctx)
+		require.NoError(t, err)
+		require.Equal(t, fc.agents, stats.ConnectedAgents)
+	})
+
+	t.Run("fetchAgentStatistics not modified", func(t *testing.T) {
+		data, etag, notModified, err := c.fetchAgentStatistics(ctx, `"v1"`)
+		require.NoError(t, err)
+		require.True(t, notModified)
+		require.Nil(t, data)
+		require.Equal(t, `"v1"`, etag)
+	})
+
+	t.Run("ServiceCredentials", func(t *testing.T) {
+		cred, err := c.ServiceCredentials(ctx, "smith", "argo", "argocd")
+		require.NoError(t, err)
+		require.Equal(t, "https://smith", cred.URL)
+		require.Equal(t, "token-smith", cred.Token.Reveal())
+		require.False(t, cred.IssuedAt.IsZero())
+
+		_, err = c.ServiceCredentials(ctx, "bad", "argo", "argocd")
+		require.EqualError(t, err, "fetching service credentials: http status 500: agent not connected")
+		var respErr *httputil.ResponseError
+		require.True(t, errors.As(err, &respErr))
+		require.Equal(t, http.StatusInternalServerError, respErr.StatusCode)
+	})
+
+	t.Run("AgentStatistics error", func(t *testing.T) {
+		down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+		}))
+		defer down.Close()
+		_, err := NewClient(Config{URL: down.URL, Token: util.NewSecret("abc")}).AgentStatistics(ctx)
+		var respErr *httputil.ResponseError
+		require.True(t, errors.As(err, &respErr))
+		require.Equal(t, http.StatusServiceUnavailable, respErr.StatusCode)
+	})
+
+	t.Run("TLS client is reused", func(t *testing.T) {
+		first, err := c.getTLSClient()
+		require.NoError(t, err)
+		second, err := c.getTLSClient()
+		require.NoError(t, err)
+		require.Same(t, first, second)
+
+		before := atomic.LoadInt32(&connections)
+		for i := 0; i < 3; i++ {
+			_, err := c.ServiceCredentials(ctx, "smith", "argo", "argocd")
+			require.NoError(t, err)
+		}
+		require.Equal(t, before, atomic.LoadInt32(&connections))
+	})
+}
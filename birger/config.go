@@ -15,29 +15,194 @@
 package birger
 
 import (
+	"fmt"
 	"log"
 	"os"
+
+	"github.com/OpsMx/go-app-base/util"
+	"github.com/OpsMx/go-app-base/version"
 )
 
 type Config struct {
-	URL                    string `json:"url,omitempty" yaml:"url,omitempty"`
-	Token                  string `json:"token,omitempty" yaml:"token,omitempty"`
-	UpdateFrequencySeconds int    `json:"updateFrequencySeconds,omitempty" yaml:"updateFrequencySeconds,omitempty"`
+	URL                    string      `json:"url,omitempty" yaml:"url,omitempty"`
+	Token                  util.Secret `json:"token,omitempty" yaml:"token,omitempty"`
+	UpdateFrequencySeconds int         `json:"updateFrequencySeconds,omitempty" yaml:"updateFrequencySeconds,omitempty"`
+
+	// CredentialFetchParallelism limits how many credential requests
+	// are made to the controller at once.  Negative values mean 1.
+	CredentialFetchParallelism int `json:"credentialFetchParallelism,omitempty" yaml:"credentialFetchParallelism,omitempty"`
+
+	// SyncTimeoutSeconds limits how long one sync with the controller,
+	// including all credential requests, may take.
+	SyncTimeoutSeconds int `json:"syncTimeoutSeconds,omitempty" yaml:"syncTimeoutSeconds,omitempty"`
+
+	// AgentVersions limits which agent versions will be used for each
+	// service type.  Endpoints on agents outside the range are excluded.
+	AgentVersions map[string]VersionConstraint `json:"agentVersions,omitempty" yaml:"agentVersions,omitempty"`
+
+	// Audit enables a JSON lines log of every service discovery change.
+	Audit AuditConfig `json:"audit,omitempty" yaml:"audit,omitempty"`
+
+	// MaxClockSkewSeconds is how far the controller's clock may differ from
+	// ours before a warning is logged.
+	MaxClockSkewSeconds int `json:"maxClockSkewSeconds,omitempty" yaml:"maxClockSkewSeconds,omitempty"`
+
+	// MinControllerVersion, if set, causes syncs with an older controller,
+	// or one whose version cannot be parsed, to fail rather than use
+	// responses which may not be understood.
+	MinControllerVersion string `json:"minControllerVersion,omitempty" yaml:"minControllerVersion,omitempty"`
+
+	// CredentialStore configures where issued service credentials are kept.
+	CredentialStore CredentialStoreConfig `json:"credentialStore,omitempty" yaml:"credentialStore,omitempty"`
+}
+
+// CredentialStoreConfig configures reuse of issued credentials.  If Store
+// is set, it is used.  Otherwise, if Path is set, a FileCredentialStore
+// is used, which may be shared with other replicas.  If neither is set,
+// credentials are kept in memory.
+//
+// Credentials are re-issued after TTLSeconds.
+type CredentialStoreConfig struct {
+	Path       string          `json:"path,omitempty" yaml:"path,omitempty"`
+	TTLSeconds int             `json:"ttlSeconds,omitempty" yaml:"ttlSeconds,omitempty"`
+	Store      CredentialStore `json:"-" yaml:"-"`
+}
+
+// AuditConfig configures the optional audit log.  If Path is empty, no
+// audit log is written.  The file is rotated when it would exceed
+// MaxSizeMB, keeping MaxBackups older files named Path.1, Path.2, etc.
+// At least one older file is kept, so negative values mean 1.
+type AuditConfig struct {
+	Path       string `json:"path,omitempty" yaml:"path,omitempty"`
+	MaxSizeMB  int    `json:"maxSizeMB,omitempty" yaml:"maxSizeMB,omitempty"`
+	MaxBackups int    `json:"maxBackups,omitempty" yaml:"maxBackups,omitempty"`
+}
+
+// VersionConstraint holds an optional minimum and maximum agent version,
+// both inclusive, in `git describe` format such as `v3.4.6` or
+// `v3.4.6-6-g4eee038`.
+type VersionConstraint struct {
+	Min string `json:"min,omitempty" yaml:"min,omitempty"`
+	Max string `json:"max,omitempty" yaml:"max,omitempty"`
+}
+
+type versionRange struct {
+	min *version.Semver
+	max *version.Semver
 }
 
 var defaultConfig = Config{
-	UpdateFrequencySeconds: 30,
+	UpdateFrequencySeconds:     30,
+	CredentialFetchParallelism: 8,
+	SyncTimeoutSeconds:         120,
+	MaxClockSkewSeconds:        30,
+}
+
+var defaultCredentialStoreConfig = CredentialStoreConfig{
+	TTLSeconds: 24 * 60 * 60,
+}
+
+var defaultAuditConfig = AuditConfig{
+	MaxSizeMB:  10,
+	MaxBackups: 3,
 }
 
 func (cc *Config) applyDefaults() {
-	if cc.Token == "" {
+	if cc.Token.IsZero() {
 		t, found := os.LookupEnv("CONTROLLER_TOKEN")
 		if !found {
 			log.Fatal("no token in config, nor CONTROLLER_TOKEN envar")
 		}
-		cc.Token = t
+		cc.Token = util.NewSecret(t)
 	}
 	if cc.UpdateFrequencySeconds == 0 {
 		cc.UpdateFrequencySeconds = defaultConfig.UpdateFrequencySeconds
 	}
+	if cc.CredentialFetchParallelism == 0 {
+		cc.CredentialFetchParallelism = defaultConfig.CredentialFetchParallelism
+	}
+	if cc.CredentialFetchParallelism < 0 {
+		cc.CredentialFetchParallelism = 1
+	}
+	if cc.SyncTimeoutSeconds == 0 {
+		cc.SyncTimeoutSeconds = defaultConfig.SyncTimeoutSeconds
+	}
+	if cc.MaxClockSkewSeconds == 0 {
+		cc.MaxClockSkewSeconds = defaultConfig.MaxClockSkewSeconds
+	}
+	if cc.CredentialStore.TTLSeconds == 0 {
+		cc.CredentialStore.TTLSeconds = defaultCredentialStoreConfig.TTLSeconds
+	}
+}
+
+func (sc CredentialStoreConfig) makeStore() (CredentialStore, error) {
+	if sc.Store != nil {
+		return sc.Store, nil
+	}
+	if sc.Path != "" {
+		return NewFileCredentialStore(sc.Path)
+	}
+	return NewMemoryCredentialStore(), nil
+}
+
+func (ac *AuditConfig) applyDefaults() {
+	if ac.MaxSizeMB == 0 {
+		ac.MaxSizeMB = defaultAuditConfig.MaxSizeMB
+	}
+	if ac.MaxBackups == 0 {
+		ac.MaxBackups = defaultAuditConfig.MaxBackups
+	}
+	if ac.MaxBackups < 0 {
+		ac.MaxBackups = 1
+	}
+}
+
+func (cc *Config) parseMinControllerVersion() (*version.Semver, error) {
+	if cc.MinControllerVersion == "" {
+		return nil, nil
+	}
+	v, err := version.ParseSemver(cc.MinControllerVersion)
+	if err != nil {
+		return nil, fmt.Errorf("minControllerVersion: %v", err)
+	}
+	return &v, nil
+}
+
+func (cc *Config) parseVersionConstraints() (map[string]versionRange, error) {
+	ret := map[string]versionRange{}
+	for serviceType, constraint := range cc.AgentVersions {
+		r := versionRange{}
+		if constraint.Min != "" {
+			v, err := version.ParseSemver(constraint.Min)
+			if err != nil {
+				return nil, fmt.Errorf("agentVersions[%s].min: %v", serviceType, err)
+			}
+			r.min = &v
+		}
+		if constraint.Max != "" {
+			v, err := version.ParseSemver(constraint.Max)
+			if err != nil {
+				return nil, fmt.Errorf("agentVersions[%s].max: %v", serviceType, err)
+			}
+			r.max = &v
+		}
+		ret[serviceType] = r
+	}
+	return ret, nil
+}
+
+// check returns a reason the agent version is outside the range,
+// or an empty string if it is allowed.
+func (r versionRange) check(agentVersion string) string {
+	v, err := version.ParseSemver(agentVersion)
+	if err != nil {
+		return fmt.Sprintf("agent version %q cannot be parsed", agentVersion)
+	}
+	if r.min != nil && v.Compare(*r.min) < 0 {
+		return fmt.Sprintf("agent version %s is older than minimum %s", agentVersion, r.min)
+	}
+	if r.max != nil && v.Compare(*r.max) > 0 {
+		return fmt.Sprintf("agent version %s is newer than maximum %s", agentVersion, r.max)
+	}
+	return ""
 }
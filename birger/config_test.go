@@ -17,6 +17,7 @@ package birger
 import (
 	"testing"
 
+	"github.com/OpsMx/go-app-base/util"
 	"github.com/stretchr/testify/require"
 )
 
@@ -28,27 +29,63 @@ func TestConfig_applyDefaults(t *testing.T) {
 	}{
 		{
 			"URL provided isn't overwritten",
-			Config{URL: "abc", Token: "abc"},
+			Config{URL: "abc", Token: util.NewSecret("abc")},
 			Config{
-				URL:                    "abc",
-				Token:                  "abc",
-				UpdateFrequencySeconds: defaultConfig.UpdateFrequencySeconds,
+				URL:                        "abc",
+				Token:                      util.NewSecret("abc"),
+				UpdateFrequencySeconds:     defaultConfig.UpdateFrequencySeconds,
+				CredentialFetchParallelism: defaultConfig.CredentialFetchParallelism,
+				SyncTimeoutSeconds:         defaultConfig.SyncTimeoutSeconds,
+				MaxClockSkewSeconds:        defaultConfig.MaxClockSkewSeconds,
+				CredentialStore:            defaultCredentialStoreConfig,
 			},
 		}, {
 			"token isn't overwritten",
-			Config{Token: "xyz"},
+			Config{Token: util.NewSecret("xyz")},
 			Config{
-				URL:                    defaultConfig.URL,
-				Token:                  "xyz",
-				UpdateFrequencySeconds: defaultConfig.UpdateFrequencySeconds,
+				URL:                        defaultConfig.URL,
+				Token:                      util.NewSecret("xyz"),
+				UpdateFrequencySeconds:     defaultConfig.UpdateFrequencySeconds,
+				CredentialFetchParallelism: defaultConfig.CredentialFetchParallelism,
+				SyncTimeoutSeconds:         defaultConfig.SyncTimeoutSeconds,
+				MaxClockSkewSeconds:        defaultConfig.MaxClockSkewSeconds,
+				CredentialStore:            defaultCredentialStoreConfig,
 			},
 		}, {
 			"UpdateFrequencySeconds provided isn't overwritten",
-			Config{UpdateFrequencySeconds: 1234, Token: "abc"},
+			Config{UpdateFrequencySeconds: 1234, Token: util.NewSecret("abc")},
 			Config{
-				URL:                    defaultConfig.URL,
-				Token:                  "abc",
-				UpdateFrequencySeconds: 1234,
+				URL:                        defaultConfig.URL,
+				Token:                      util.NewSecret("abc"),
+				UpdateFrequencySeconds:     1234,
+				CredentialFetchParallelism: defaultConfig.CredentialFetchParallelism,
+				SyncTimeoutSeconds:         defaultConfig.SyncTimeoutSeconds,
+				MaxClockSkewSeconds:        defaultConfig.MaxClockSkewSeconds,
+				CredentialStore:            defaultCredentialStoreConfig,
+			},
+		}, {
+			"CredentialFetchParallelism and SyncTimeoutSeconds provided aren't overwritten",
+			Config{CredentialFetchParallelism: 2, SyncTimeoutSeconds: 5, Token: util.NewSecret("abc")},
+			Config{
+				URL:                        defaultConfig.URL,
+				Token:                      util.NewSecret("abc"),
+				UpdateFrequencySeconds:     defaultConfig.UpdateFrequencySeconds,
+				CredentialFetchParallelism: 2,
+				SyncTimeoutSeconds:         5,
+				MaxClockSkewSeconds:        defaultConfig.MaxClockSkewSeconds,
+				CredentialStore:            defaultCredentialStoreConfig,
+			},
+		}, {
+			"negative CredentialFetchParallelism is clamped to 1",
+			Config{CredentialFetchParallelism: -3, Token: util.NewSecret("abc")},
+			Config{
+				URL:                        defaultConfig.URL,
+				Token:                      util.NewSecret("abc"),
+				UpdateFrequencySeconds:     defaultConfig.UpdateFrequencySeconds,
+				CredentialFetchParallelism: 1,
+				SyncTimeoutSeconds:         defaultConfig.SyncTimeoutSeconds,
+				MaxClockSkewSeconds:        defaultConfig.MaxClockSkewSeconds,
+				CredentialStore:            defaultCredentialStoreConfig,
 			},
 		},
 	}
@@ -59,3 +96,27 @@ func TestConfig_applyDefaults(t *testing.T) {
 		})
 	}
 }
+
+func TestConfig_parseVersionConstraints(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		c := Config{AgentVersions: map[string]VersionConstraint{
+			"argocd": {Min: "v3.4.6", Max: "v4.0.0"},
+			"whoami": {Max: "v3.0.0-2-gabcdef"},
+		}}
+		ranges, err := c.parseVersionConstraints()
+		require.NoError(t, err)
+		require.Equal(t, "", ranges["argocd"].check("v3.4.6-6-g4eee038"))
+		require.Equal(t, "", ranges["argocd"].check("v4.0.0"))
+		require.NotEqual(t, "", ranges["argocd"].check("v4.0.0-1-g1234567"))
+		require.Nil(t, ranges["whoami"].min)
+		require.NotEqual(t, "", ranges["whoami"].check("v3.0.0-3-g1234567"))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		c := Config{AgentVersions: map[string]VersionConstraint{
+			"argocd": {Min: "latest"},
+		}}
+		_, err := c.parseVersionConstraints()
+		require.Error(t, err)
+	})
+}
@@ -15,19 +15,17 @@
 package birger
 
 import (
-	"bytes"
-	"crypto/tls"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"net/url"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/OpsMx/go-app-base/httputil"
 	"github.com/OpsMx/go-app-base/util"
+	"github.com/OpsMx/go-app-base/version"
 )
 
 // ControllerManager checks the services available on the controller,
@@ -36,12 +34,36 @@ import (
 type ControllerManager struct {
 	UpdateChan        chan ServiceUpdate
 	conf              Config
-	serviceTypes      []string
+	client            *Client
+	filter            ServiceFilter
+	routes            []route
 	shutdownWorker    chan bool
 	shutdownCount     sync.WaitGroup
 	updateRate        time.Duration
+	syncTimeout       time.Duration
 	healthcheckStatus error
 	services          map[string]controllerService
+	audit             *AuditLog
+	credentials       CredentialStore
+	credentialTTL     time.Duration
+	maxClockSkew      time.Duration
+	minController     *version.Semver
+
+	// State used to skip work when the controller's response is unchanged.
+	etag             string
+	bodyHash         [sha256.Size]byte
+	agentCache       map[[sha256.Size]byte]Agent
+	lastFetched      map[string]controllerService
+	lastSyncComplete bool
+
+	lock              sync.Mutex
+	excluded          map[string]ExcludedService
+	loggedExclusions  map[string]ExcludedService
+	invalidated       map[string]uint64
+	invalidations     uint64
+	clockSkew         time.Duration
+	skewWarned        bool
+	controllerVersion string
 }
 
 type controllerService struct {
@@ -50,18 +72,75 @@ type controllerService struct {
 	Type        string
 	Annotations map[string]string
 	AgentName   string
-	Token       string
+	Session     string
+	Token       util.Secret
+	ExpiresAt   time.Time
 }
 
 // MakeControllerManager returns a new ControllerManager which will periodically poll
-// the controller for services, and send
+// the controller for services, and send updates for those matching the serviceTypes
+// patterns to UpdateChan.  See Route for the pattern syntax; a plain type name
+// matches only itself.
 func MakeControllerManager(conf Config, serviceTypes []string) *ControllerManager {
+	subscriptions, err := compileTypePatterns(serviceTypes)
+	if err != nil {
+		log.Fatalf("invalid birger service types: %v", err)
+	}
+	m, err := startControllerManager(conf, subscriptions, nil)
+	if err != nil {
+		log.Fatalf("invalid birger config: %v", err)
+	}
+	return m
+}
+
+// MakeRoutingControllerManager returns a new ControllerManager which will
+// periodically poll the controller for services matching any of the routes,
+// and call the handler of the first route matching each update's type.
+// Handlers are called from a single goroutine, so should not block for long.
+//
+// UpdateChan is not used by a routing ControllerManager.
+func MakeRoutingControllerManager(conf Config, routes []Route) (*ControllerManager, error) {
+	compiled, subscriptions, err := compileRoutes(routes)
+	if err != nil {
+		return nil, err
+	}
+	return startControllerManager(conf, subscriptions, compiled)
+}
+
+func startControllerManager(conf Config, subscriptions []typeMatcher, routes []route) (*ControllerManager, error) {
 	conf.applyDefaults()
+	versionRanges, err := conf.parseVersionConstraints()
+	if err != nil {
+		return nil, err
+	}
+	credentials, err := conf.CredentialStore.makeStore()
+	if err != nil {
+		return nil, err
+	}
+	var audit *AuditLog
+	if conf.Audit.Path != "" {
+		audit, err = NewAuditLog(conf.Audit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	minControllerVersion, err := conf.parseMinControllerVersion()
+	if err != nil {
+		return nil, err
+	}
 	m := ControllerManager{
+		client:            &Client{conf: conf},
+		maxClockSkew:      time.Duration(conf.MaxClockSkewSeconds) * time.Second,
+		minController:     minControllerVersion,
+		filter:            ServiceFilter{subscriptions: subscriptions, versionRanges: versionRanges},
+		audit:             audit,
+		credentials:       credentials,
+		credentialTTL:     time.Duration(conf.CredentialStore.TTLSeconds) * time.Second,
 		conf:              conf,
-		serviceTypes:      serviceTypes,
+		routes:            routes,
 		shutdownWorker:    make(chan bool),
 		updateRate:        time.Duration(conf.UpdateFrequencySeconds) * time.Second,
+		syncTimeout:       time.Duration(conf.SyncTimeoutSeconds) * time.Second,
 		services:          map[string]controllerService{},
 		healthcheckStatus: fmt.Errorf("controller is not yet synced"),
 		UpdateChan:        make(chan ServiceUpdate, 10),
@@ -70,7 +149,7 @@ func MakeControllerManager(conf Config, serviceTypes []string) *ControllerManage
 	m.shutdownCount.Add(1)
 	go m.worker()
 
-	return &m
+	return &m, nil
 }
 
 // Shutdown tells the manager to stop doing updates and causes all
@@ -79,6 +158,9 @@ func (m *ControllerManager) Shutdown() {
 	m.shutdownWorker <- true
 	close(m.UpdateChan)
 	m.shutdownCount.Wait()
+	if err := m.audit.Close(); err != nil {
+		log.Printf("closing audit log: %v", err)
+	}
 }
 
 func (m *ControllerManager) worker() {
@@ -103,37 +185,98 @@ func (m *ControllerManager) worker() {
 }
 
 func (m *ControllerManager) reloadFromController() {
-	services, err := m.getArgoServices()
+	ctx, cancel := context.WithTimeout(context.Background(), m.syncTimeout)
+	defer cancel()
+
+	services, changed, err := m.getArgoServices(ctx)
 	if err != nil {
-		m.healthcheckStatus = err
+		m.setHealthcheckStatus(err)
+		m.lastSyncComplete = false
 		log.Printf("unable to get argo services from controller: %v", err)
 		return
 	}
-	m.healthcheckStatus = nil
+	invalidated := m.pendingInvalidations()
+	now := time.Now()
+
+	// If nothing changed and the last sync applied everything, there is
+	// nothing to do.  If some credentials could not be fetched last time,
+	// or need to be re-issued, continue so they are.
+	if !changed && m.lastSyncComplete && len(invalidated) == 0 && !m.credentialsExpired(now) {
+		m.setHealthcheckStatus(nil)
+		return
+	}
+	m.setHealthcheckStatus(nil)
+	m.logExclusions()
+
+	keys := make([]string, 0, len(services))
+	for key := range services {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
 	// compare existing services to the new list.  We can assume that if we have an entry,
-	// we do not need to refresh tokens and the URL cannot change when talking to the
-	// controller.  If these change, we will want a restart.
-	for key, fetchedService := range services {
+	// we do not need to refresh tokens unless they have expired or were invalidated,
+	// and the URL cannot change when talking to the controller.  If these change,
+	// we will want a restart.
+	newServices := []controllerService{}
+	for _, key := range keys {
+		fetchedService := services[key]
+		if svc, found := m.services[key]; found && (invalidated[key] != 0 || svc.expired(now)) {
+			newServices = append(newServices, fetchedService)
+			continue
+		}
 		if svc, found := m.services[key]; found {
+			if svc.Session != fetchedService.Session {
+				m.audit.recordRotate(svc, fetchedService)
+				svc.Session = fetchedService.Session
+				m.services[key] = svc
+			}
 			if annotationsDifferent(svc, fetchedService) {
+				m.audit.recordModify(svc, fetchedService)
 				fetchedService.URL = svc.URL
 				fetchedService.Token = svc.Token
+				fetchedService.ExpiresAt = svc.ExpiresAt
 				m.services[key] = fetchedService
 				m.sendUpdate(fetchedService)
 			}
 			continue
 		}
-		url, token, err := m.getTokenAndURL(fetchedService)
-		if err != nil {
-			m.healthcheckStatus = err
-			log.Printf("unable to fetch service credentials from controller: %v", err)
-			return
+		newServices = append(newServices, fetchedService)
+	}
+
+	// Credentials are fetched concurrently, but applied in key order so
+	// updates are sent in the same order regardless of which fetch
+	// finished first.  Any which fail will be retried on the next sync.
+	results := m.fetchCredentials(ctx, newServices)
+	for i, fetchedService := range newServices {
+		if results[i].err != nil {
+			if m.healthcheckStatus == nil {
+				m.setHealthcheckStatus(results[i].err)
+			}
+			log.Printf("unable to fetch service credentials from controller: %v", results[i].err)
+			continue
+		}
+		key := fetchedService.key()
+		fetchedService.URL = results[i].url
+		fetchedService.Token = results[i].token
+		fetchedService.ExpiresAt = results[i].expiresAt
+		if previous, found := m.services[key]; found {
+			m.audit.recordRotate(previous, fetchedService)
+		} else {
+			m.audit.recordAdd(fetchedService)
 		}
-		fetchedService.URL = url
-		fetchedService.Token = token
 		m.services[key] = fetchedService
 		m.sendUpdate(fetchedService)
+		if seq, found := invalidated[key]; found {
+			m.clearInvalidation(key, seq)
+		}
+	}
+
+	// Invalidations of services which no longer exist are not needed.
+	for key, seq := range invalidated {
+		if _, found := services[key]; !found {
+			m.clearInvalidation(key, seq)
+		}
 	}
 
 	// now, remove any we don't currently see.
@@ -141,9 +284,129 @@ func (m *ControllerManager) reloadFromController() {
 		if _, found := services[key]; found {
 			continue
 		}
+		m.audit.recordRemove(service)
 		m.sendDelete(service)
 		delete(m.services, key)
+		if err := m.credentials.Invalidate(key); err != nil {
+			log.Printf("invalidating stored credentials for %s: %v", key, err)
+		}
+	}
+
+	m.lastSyncComplete = m.healthcheckStatus == nil
+}
+
+type credentialResult struct {
+	url       string
+	token     util.Secret
+	expiresAt time.Time
+	err       error
+}
+
+// fetchCredentials returns credentials for each service, from the
+// credential store if possible, otherwise from the controller, running at
+// most Config.CredentialFetchParallelism requests at once.  The results
+// are returned in the same order as services.
+func (m *ControllerManager) fetchCredentials(ctx context.Context, services []controllerService) []credentialResult {
+	results := make([]credentialResult, len(services))
+	sem := make(chan struct{}, m.conf.CredentialFetchParallelism)
+	var wg sync.WaitGroup
+	for i, s := range services {
+		wg.Add(1)
+		go func(i int, s controllerService) {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			case <-ctx.Done():
+				results[i].err = fmt.Errorf("fetching service credentials for %s: %v", s.key(), ctx.Err())
+				return
+			}
+			results[i] = m.getCredential(ctx, s)
+		}(i, s)
 	}
+	wg.Wait()
+	return results
+}
+
+// getCredential returns a stored credential for the service, or has the
+// controller issue a new one and stores it.
+func (m *ControllerManager) getCredential(ctx context.Context, s controllerService) credentialResult {
+	key := s.key()
+	c, found, err := m.credentials.Get(key)
+	if err != nil {
+		log.Printf("reading stored credentials for %s: %v", key, err)
+	}
+	if found {
+		return credentialResult{url: c.URL, token: c.Token, expiresAt: c.ExpiresAt}
+	}
+
+	c, err = m.client.ServiceCredentials(ctx, s.AgentName, s.Name, s.Type)
+	if err != nil {
+		return credentialResult{err: err}
+	}
+	c.ExpiresAt = c.IssuedAt.Add(m.credentialTTL)
+	if err := m.credentials.Put(key, c); err != nil {
+		log.Printf("storing credentials for %s: %v", key, err)
+	}
+	return credentialResult{url: c.URL, token: c.Token, expiresAt: c.ExpiresAt}
+}
+
+// InvalidateCredentials discards the credentials sent in an update, such
+// as when the service rejects them.  New credentials will be issued on
+// the next sync, and sent as another update.  If they cannot be fetched,
+// each later sync tries again.
+func (m *ControllerManager) InvalidateCredentials(u ServiceUpdate) {
+	key := endpointKey(u.AgentName, u.Name, u.Type)
+	if err := m.credentials.Invalidate(key); err != nil {
+		log.Printf("invalidating stored credentials for %s: %v", key, err)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.invalidated == nil {
+		m.invalidated = map[string]uint64{}
+	}
+	m.invalidations++
+	m.invalidated[key] = m.invalidations
+}
+
+// pendingInvalidations returns the invalidated keys.  They remain pending
+// until clearInvalidation() is called once new credentials are applied,
+// so a failed fetch is retried on the next sync.
+func (m *ControllerManager) pendingInvalidations() map[string]uint64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make(map[string]uint64, len(m.invalidated))
+	for key, seq := range m.invalidated {
+		ret[key] = seq
+	}
+	return ret
+}
+
+// clearInvalidation removes a pending invalidation, unless the key was
+// invalidated again since pendingInvalidations() returned seq.
+func (m *ControllerManager) clearInvalidation(key string, seq uint64) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.invalidated[key] == seq {
+		delete(m.invalidated, key)
+	}
+}
+
+func (m *ControllerManager) credentialsExpired(now time.Time) bool {
+	for _, s := range m.services {
+		if s.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s controllerService) expired(now time.Time) bool {
+	return !s.ExpiresAt.IsZero() && !now.Before(s.ExpiresAt)
+}
+
+func (s controllerService) key() string {
+	return endpointKey(s.AgentName, s.Name, s.Type)
 }
 
 func annotationsDifferent(a controllerService, b controllerService) bool {
@@ -159,7 +422,7 @@ func annotationsDifferent(a controllerService, b controllerService) bool {
 }
 
 func (m *ControllerManager) sendUpdate(s controllerService) {
-	m.UpdateChan <- ServiceUpdate{
+	m.dispatch(ServiceUpdate{
 		Operation:   "update",
 		Name:        s.Name,
 		Type:        s.Type,
@@ -167,193 +430,162 @@ func (m *ControllerManager) sendUpdate(s controllerService) {
 		Annotations: s.Annotations,
 		URL:         s.URL,
 		Token:       s.Token,
-	}
+	})
 }
 
 func (m *ControllerManager) sendDelete(s controllerService) {
-	m.UpdateChan <- ServiceUpdate{
+	m.dispatch(ServiceUpdate{
 		Operation: "delete",
 		Name:      s.Name,
 		Type:      s.Type,
 		AgentName: s.AgentName,
-	}
-}
-
-// Check returns the last error received during a sync, if any.
-// Used for a healthcheck status.
-func (m *ControllerManager) Check() error {
-	return m.healthcheckStatus
+	})
 }
 
-type connectedAgentsResponse struct {
-	ConnectedAgents []connectedAgent `json:"connectedAgents,omitempty"`
+// logExclusions reports newly excluded endpoints.  Those excluded on the
+// previous sync are not logged again.
+func (m *ControllerManager) logExclusions() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for key, e := range m.excluded {
+		if _, found := m.loggedExclusions[key]; !found {
+			log.Printf("excluding %s %s on agent %s: %s", e.Type, e.Name, e.AgentName, e.Reason)
+		}
+	}
+	m.loggedExclusions = m.excluded
 }
 
-type connectedAgent struct {
-	Name         string            `json:"name,omitempty"`
-	Annnotations map[string]string `json:"annotations,omitempty"`
-	Endpoints    []agentEndpoint   `json:"endpoints,omitempty"`
-	ConnectedAt  int64             `json:"connectedAt,omitempty"`
+// ExcludedServices returns the endpoints which were not used on the most
+// recent sync because their agent's version is outside the range configured
+// in Config.AgentVersions.
+func (m *ControllerManager) ExcludedServices() []ExcludedService {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return sortedExclusions(m.excluded)
 }
 
-type agentEndpoint struct {
-	Name         string            `json:"name,omitempty"`
-	Type         string            `json:"type,omitempty"`
-	Annnotations map[string]string `json:"annotations,omitempty"`
-	Configured   bool              `json:"configured,omitempty"`
+// Check returns the last error received during a sync, if any.
+// Used for a healthcheck status, see the health package.
+func (m *ControllerManager) Check() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.healthcheckStatus
 }
 
-type controllerServiceCredentialsRequest struct {
-	AgentName string `json:"agentName,omitempty"`
-	Type      string `json:"type,omitempty"`
-	Name      string `json:"name,omitempty"`
+// setHealthcheckStatus is only called from the sync goroutine, which
+// may read healthcheckStatus without the lock.
+func (m *ControllerManager) setHealthcheckStatus(err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.healthcheckStatus = err
 }
 
-type controllerServiceCredentialResponse struct {
-	AgentName      string `json:"agentName,omitempty"`
-	Name           string `json:"name,omitempty"`
-	Type           string `json:"type,omitempty"`
-	CredentialType string `json:"credentialType,omitempty"`
-	Credential     struct {
-		Password string `json:"password,omitempty"`
-	} `json:"credential,omitempty"`
-	URL string `json:"url,omitempty"`
+// rawAgentStatistics defers decoding each agent, so agents whose JSON
+// has not changed since the last poll need not be decoded again.
+type rawAgentStatistics struct {
+	ServerTime      int64             `json:"serverTime,omitempty"`
+	Version         string            `json:"version,omitempty"`
+	ConnectedAgents []json.RawMessage `json:"connectedAgents,omitempty"`
 }
 
-func (m *ControllerManager) makeRequest(method string, url string, body io.Reader) (*http.Request, error) {
-	req, err := http.NewRequest(method, url, body)
-	if err != nil {
-		return nil, err
+// hash covers everything except serverTime, which changes on every
+// response even when nothing else has.
+func (stats rawAgentStatistics) hash() [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte(stats.Version))
+	for _, raw := range stats.ConnectedAgents {
+		h.Write([]byte{0})
+		h.Write(raw)
 	}
-	req.Header.Set("content-type", "application/json")
-	req.Header.Set("authorization", "Bearer "+m.conf.Token)
-	return req, nil
+	var ret [sha256.Size]byte
+	copy(ret[:], h.Sum(nil))
+	return ret
 }
 
-func (m *ControllerManager) getTokenAndURL(s controllerService) (serviceUrl string, serviceToken string, err error) {
-	url, err := url.JoinPath(m.conf.URL, "/api/v1/generateServiceCredentials")
-	if err != nil {
-		return
-	}
-
-	client, err := m.getTLSClient()
-	if err != nil {
-		return "", "", fmt.Errorf("making TLS client: %v", err)
-	}
-
-	credentialsRequest := controllerServiceCredentialsRequest{
-		AgentName: s.AgentName,
-		Name:      s.Name,
-		Type:      s.Type,
-	}
-
-	d, err := json.Marshal(credentialsRequest)
-	if err != nil {
-		return
-	}
-	r := bytes.NewReader(d)
-	req, err := m.makeRequest(http.MethodPost, url, r)
-	if err != nil {
-		return
+func decodeAgentStatistics(data []byte) (rawAgentStatistics, error) {
+	var stats rawAgentStatistics
+	if err := json.Unmarshal(data, &stats); err != nil {
+		return stats, fmt.Errorf("cannot decode connected agent JSON: %v", err)
 	}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", "", fmt.Errorf("fetching service credentials: %v", err)
-	}
-	defer resp.Body.Close()
+	return stats, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return "", "", fmt.Errorf("fetching service credentials: http status %d", resp.StatusCode)
-	}
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", "", fmt.Errorf("reading body: %v", err)
+// getArgoServices returns the services the controller currently offers,
+// and false if the controller's response has not changed since the last
+// call, in which case the previously returned services are returned again.
+//
+// The controller's ETag is sent as If-None-Match, and if the controller
+// does not support conditional requests, a hash of the body is compared
+// instead.
+func (m *ControllerManager) getArgoServices(ctx context.Context) (map[string]controllerService, bool, error) {
+	etag := ""
+	if m.lastFetched != nil {
+		etag = m.etag
 	}
-
-	var creds controllerServiceCredentialResponse
-	err = json.Unmarshal(data, &creds)
+	start := time.Now()
+	data, newETag, notModified, err := m.client.fetchAgentStatistics(ctx, etag)
 	if err != nil {
-		return "", "", fmt.Errorf("cannot decode service credentials JSON: %v", err)
+		return map[string]controllerService{}, false, err
 	}
-
-	return creds.URL, creds.Credential.Password, nil
-}
-
-func (m *ControllerManager) getArgoServices() (map[string]controllerService, error) {
-	url, err := url.JoinPath(m.conf.URL, "/api/v1/getAgentStatistics")
-	if err != nil {
-		return map[string]controllerService{}, fmt.Errorf("joining url: %v", err)
+	end := time.Now()
+	if notModified && m.lastFetched != nil {
+		return m.lastFetched, false, nil
 	}
 
-	client, err := m.getTLSClient()
+	stats, err := decodeAgentStatistics(data)
 	if err != nil {
-		return map[string]controllerService{}, fmt.Errorf("making TLS client: %v", err)
+		return map[string]controllerService{}, false, err
 	}
-
-	req, err := m.makeRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return map[string]controllerService{}, fmt.Errorf("making connected agents request: %v", err)
+	m.observeServerTime(stats.ServerTime, start, end)
+	if err := m.observeControllerVersion(stats.Version); err != nil {
+		return map[string]controllerService{}, false, err
 	}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return map[string]controllerService{}, fmt.Errorf("fetching connected agents: %v", err)
+	hash := stats.hash()
+	if m.lastFetched != nil && hash == m.bodyHash {
+		m.etag = newETag
+		return m.lastFetched, false, nil
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return map[string]controllerService{}, fmt.Errorf("fetching connnected agents: http status %d", resp.StatusCode)
-	}
-	data, err := io.ReadAll(resp.Body)
+	services, err := m.servicesFromStatistics(stats)
 	if err != nil {
-		return map[string]controllerService{}, fmt.Errorf("reading body: %v", err)
+		return map[string]controllerService{}, false, err
 	}
-
-	return m.parseAgentStatistics(data)
-}
-
-type serviceList struct {
-	connectedAt int64
-	endpoints   []agentEndpoint
+	m.etag = newETag
+	m.bodyHash = hash
+	m.lastFetched = services
+	return services, true, nil
 }
 
 func (m *ControllerManager) parseAgentStatistics(data []byte) (map[string]controllerService, error) {
-	var ca connectedAgentsResponse
-	err := json.Unmarshal(data, &ca)
+	stats, err := decodeAgentStatistics(data)
 	if err != nil {
-		return map[string]controllerService{}, fmt.Errorf("cannot decode connected agent JSON: %v", err)
+		return map[string]controllerService{}, err
 	}
+	return m.servicesFromStatistics(stats)
+}
 
-	newestAgents := map[string]serviceList{}
-	// Find the newest versions of each agent, based on connect time.
-	for _, a := range ca.ConnectedAgents {
-		f, found := newestAgents[a.Name]
-		if !found || f.connectedAt < a.ConnectedAt {
-			newestAgents[a.Name] = serviceList{
-				connectedAt: a.ConnectedAt,
-				endpoints:   a.Endpoints,
+func (m *ControllerManager) servicesFromStatistics(stats rawAgentStatistics) (map[string]controllerService, error) {
+	agentCache := make(map[[sha256.Size]byte]Agent, len(stats.ConnectedAgents))
+	agents := make([]Agent, 0, len(stats.ConnectedAgents))
+	for _, raw := range stats.ConnectedAgents {
+		hash := sha256.Sum256(raw)
+		a, found := m.agentCache[hash]
+		if !found {
+			if err := json.Unmarshal(raw, &a); err != nil {
+				return map[string]controllerService{}, fmt.Errorf("cannot decode connected agent JSON: %v", err)
 			}
 		}
+		agentCache[hash] = a
+		agents = append(agents, a)
 	}
+	m.agentCache = agentCache
 
-	endpoints := map[string]controllerService{}
+	endpoints, excluded := m.filter.filter(agents)
 
-	for agentName, agent := range newestAgents {
-		for _, ep := range agent.endpoints {
-			if !ep.Configured || !util.Contains(m.serviceTypes, ep.Type) {
-				continue
-			}
-			key := agentName + ":" + ep.Name + ":" + ep.Type
-			endpoints[key] = controllerService{AgentName: agentName, Name: ep.Name, Type: ep.Type, Annotations: ep.Annnotations}
-		}
-	}
+	m.lock.Lock()
+	m.excluded = excluded
+	m.lock.Unlock()
 
 	return endpoints, nil
 }
-
-func (m *ControllerManager) getTLSClient() (*http.Client, error) {
-	tlsConfig := tls.Config{
-		MinVersion: tls.VersionTLS13,
-	}
-	return httputil.NewHTTPClient(&tlsConfig), nil
-}
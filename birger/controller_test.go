@@ -15,10 +15,23 @@
 package birger
 
 import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/OpsMx/go-app-base/health"
+	"github.com/OpsMx/go-app-base/httputil"
+	"github.com/OpsMx/go-app-base/util"
+	"github.com/stretchr/testify/require"
 )
 
+var _ health.Checker = (*ControllerManager)(nil)
+
 func Test_parseAgentStatistics(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -73,6 +86,7 @@ func Test_parseAgentStatistics(t *testing.T) {
 					Name:      "whoami",
 					Type:      "whoami",
 					AgentName: "smith",
+					Session:   "0001HH270W7TD8DZZ6STNY2ASX",
 					Annotations: map[string]string{
 						"description": "demo service",
 					},
@@ -170,6 +184,7 @@ func Test_parseAgentStatistics(t *testing.T) {
 					Name:      "whoami",
 					Type:      "whoami",
 					AgentName: "smith",
+					Session:   "session-one",
 					Annotations: map[string]string{
 						"description":     "demo service",
 						"otherAnnotation": "newer annotation",
@@ -181,7 +196,9 @@ func Test_parseAgentStatistics(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			m := ControllerManager{serviceTypes: tt.filter}
+			subscriptions, err := compileTypePatterns(tt.filter)
+			require.NoError(t, err)
+			m := ControllerManager{filter: ServiceFilter{subscriptions: subscriptions}}
 			got, err := m.parseAgentStatistics(tt.data)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("parseAgentStatistics() error = %v, wantErr %v", err, tt.wantErr)
@@ -193,3 +210,352 @@ func Test_parseAgentStatistics(t *testing.T) {
 		})
 	}
 }
+
+func Test_parseAgentStatistics_versionGating(t *testing.T) {
+	data := []byte(`
+		{
+			"connectedAgents": [
+				{
+					"name": "old",
+					"version": "v3.4.6-6-g4eee038",
+					"endpoints": [{"name": "argo", "type": "argocd", "configured": true}]
+				},
+				{
+					"name": "new",
+					"version": "v3.5.0",
+					"endpoints": [{"name": "argo", "type": "argocd", "configured": true}]
+				},
+				{
+					"name": "dev",
+					"version": "dev",
+					"endpoints": [{"name": "argo", "type": "argocd", "configured": true}]
+				},
+				{
+					"name": "other",
+					"version": "dev",
+					"endpoints": [{"name": "jenkins", "type": "jenkins", "configured": true}]
+				}
+			]
+		}
+	`)
+	conf := Config{
+		AgentVersions: map[string]VersionConstraint{
+			"argocd": {Min: "v3.4.7"},
+		},
+	}
+	ranges, err := conf.parseVersionConstraints()
+	require.NoError(t, err)
+	subscriptions, err := compileTypePatterns([]string{"argocd", "jenkins"})
+	require.NoError(t, err)
+	m := ControllerManager{filter: ServiceFilter{subscriptions: subscriptions, versionRanges: ranges}}
+
+	got, err := m.parseAgentStatistics(data)
+	require.NoError(t, err)
+	require.Equal(t, map[string]controllerService{
+		"new:argo:argocd":       {AgentName: "new", Name: "argo", Type: "argocd"},
+		"other:jenkins:jenkins": {AgentName: "other", Name: "jenkins", Type: "jenkins"},
+	}, got)
+
+	require.Equal(t, []ExcludedService{
+		{
+			Name:         "argo",
+			Type:         "argocd",
+			AgentName:    "dev",
+			AgentVersion: "dev",
+			Reason:       `agent version "dev" cannot be parsed`,
+		}, {
+			Name:         "argo",
+			Type:         "argocd",
+			AgentName:    "old",
+			AgentVersion: "v3.4.6-6-g4eee038",
+			Reason:       "agent version v3.4.6-6-g4eee038 is older than minimum v3.4.7",
+		},
+	}, m.ExcludedServices())
+}
+
+type fakeController struct {
+	version      string
+	serverTime   func() int64
+	agents       []Agent
+	failAgents   map[string]bool
+	etag         string
+	inFlight     int32
+	maxInFlight  int32
+	credRequests int32
+	notModified  int32
+}
+
+func (fc *fakeController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/v1/getAgentStatistics":
+		if fc.etag != "" {
+			if r.Header.Get("if-none-match") == fc.etag {
+				atomic.AddInt32(&fc.notModified, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("etag", fc.etag)
+		}
+		stats := AgentStatistics{Version: fc.version, ConnectedAgents: fc.agents}
+		if fc.serverTime != nil {
+			stats.ServerTime = fc.serverTime()
+		}
+		d, _ := json.Marshal(stats)
+		_, _ = w.Write(d)
+	case "/api/v1/generateServiceCredentials":
+		atomic.AddInt32(&fc.credRequests, 1)
+		n := atomic.AddInt32(&fc.inFlight, 1)
+		defer atomic.AddInt32(&fc.inFlight, -1)
+		for {
+			prev := atomic.LoadInt32(&fc.maxInFlight)
+			if n <= prev || atomic.CompareAndSwapInt32(&fc.maxInFlight, prev, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		var req controllerServiceCredentialsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || fc.failAgents[req.AgentName] {
+			httputil.SetError(w, http.StatusInternalServerError, "agent not connected")
+			return
+		}
+		resp := controllerServiceCredentialResponse{
+			AgentName: req.AgentName,
+			Name:      req.Name,
+			Type:      req.Type,
+			URL:       "https://" + req.AgentName,
+		}
+		resp.Credential.Password = "token-" + req.AgentName
+		d, _ := json.Marshal(resp)
+		_, _ = w.Write(d)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func makeTestControllerManager(t *testing.T, conf Config) *ControllerManager {
+	conf.applyDefaults()
+	subscriptions, err := compileTypePatterns([]string{"argocd"})
+	require.NoError(t, err)
+	store, err := conf.CredentialStore.makeStore()
+	require.NoError(t, err)
+	return &ControllerManager{
+		conf:          conf,
+		client:        &Client{conf: conf},
+		filter:        ServiceFilter{subscriptions: subscriptions},
+		credentials:   store,
+		credentialTTL: time.Duration(conf.CredentialStore.TTLSeconds) * time.Second,
+		syncTimeout:   10 * time.Second,
+		services:      map[string]controllerService{},
+		UpdateChan:    make(chan ServiceUpdate, 20),
+	}
+}
+
+func TestControllerManager_reloadFromController_parallelCredentials(t *testing.T) {
+	fc := &fakeController{failAgents: map[string]bool{"agent-03": true}}
+	for i := 0; i < 10; i++ {
+		fc.agents = append(fc.agents, Agent{
+			Name:      fmt.Sprintf("agent-%02d", i),
+			Endpoints: []AgentEndpoint{{Name: "argo", Type: "argocd", Configured: true}},
+		})
+	}
+	server := httptest.NewServer(fc)
+	defer server.Close()
+
+	m := makeTestControllerManager(t, Config{URL: server.URL, Token: util.NewSecret("abc"), CredentialFetchParallelism: 3})
+	m.reloadFromController()
+	close(m.UpdateChan)
+
+	require.Error(t, m.Check())
+	require.LessOrEqual(t, atomic.LoadInt32(&fc.maxInFlight), int32(3))
+	require.Len(t, m.services, 9)
+
+	agents := []string{}
+	for u := range m.UpdateChan {
+		require.Equal(t, "https://"+u.AgentName, u.URL)
+		require.Equal(t, "token-"+u.AgentName, u.Token.Reveal())
+		agents = append(agents, u.AgentName)
+	}
+	require.Equal(t, []string{
+		"agent-00", "agent-01", "agent-02", "agent-04", "agent-05",
+		"agent-06", "agent-07", "agent-08", "agent-09",
+	}, agents)
+}
+
+func TestControllerManager_reloadFromController_unchanged(t *testing.T) {
+	tests := []struct {
+		name            string
+		etag            string
+		wantNotModified int32
+	}{
+		{"etag", `"v1"`, 2},
+		{"content hash", "", 0},
+	}
+	var serverTime int64
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fc := &fakeController{
+				etag:       tt.etag,
+				serverTime: func() int64 { return atomic.AddInt64(&serverTime, 1) },
+				failAgents: map[string]bool{"bad": true},
+				agents: []Agent{
+					{Name: "good", Endpoints: []AgentEndpoint{{Name: "argo", Type: "argocd", Configured: true}}},
+					{Name: "bad", Endpoints: []AgentEndpoint{{Name: "argo", Type: "argocd", Configured: true}}},
+				},
+			}
+			server := httptest.NewServer(fc)
+			defer server.Close()
+			m := makeTestControllerManager(t, Config{URL: server.URL, Token: util.NewSecret("abc")})
+
+			m.reloadFromController()
+			require.Error(t, m.Check())
+			require.Len(t, m.UpdateChan, 1)
+			require.Equal(t, int32(2), atomic.LoadInt32(&fc.credRequests))
+
+			// unchanged, but the failed credentials are retried.
+			fc.failAgents = map[string]bool{}
+			m.reloadFromController()
+			require.NoError(t, m.Check())
+			require.Len(t, m.UpdateChan, 2)
+			require.Equal(t, int32(3), atomic.LoadInt32(&fc.credRequests))
+
+			// unchanged and complete, so nothing is done.
+			m.reloadFromController()
+			require.NoError(t, m.Check())
+			require.Len(t, m.UpdateChan, 2)
+			require.Equal(t, int32(3), atomic.LoadInt32(&fc.credRequests))
+			require.Equal(t, tt.wantNotModified, atomic.LoadInt32(&fc.notModified))
+
+			// a changed response is diffed.
+			fc.agents = fc.agents[:1]
+			fc.etag = ""
+			m.reloadFromController()
+			require.NoError(t, m.Check())
+			require.Len(t, m.UpdateChan, 3)
+			require.Len(t, m.services, 1)
+		})
+	}
+}
+
+func TestControllerManager_InvalidateCredentials_retriedAfterFailure(t *testing.T) {
+	fc := &fakeController{
+		agents: []Agent{
+			{Name: "smith", Endpoints: []AgentEndpoint{{Name: "argo", Type: "argocd", Configured: true}}},
+		},
+	}
+	server := httptest.NewServer(fc)
+	defer server.Close()
+	m := makeTestControllerManager(t, Config{URL: server.URL, Token: util.NewSecret("abc")})
+
+	m.reloadFromController()
+	require.NoError(t, m.Check())
+	u := <-m.UpdateChan
+	require.Equal(t, int32(1), atomic.LoadInt32(&fc.credRequests))
+
+	// the refetch fails, so the invalidation stays pending.
+	m.InvalidateCredentials(u)
+	fc.failAgents = map[string]bool{"smith": true}
+	m.reloadFromController()
+	require.Error(t, m.Check())
+	require.Equal(t, int32(2), atomic.LoadInt32(&fc.credRequests))
+	require.Len(t, m.UpdateChan, 0)
+	require.Contains(t, m.pendingInvalidations(), "smith:argo:argocd")
+
+	// the next sync fetches it again, and the new credential is sent.
+	fc.failAgents = nil
+	m.reloadFromController()
+	require.NoError(t, m.Check())
+	require.Equal(t, int32(3), atomic.LoadInt32(&fc.credRequests))
+	require.Len(t, m.UpdateChan, 1)
+	require.Equal(t, "token-smith", (<-m.UpdateChan).Token.Reveal())
+	require.Empty(t, m.pendingInvalidations())
+
+	// with nothing pending, later syncs do not fetch it again.
+	m.reloadFromController()
+	require.Equal(t, int32(3), atomic.LoadInt32(&fc.credRequests))
+}
+
+func TestControllerManager_clearInvalidation(t *testing.T) {
+	m := &ControllerManager{credentials: NewMemoryCredentialStore()}
+	u := ServiceUpdate{AgentName: "smith", Name: "argo", Type: "argocd"}
+	m.InvalidateCredentials(u)
+	pending := m.pendingInvalidations()
+
+	// invalidated again during the sync, so it stays pending.
+	m.InvalidateCredentials(u)
+	m.clearInvalidation("smith:argo:argocd", pending["smith:argo:argocd"])
+	require.Len(t, m.pendingInvalidations(), 1)
+
+	m.clearInvalidation("smith:argo:argocd", m.pendingInvalidations()["smith:argo:argocd"])
+	require.Empty(t, m.pendingInvalidations())
+}
+
+func TestControllerManager_reloadFromController_credentialStore(t *testing.T) {
+	fc := &fakeController{
+		agents: []Agent{
+			{Name: "smith", Endpoints: []AgentEndpoint{{Name: "argo", Type: "argocd", Configured: true}}},
+		},
+	}
+	server := httptest.NewServer(fc)
+	defer server.Close()
+
+	store := NewMemoryCredentialStore()
+	require.NoError(t, store.Put("smith:argo:argocd", Credential{URL: "https://peer", Token: util.NewSecret("peer-token")}))
+	m := makeTestControllerManager(t, Config{
+		URL:             server.URL,
+		Token:           util.NewSecret("abc"),
+		CredentialStore: CredentialStoreConfig{Store: store},
+	})
+
+	// a credential issued to a peer is reused.
+	m.reloadFromController()
+	require.NoError(t, m.Check())
+	require.Equal(t, int32(0), atomic.LoadInt32(&fc.credRequests))
+	u := <-m.UpdateChan
+	require.Equal(t, "peer-token", u.Token.Reveal())
+
+	// once invalidated, a new one is issued and stored.
+	m.InvalidateCredentials(u)
+	m.reloadFromController()
+	require.Equal(t, int32(1), atomic.LoadInt32(&fc.credRequests))
+	u = <-m.UpdateChan
+	require.Equal(t, "token-smith", u.Token.Reveal())
+	c, found, err := store.Get("smith:argo:argocd")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Equal(t, "token-smith", c.Token.Reveal())
+
+	// expired credentials are re-issued.
+	svc := m.services["smith:argo:argocd"]
+	svc.ExpiresAt = time.Now().Add(-time.Second)
+	m.services["smith:argo:argocd"] = svc
+	require.NoError(t, store.Invalidate("smith:argo:argocd"))
+	m.reloadFromController()
+	require.Equal(t, int32(2), atomic.LoadInt32(&fc.credRequests))
+	require.Len(t, m.UpdateChan, 1)
+	<-m.UpdateChan
+
+	// an annotation change keeps the expiry, so it is still re-issued.
+	svc = m.services["smith:argo:argocd"]
+	expiresAt := time.Now().Add(50 * time.Millisecond)
+	svc.ExpiresAt = expiresAt
+	m.services["smith:argo:argocd"] = svc
+	fc.agents[0].Endpoints[0].Annotations = map[string]string{"team": "blue"}
+	m.reloadFromController()
+	require.Equal(t, int32(2), atomic.LoadInt32(&fc.credRequests))
+	require.Equal(t, "blue", (<-m.UpdateChan).Annotations["team"])
+	require.True(t, expiresAt.Equal(m.services["smith:argo:argocd"].ExpiresAt))
+	time.Sleep(time.Until(expiresAt))
+	require.NoError(t, store.Invalidate("smith:argo:argocd"))
+	m.reloadFromController()
+	require.Equal(t, int32(3), atomic.LoadInt32(&fc.credRequests))
+	require.Len(t, m.UpdateChan, 1)
+	<-m.UpdateChan
+
+	// removed services have their credentials invalidated.
+	fc.agents = nil
+	m.reloadFromController()
+	_, found, err = store.Get("smith:argo:argocd")
+	require.NoError(t, err)
+	require.False(t, found)
+}
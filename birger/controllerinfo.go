@@ -0,0 +1,102 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/OpsMx/go-app-base/version"
+)
+
+// observeServerTime estimates how far the controller's clock is ahead of
+// ours, assuming serverTime was taken halfway through the request.
+func (m *ControllerManager) observeServerTime(serverTime int64, start time.Time, end time.Time) {
+	if serverTime == 0 {
+		return
+	}
+	midpoint := start.Add(end.Sub(start) / 2)
+	skew := time.UnixMilli(serverTime).Sub(midpoint)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.clockSkew = skew
+	exceeded := m.maxClockSkew > 0 && (skew > m.maxClockSkew || skew < -m.maxClockSkew)
+	if exceeded && !m.skewWarned {
+		log.Printf("controller clock differs from ours by %v, more than %v", skew.Round(time.Millisecond), m.maxClockSkew)
+	}
+	if !exceeded && m.skewWarned {
+		log.Printf("controller clock now differs from ours by %v", skew.Round(time.Millisecond))
+	}
+	m.skewWarned = exceeded
+}
+
+// observeControllerVersion records the controller's version, and returns
+// an error if it is older than Config.MinControllerVersion.
+func (m *ControllerManager) observeControllerVersion(v string) error {
+	m.lock.Lock()
+	changed := m.controllerVersion != v
+	m.controllerVersion = v
+	m.lock.Unlock()
+	if changed {
+		log.Printf("controller version is %q", v)
+	}
+
+	if m.minController == nil {
+		return nil
+	}
+	parsed, err := version.ParseSemver(v)
+	if err != nil {
+		return fmt.Errorf("controller version %q cannot be compared to minimum %s", v, m.minController)
+	}
+	if parsed.Compare(*m.minController) < 0 {
+		return fmt.Errorf("controller version %s is older than minimum %s", v, m.minController)
+	}
+	return nil
+}
+
+// ClockSkew returns how far the controller's clock was ahead of ours, or
+// behind if negative, as of the last sync.
+func (m *ControllerManager) ClockSkew() time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.clockSkew
+}
+
+// ControllerVersion returns the version the controller reported on the
+// last sync, or an empty string if it has not yet been seen.
+func (m *ControllerManager) ControllerVersion() string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.controllerVersion
+}
+
+// ControllerVersionAtLeast returns true if the controller's version is
+// the same as or newer than minimum, so optional behaviour can be enabled
+// only for controllers which support it.  An error is returned if either
+// version cannot be parsed, including when no sync has completed yet.
+func (m *ControllerManager) ControllerVersionAtLeast(minimum string) (bool, error) {
+	want, err := version.ParseSemver(minimum)
+	if err != nil {
+		return false, err
+	}
+	current := m.ControllerVersion()
+	have, err := version.ParseSemver(current)
+	if err != nil {
+		return false, fmt.Errorf("controller version: %v", err)
+	}
+	return have.Compare(want) >= 0, nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/OpsMx/go-app-base/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControllerManager_observeServerTime(t *testing.T) {
+	m := ControllerManager{maxClockSkew: 30 * time.Second}
+	start := time.UnixMilli(1662067500000)
+	end := start.Add(2 * time.Second)
+
+	m.observeServerTime(1662067501000+45000, start, end)
+	require.Equal(t, 45*time.Second, m.ClockSkew())
+	require.True(t, m.skewWarned)
+
+	m.observeServerTime(1662067501000-2000, start, end)
+	require.Equal(t, -2*time.Second, m.ClockSkew())
+	require.False(t, m.skewWarned)
+
+	// a missing serverTime leaves the last value.
+	m.observeServerTime(0, start, end)
+	require.Equal(t, -2*time.Second, m.ClockSkew())
+}
+
+func TestControllerManager_ControllerVersionAtLeast(t *testing.T) {
+	m := ControllerManager{}
+	_, err := m.ControllerVersionAtLeast("v3.4.0")
+	require.Error(t, err)
+
+	require.NoError(t, m.observeControllerVersion("v3.4.6-6-g4eee038"))
+	require.Equal(t, "v3.4.6-6-g4eee038", m.ControllerVersion())
+
+	ok, err := m.ControllerVersionAtLeast("v3.4.6")
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = m.ControllerVersionAtLeast("v3.5.0")
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, err = m.ControllerVersionAtLeast("latest")
+	require.Error(t, err)
+}
+
+func TestControllerManager_minControllerVersion(t *testing.T) {
+	fc := &fakeController{
+		version: "v3.3.0",
+		agents: []Agent{
+			{Name: "smith", Endpoints: []AgentEndpoint{{Name: "argo", Type: "argocd", Configured: true}}},
+		},
+	}
+	server := httptest.NewServer(fc)
+	defer server.Close()
+
+	conf := Config{URL: server.URL, Token: util.NewSecret("abc"), MinControllerVersion: "v3.4.0"}
+	minimum, err := conf.parseMinControllerVersion()
+	require.NoError(t, err)
+	m := makeTestControllerManager(t, conf)
+	m.minController = minimum
+
+	m.reloadFromController()
+	require.EqualError(t, m.Check(), "controller version v3.3.0 is older than minimum v3.4.0")
+	require.Empty(t, m.services)
+
+	fc.version = "dev"
+	m.reloadFromController()
+	require.Error(t, m.Check())
+
+	fc.version = "v3.4.6-6-g4eee038"
+	m.reloadFromController()
+	require.NoError(t, m.Check())
+	require.Len(t, m.services, 1)
+}
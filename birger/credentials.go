@@ -0,0 +1,254 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/OpsMx/go-app-base/util"
+)
+
+// Credential is a service URL and token issued by the controller.
+// The Token is redacted when marshalled.
+type Credential struct {
+	URL       string      `json:"url"`
+	Token     util.Secret `json:"token"`
+	IssuedAt  time.Time   `json:"issuedAt"`
+	ExpiresAt time.Time   `json:"expiresAt,omitempty"`
+}
+
+// storedCredential is the form of a Credential written by
+// FileCredentialStore, which unlike Credential keeps the token.
+type storedCredential struct {
+	URL       string    `json:"url"`
+	Token     string    `json:"token"`
+	IssuedAt  time.Time `json:"issuedAt"`
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+}
+
+func (c Credential) expired(now time.Time) bool {
+	return !c.ExpiresAt.IsZero() && !now.Before(c.ExpiresAt)
+}
+
+// CredentialStore holds credentials issued by the controller so they
+// can be reused, possibly by other replicas, rather than issuing new
+// ones for every endpoint each time a process starts.
+//
+// Keys are of the form `agentName:serviceName:serviceType`.
+type CredentialStore interface {
+	// Get returns the stored credential, and false if there is none
+	// or it has expired.
+	Get(key string) (Credential, bool, error)
+	// Put stores a credential, replacing any existing one.
+	Put(key string, c Credential) error
+	// Invalidate removes a credential so it will not be reused.
+	Invalidate(key string) error
+}
+
+// MemoryCredentialStore is a CredentialStore which is local to this
+// process.  It is used if no other store is configured.
+type MemoryCredentialStore struct {
+	lock  sync.Mutex
+	creds map[string]Credential
+	now   func() time.Time
+}
+
+// NewMemoryCredentialStore returns an empty MemoryCredentialStore.
+func NewMemoryCredentialStore() *MemoryCredentialStore {
+	return &MemoryCredentialStore{
+		creds: map[string]Credential{},
+		now:   time.Now,
+	}
+}
+
+// Get implements CredentialStore.
+func (s *MemoryCredentialStore) Get(key string) (Credential, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	c, found := s.creds[key]
+	if !found || c.expired(s.now()) {
+		return Credential{}, false, nil
+	}
+	return c, true, nil
+}
+
+// Put implements CredentialStore.
+func (s *MemoryCredentialStore) Put(key string, c Credential) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.creds[key] = c
+	return nil
+}
+
+// Invalidate implements CredentialStore.
+func (s *MemoryCredentialStore) Invalidate(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.creds, key)
+	return nil
+}
+
+// FileCredentialStore is a CredentialStore kept in a single JSON file,
+// so replicas sharing a volume can reuse credentials issued to each other.
+// Access is serialized between processes using flock() on a lock file
+// next to it, and the file is replaced atomically on each change.
+type FileCredentialStore struct {
+	path     string
+	lockPath string
+	now      func() time.Time
+}
+
+// NewFileCredentialStore returns a FileCredentialStore using path,
+// creating its directory if needed.  The file itself is created on
+// the first Put().
+func NewFileCredentialStore(path string) (*FileCredentialStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("creating credential store directory: %v", err)
+	}
+	return &FileCredentialStore{
+		path:     path,
+		lockPath: path + ".lock",
+		now:      time.Now,
+	}, nil
+}
+
+// withLock runs f while holding a shared or exclusive lock on the store.
+func (s *FileCredentialStore) withLock(exclusive bool, f func() error) error {
+	lf, err := os.OpenFile(s.lockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return fmt.Errorf("opening credential store lock: %v", err)
+	}
+	defer lf.Close()
+	if err := lockFile(lf, exclusive); err != nil {
+		return fmt.Errorf("locking credential store: %v", err)
+	}
+	defer func() {
+		_ = unlockFile(lf)
+	}()
+	return f()
+}
+
+func (s *FileCredentialStore) read() (map[string]Credential, error) {
+	creds := map[string]Credential{}
+	d, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return creds, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading credential store: %v", err)
+	}
+	stored := map[string]storedCredential{}
+	if err := json.Unmarshal(d, &stored); err != nil {
+		return nil, fmt.Errorf("decoding credential store: %v", err)
+	}
+	for k, sc := range stored {
+		creds[k] = Credential{
+			URL:       sc.URL,
+			Token:     util.NewSecret(sc.Token),
+			IssuedAt:  sc.IssuedAt,
+			ExpiresAt: sc.ExpiresAt,
+		}
+	}
+	return creds, nil
+}
+
+func (s *FileCredentialStore) write(creds map[string]Credential) error {
+	stored := make(map[string]storedCredential, len(creds))
+	for k, c := range creds {
+		stored[k] = storedCredential{
+			URL:       c.URL,
+			Token:     c.Token.Reveal(),
+			IssuedAt:  c.IssuedAt,
+			ExpiresAt: c.ExpiresAt,
+		}
+	}
+	d, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("encoding credential store: %v", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("writing credential store: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(d); err != nil {
+		f.Close()
+		return fmt.Errorf("writing credential store: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("writing credential store: %v", err)
+	}
+	if err := os.Rename(f.Name(), s.path); err != nil {
+		return fmt.Errorf("writing credential store: %v", err)
+	}
+	return nil
+}
+
+// Get implements CredentialStore.
+func (s *FileCredentialStore) Get(key string) (Credential, bool, error) {
+	var c Credential
+	var found bool
+	err := s.withLock(false, func() error {
+		creds, err := s.read()
+		if err != nil {
+			return err
+		}
+		c, found = creds[key]
+		return nil
+	})
+	if err != nil || !found || c.expired(s.now()) {
+		return Credential{}, false, err
+	}
+	return c, true, nil
+}
+
+// Put implements CredentialStore.  Expired credentials from any
+// replica are removed at the same time.
+func (s *FileCredentialStore) Put(key string, c Credential) error {
+	return s.withLock(true, func() error {
+		creds, err := s.read()
+		if err != nil {
+			return err
+		}
+		now := s.now()
+		for k, existing := range creds {
+			if existing.expired(now) {
+				delete(creds, k)
+			}
+		}
+		creds[key] = c
+		return s.write(creds)
+	})
+}
+
+// Invalidate implements CredentialStore.
+func (s *FileCredentialStore) Invalidate(key string) error {
+	return s.withLock(true, func() error {
+		creds, err := s.read()
+		if err != nil {
+			return err
+		}
+		if _, found := creds[key]; !found {
+			return nil
+		}
+		delete(creds, key)
+		return s.write(creds)
+	})
+}
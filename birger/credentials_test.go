@@ -0,0 +1,93 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpsMx/go-app-base/util"
+	"github.com/stretchr/testify/require"
+)
+
+func testCredentialStore(t *testing.T, store CredentialStore, setNow func(time.Time)) {
+	now := time.Unix(1662067531, 0)
+	setNow(now)
+
+	_, found, err := store.Get("a:b:c")
+	require.NoError(t, err)
+	require.False(t, found)
+
+	c := Credential{URL: "https://x", Token: util.NewSecret("abc"), IssuedAt: now, ExpiresAt: now.Add(time.Minute)}
+	require.NoError(t, store.Put("a:b:c", c))
+	got, found, err := store.Get("a:b:c")
+	require.NoError(t, err)
+	require.True(t, found)
+	require.True(t, c.ExpiresAt.Equal(got.ExpiresAt))
+	require.Equal(t, "abc", got.Token.Reveal())
+
+	setNow(now.Add(time.Minute))
+	_, found, err = store.Get("a:b:c")
+	require.NoError(t, err)
+	require.False(t, found)
+
+	setNow(now)
+	require.NoError(t, store.Invalidate("a:b:c"))
+	_, found, err = store.Get("a:b:c")
+	require.NoError(t, err)
+	require.False(t, found)
+	require.NoError(t, store.Invalidate("a:b:c"))
+}
+
+func TestMemoryCredentialStore(t *testing.T) {
+	store := NewMemoryCredentialStore()
+	testCredentialStore(t, store, func(now time.Time) { store.now = func() time.Time { return now } })
+}
+
+func TestFileCredentialStore(t *testing.T) {
+	store, err := NewFileCredentialStore(filepath.Join(t.TempDir(), "creds", "store.json"))
+	require.NoError(t, err)
+	testCredentialStore(t, store, func(now time.Time) { store.now = func() time.Time { return now } })
+}
+
+func TestFileCredentialStore_shared(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	a, err := NewFileCredentialStore(path)
+	require.NoError(t, err)
+	b, err := NewFileCredentialStore(path)
+	require.NoError(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store := a
+			if i%2 == 1 {
+				store = b
+			}
+			require.NoError(t, store.Put(string(rune('a'+i)), Credential{Token: util.NewSecret("t")}))
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 20; i++ {
+		_, found, err := b.Get(string(rune('a' + i)))
+		require.NoError(t, err)
+		require.True(t, found)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"sort"
+)
+
+// ExcludedService describes an endpoint which matched a requested service
+// type, but was not used because of the agent's version.
+type ExcludedService struct {
+	Name         string
+	Type         string
+	AgentName    string
+	AgentVersion string
+	Reason       string
+}
+
+// ServiceFilter selects the agent endpoints which a ControllerManager
+// would use, based on the requested service types and Config.AgentVersions.
+type ServiceFilter struct {
+	subscriptions []typeMatcher
+	versionRanges map[string]versionRange
+}
+
+// NewServiceFilter returns a ServiceFilter matching the serviceTypes
+// patterns, as MakeControllerManager would.
+func NewServiceFilter(conf Config, serviceTypes []string) (*ServiceFilter, error) {
+	subscriptions, err := compileTypePatterns(serviceTypes)
+	if err != nil {
+		return nil, err
+	}
+	versionRanges, err := conf.parseVersionConstraints()
+	if err != nil {
+		return nil, err
+	}
+	return &ServiceFilter{subscriptions: subscriptions, versionRanges: versionRanges}, nil
+}
+
+// Filter returns the endpoints which would be used, and those excluded
+// because of their agent's version, both sorted by agent, name, and type.
+// The URL and Token of the returned endpoints are not set.
+func (f *ServiceFilter) Filter(agents []Agent) ([]Endpoint, []ExcludedService) {
+	services, excluded := f.filter(agents)
+
+	endpoints := make([]Endpoint, 0, len(services))
+	for _, s := range services {
+		endpoints = append(endpoints, Endpoint{
+			AgentName:   s.AgentName,
+			Name:        s.Name,
+			Type:        s.Type,
+			Annotations: s.Annotations,
+		})
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpointKey(endpoints[i].AgentName, endpoints[i].Name, endpoints[i].Type) <
+			endpointKey(endpoints[j].AgentName, endpoints[j].Name, endpoints[j].Type)
+	})
+
+	return endpoints, sortedExclusions(excluded)
+}
+
+func endpointKey(agentName string, name string, serviceType string) string {
+	return agentName + ":" + name + ":" + serviceType
+}
+
+func sortedExclusions(excluded map[string]ExcludedService) []ExcludedService {
+	ret := make([]ExcludedService, 0, len(excluded))
+	for _, e := range excluded {
+		ret = append(ret, e)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return endpointKey(ret[i].AgentName, ret[i].Name, ret[i].Type) < endpointKey(ret[j].AgentName, ret[j].Name, ret[j].Type)
+	})
+	return ret
+}
+
+// subscribed returns true if any of the requested service type patterns
+// match.
+func (f *ServiceFilter) subscribed(serviceType string) bool {
+	for _, tm := range f.subscriptions {
+		if tm.match(serviceType) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *ServiceFilter) filter(agents []Agent) (map[string]controllerService, map[string]ExcludedService) {
+	newestAgents := map[string]Agent{}
+	// Find the newest versions of each agent, based on connect time.
+	for _, a := range agents {
+		n, found := newestAgents[a.Name]
+		if !found || n.ConnectedAt < a.ConnectedAt {
+			newestAgents[a.Name] = a
+		}
+	}
+
+	endpoints := map[string]controllerService{}
+	excluded := map[string]ExcludedService{}
+
+	for agentName, agent := range newestAgents {
+		for _, ep := range agent.Endpoints {
+			if !ep.Configured || !f.subscribed(ep.Type) {
+				continue
+			}
+			key := endpointKey(agentName, ep.Name, ep.Type)
+			if r, found := f.versionRanges[ep.Type]; found {
+				if reason := r.check(agent.Version); reason != "" {
+					excluded[key] = ExcludedService{
+						Name:         ep.Name,
+						Type:         ep.Type,
+						AgentName:    agentName,
+						AgentVersion: agent.Version,
+						Reason:       reason,
+					}
+					continue
+				}
+			}
+			endpoints[key] = controllerService{
+				AgentName:   agentName,
+				Session:     agent.Session,
+				Name:        ep.Name,
+				Type:        ep.Type,
+				Annotations: ep.Annotations,
+			}
+		}
+	}
+
+	return endpoints, excluded
+}
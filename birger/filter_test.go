@@ -0,0 +1,64 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceFilter_Filter(t *testing.T) {
+	f, err := NewServiceFilter(Config{
+		AgentVersions: map[string]VersionConstraint{"argocd": {Min: "v3.4.0"}},
+	}, []string{"argocd*", "jenkins"})
+	require.NoError(t, err)
+
+	endpoints, excluded := f.Filter([]Agent{
+		{
+			Name:        "b",
+			Version:     "v3.5.0",
+			ConnectedAt: 1,
+			Endpoints: []AgentEndpoint{
+				{Name: "argo", Type: "argocd", Configured: true},
+				{Name: "ci", Type: "jenkins", Configured: false},
+				{Name: "whoami", Type: "whoami", Configured: true},
+			},
+		},
+		{
+			Name:        "a",
+			Version:     "v3.3.0",
+			ConnectedAt: 1,
+			Endpoints: []AgentEndpoint{
+				{Name: "argo", Type: "argocd", Configured: true},
+				{Name: "rollouts", Type: "argocd-rollouts", Configured: true},
+			},
+		},
+	})
+	require.Equal(t, []Endpoint{
+		{AgentName: "a", Name: "rollouts", Type: "argocd-rollouts"},
+		{AgentName: "b", Name: "argo", Type: "argocd"},
+	}, endpoints)
+	require.Equal(t, []ExcludedService{{
+		Name:         "argo",
+		Type:         "argocd",
+		AgentName:    "a",
+		AgentVersion: "v3.3.0",
+		Reason:       "agent version v3.3.0 is older than minimum v3.4.0",
+	}}, excluded)
+
+	_, err = NewServiceFilter(Config{}, []string{"re:("})
+	require.Error(t, err)
+}
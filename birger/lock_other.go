@@ -0,0 +1,40 @@
+//go:build !unix && !windows
+
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"os"
+	"sync"
+)
+
+// fileLocks holds a mutex per lock file.  Where file locking is not
+// available, stores are only safe to share within one process.
+var fileLocks sync.Map
+
+// lockFile always takes an exclusive lock, held only within this process.
+func lockFile(f *os.File, _ bool) error {
+	l, _ := fileLocks.LoadOrStore(f.Name(), &sync.Mutex{})
+	l.(*sync.Mutex).Lock()
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	if l, found := fileLocks.Load(f.Name()); found {
+		l.(*sync.Mutex).Unlock()
+	}
+	return nil
+}
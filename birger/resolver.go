@@ -0,0 +1,301 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpsMx/go-app-base/util"
+)
+
+// Strategy selects which of several equivalent endpoints the Resolver
+// will return.
+type Strategy int
+
+const (
+	// RoundRobin cycles through the healthy endpoints in agent name order.
+	RoundRobin Strategy = iota
+	// LeastRecentlyFailed returns the endpoint whose last reported failure
+	// is the oldest.  Endpoints which have never failed are preferred, and
+	// ties are broken round-robin.
+	LeastRecentlyFailed
+)
+
+// DefaultFailureCooldown is how long an endpoint is considered unhealthy
+// after a failure is reported, if no other duration is given to NewResolver().
+const DefaultFailureCooldown = 30 * time.Second
+
+// ErrNoEndpoints is returned when no endpoint is known for the
+// requested service name and type.
+var ErrNoEndpoints = fmt.Errorf("no endpoints available")
+
+// Endpoint is one agent's instance of a service.
+type Endpoint struct {
+	AgentName   string
+	Name        string
+	Type        string
+	URL         string
+	Token       util.Secret
+	Annotations map[string]string
+}
+
+// Resolver groups endpoints which offer the same service name and type
+// on different agents, and selects one of them for each call.
+//
+// Updates are fed to it using Apply(), generally from the ControllerManager's
+// UpdateChan.  Callers which fail to use an endpoint should call ReportFailure()
+// so it will be avoided for a while.
+//
+// A Resolver is safe for concurrent use.
+type Resolver struct {
+	lock            sync.Mutex
+	groups          map[string]*endpointGroup
+	failureCooldown time.Duration
+	now             func() time.Time
+}
+
+// endpointGroup keeps a cursor for each set of candidates, the agent
+// name last chosen from it, so rotating through one set does not skew
+// another.  Affinity cursors are keyed by affinityKey().
+type endpointGroup struct {
+	endpoints  []*resolvedEndpoint // sorted by agent name
+	last       string
+	affinities map[string]*string
+}
+
+type resolvedEndpoint struct {
+	Endpoint
+	lastFailure time.Time
+}
+
+// NewResolver returns a Resolver which will avoid endpoints for
+// failureCooldown after a failure is reported.  If 0,
+// DefaultFailureCooldown is used.
+func NewResolver(failureCooldown time.Duration) *Resolver {
+	if failureCooldown == 0 {
+		failureCooldown = DefaultFailureCooldown
+	}
+	return &Resolver{
+		groups:          map[string]*endpointGroup{},
+		failureCooldown: failureCooldown,
+		now:             time.Now,
+	}
+}
+
+func groupKey(name string, serviceType string) string {
+	return name + ":" + serviceType
+}
+
+// Apply adds, updates, or removes an endpoint based on a ServiceUpdate.
+func (r *Resolver) Apply(update ServiceUpdate) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := groupKey(update.Name, update.Type)
+	group, found := r.groups[key]
+
+	switch update.Operation {
+	case "update":
+		if !found {
+			group = &endpointGroup{}
+			r.groups[key] = group
+		}
+		ep := Endpoint{
+			AgentName:   update.AgentName,
+			Name:        update.Name,
+			Type:        update.Type,
+			URL:         update.URL,
+			Token:       update.Token,
+			Annotations: update.Annotations,
+		}
+		for _, existing := range group.endpoints {
+			if existing.AgentName == update.AgentName {
+				existing.Endpoint = ep
+				return
+			}
+		}
+		group.endpoints = append(group.endpoints, &resolvedEndpoint{Endpoint: ep})
+		sort.Slice(group.endpoints, func(i, j int) bool {
+			return group.endpoints[i].AgentName < group.endpoints[j].AgentName
+		})
+	case "delete":
+		if !found {
+			return
+		}
+		for i, existing := range group.endpoints {
+			if existing.AgentName == update.AgentName {
+				group.endpoints = append(group.endpoints[:i], group.endpoints[i+1:]...)
+				break
+			}
+		}
+		if len(group.endpoints) == 0 {
+			delete(r.groups, key)
+		}
+	}
+}
+
+// Endpoints returns all known endpoints for the service name and type,
+// sorted by agent name.
+func (r *Resolver) Endpoints(name string, serviceType string) []Endpoint {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	group, found := r.groups[groupKey(name, serviceType)]
+	if !found {
+		return []Endpoint{}
+	}
+	ret := make([]Endpoint, len(group.endpoints))
+	for i, ep := range group.endpoints {
+		ret[i] = ep.Endpoint
+	}
+	return ret
+}
+
+// Resolve returns one endpoint for the service name and type, chosen using
+// the strategy.  Endpoints which have failed recently are skipped unless
+// no others are available.
+func (r *Resolver) Resolve(name string, serviceType string, strategy Strategy) (Endpoint, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	group, found := r.groups[groupKey(name, serviceType)]
+	if !found {
+		return Endpoint{}, fmt.Errorf("%s %s: %w", serviceType, name, ErrNoEndpoints)
+	}
+	switch strategy {
+	case LeastRecentlyFailed:
+		return r.leastRecentlyFailed(&group.last, group.endpoints).Endpoint, nil
+	default:
+		return r.roundRobin(&group.last, group.endpoints).Endpoint, nil
+	}
+}
+
+// ResolveAffinity returns an endpoint whose annotations contain every
+// key and value in affinity, round-robin among those which are healthy.
+// If no healthy endpoint matches, any healthy endpoint is returned instead,
+// so affinity is a preference rather than a requirement.
+func (r *Resolver) ResolveAffinity(name string, serviceType string, affinity map[string]string) (Endpoint, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	group, found := r.groups[groupKey(name, serviceType)]
+	if !found {
+		return Endpoint{}, fmt.Errorf("%s %s: %w", serviceType, name, ErrNoEndpoints)
+	}
+	matching := []*resolvedEndpoint{}
+	for _, ep := range group.endpoints {
+		if annotationsMatch(ep.Annotations, affinity) && r.healthy(ep) {
+			matching = append(matching, ep)
+		}
+	}
+	if len(matching) == 0 {
+		return r.roundRobin(&group.last, group.endpoints).Endpoint, nil
+	}
+	key := affinityKey(affinity)
+	if group.affinities == nil {
+		group.affinities = map[string]*string{}
+	}
+	cursor, found := group.affinities[key]
+	if !found {
+		cursor = new(string)
+		group.affinities[key] = cursor
+	}
+	return r.roundRobin(cursor, matching).Endpoint, nil
+}
+
+// affinityKey returns the same string for equal affinity maps.
+func affinityKey(affinity map[string]string) string {
+	keys := make([]string, 0, len(affinity))
+	for k := range affinity {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%q=%q,", k, affinity[k])
+	}
+	return b.String()
+}
+
+// ReportFailure marks the endpoint as unhealthy, so it will be avoided
+// until the failure cooldown has passed.
+func (r *Resolver) ReportFailure(ep Endpoint) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	group, found := r.groups[groupKey(ep.Name, ep.Type)]
+	if !found {
+		return
+	}
+	for _, existing := range group.endpoints {
+		if existing.AgentName == ep.AgentName {
+			existing.lastFailure = r.now()
+			return
+		}
+	}
+}
+
+func (r *Resolver) healthy(ep *resolvedEndpoint) bool {
+	return ep.lastFailure.IsZero() || r.now().Sub(ep.lastFailure) >= r.failureCooldown
+}
+
+// roundRobin picks the next healthy candidate after the one last chosen,
+// recorded in cursor.  If none are healthy, it falls back to the least
+// recently failed one.  Candidates must be sorted by agent name.
+func (r *Resolver) roundRobin(cursor *string, candidates []*resolvedEndpoint) *resolvedEndpoint {
+	start := nextAfter(*cursor, candidates)
+	for i := 0; i < len(candidates); i++ {
+		ep := candidates[(start+i)%len(candidates)]
+		if r.healthy(ep) {
+			*cursor = ep.AgentName
+			return ep
+		}
+	}
+	return r.leastRecentlyFailed(cursor, candidates)
+}
+
+func (r *Resolver) leastRecentlyFailed(cursor *string, candidates []*resolvedEndpoint) *resolvedEndpoint {
+	start := nextAfter(*cursor, candidates)
+	var best *resolvedEndpoint
+	for i := 0; i < len(candidates); i++ {
+		ep := candidates[(start+i)%len(candidates)]
+		if best == nil || ep.lastFailure.Before(best.lastFailure) {
+			best = ep
+		}
+	}
+	*cursor = best.AgentName
+	return best
+}
+
+// nextAfter returns the index of the first candidate whose agent name
+// sorts after last, wrapping to 0.
+func nextAfter(last string, candidates []*resolvedEndpoint) int {
+	i := sort.Search(len(candidates), func(i int) bool {
+		return candidates[i].AgentName > last
+	})
+	if i == len(candidates) {
+		return 0
+	}
+	return i
+}
+
+func annotationsMatch(annotations map[string]string, want map[string]string) bool {
+	for k, v := range want {
+		if annotations[k] != v {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestResolver(agents ...string) (*Resolver, *time.Time) {
+	now := time.Unix(1000, 0)
+	r := NewResolver(10 * time.Second)
+	r.now = func() time.Time { return now }
+	for _, agent := range agents {
+		r.Apply(ServiceUpdate{
+			Operation:   "update",
+			Name:        "argo",
+			Type:        "argocd",
+			AgentName:   agent,
+			Annotations: map[string]string{"region": agent + "-region"},
+		})
+	}
+	return r, &now
+}
+
+func resolveAgents(t *testing.T, r *Resolver, count int, strategy Strategy) []string {
+	ret := []string{}
+	for i := 0; i < count; i++ {
+		ep, err := r.Resolve("argo", "argocd", strategy)
+		require.NoError(t, err)
+		ret = append(ret, ep.AgentName)
+	}
+	return ret
+}
+
+func TestResolver_Resolve(t *testing.T) {
+	t.Run("unknown service", func(t *testing.T) {
+		r, _ := makeTestResolver()
+		_, err := r.Resolve("argo", "argocd", RoundRobin)
+		require.True(t, errors.Is(err, ErrNoEndpoints))
+	})
+
+	t.Run("round robin in agent order", func(t *testing.T) {
+		r, _ := makeTestResolver("c", "a", "b")
+		require.Equal(t, []string{"a", "b", "c", "a"}, resolveAgents(t, r, 4, RoundRobin))
+	})
+
+	t.Run("round robin skips failed endpoints until cooldown passes", func(t *testing.T) {
+		r, now := makeTestResolver("a", "b", "c")
+		r.ReportFailure(Endpoint{AgentName: "b", Name: "argo", Type: "argocd"})
+		require.Equal(t, []string{"a", "c", "a", "c"}, resolveAgents(t, r, 4, RoundRobin))
+		*now = now.Add(10 * time.Second)
+		require.Equal(t, []string{"a", "b", "c"}, resolveAgents(t, r, 3, RoundRobin))
+	})
+
+	t.Run("all failed falls back to least recently failed", func(t *testing.T) {
+		r, now := makeTestResolver("a", "b")
+		r.ReportFailure(Endpoint{AgentName: "b", Name: "argo", Type: "argocd"})
+		*now = now.Add(time.Second)
+		r.ReportFailure(Endpoint{AgentName: "a", Name: "argo", Type: "argocd"})
+		require.Equal(t, []string{"b", "b"}, resolveAgents(t, r, 2, RoundRobin))
+	})
+
+	t.Run("least recently failed prefers never-failed endpoints", func(t *testing.T) {
+		r, now := makeTestResolver("a", "b", "c")
+		r.ReportFailure(Endpoint{AgentName: "a", Name: "argo", Type: "argocd"})
+		*now = now.Add(time.Second)
+		r.ReportFailure(Endpoint{AgentName: "c", Name: "argo", Type: "argocd"})
+		require.Equal(t, []string{"b", "b"}, resolveAgents(t, r, 2, LeastRecentlyFailed))
+		r.Apply(ServiceUpdate{Operation: "delete", Name: "argo", Type: "argocd", AgentName: "b"})
+		require.Equal(t, []string{"a"}, resolveAgents(t, r, 1, LeastRecentlyFailed))
+	})
+}
+
+func TestResolver_ResolveAffinity(t *testing.T) {
+	t.Run("matching endpoint is preferred", func(t *testing.T) {
+		r, _ := makeTestResolver("a", "b", "c")
+		for i := 0; i < 3; i++ {
+			ep, err := r.ResolveAffinity("argo", "argocd", map[string]string{"region": "b-region"})
+			require.NoError(t, err)
+			require.Equal(t, "b", ep.AgentName)
+		}
+	})
+
+	t.Run("interleaved calls rotate independently", func(t *testing.T) {
+		r, _ := makeTestResolver()
+		for _, agent := range []string{"a", "b", "c", "d"} {
+			tier := "silver"
+			if agent == "a" || agent == "b" {
+				tier = "gold"
+			}
+			r.Apply(ServiceUpdate{Operation: "update", Name: "argo", Type: "argocd", AgentName: agent, Annotations: map[string]string{"tier": tier}})
+		}
+		plain := []string{}
+		gold := []string{}
+		for i := 0; i < 4; i++ {
+			ep, err := r.Resolve("argo", "argocd", RoundRobin)
+			require.NoError(t, err)
+			plain = append(plain, ep.AgentName)
+			ep, err = r.ResolveAffinity("argo", "argocd", map[string]string{"tier": "gold"})
+			require.NoError(t, err)
+			gold = append(gold, ep.AgentName)
+		}
+		require.Equal(t, []string{"a", "b", "c", "d"}, plain)
+		require.Equal(t, []string{"a", "b", "a", "b"}, gold)
+	})
+
+	t.Run("failed match falls back to others", func(t *testing.T) {
+		r, _ := makeTestResolver("a", "b")
+		r.ReportFailure(Endpoint{AgentName: "b", Name: "argo", Type: "argocd"})
+		ep, err := r.ResolveAffinity("argo", "argocd", map[string]string{"region": "b-region"})
+		require.NoError(t, err)
+		require.Equal(t, "a", ep.AgentName)
+	})
+}
+
+func TestResolver_Apply(t *testing.T) {
+	r, _ := makeTestResolver("a", "b")
+	r.Apply(ServiceUpdate{Operation: "update", Name: "argo", Type: "argocd", AgentName: "a", URL: "https://new"})
+	eps := r.Endpoints("argo", "argocd")
+	require.Len(t, eps, 2)
+	require.Equal(t, "https://new", eps[0].URL)
+
+	r.Apply(ServiceUpdate{Operation: "delete", Name: "argo", Type: "argocd", AgentName: "a"})
+	r.Apply(ServiceUpdate{Operation: "delete", Name: "argo", Type: "argocd", AgentName: "b"})
+	require.Empty(t, r.Endpoints("argo", "argocd"))
+	_, err := r.Resolve("argo", "argocd", RoundRobin)
+	require.True(t, errors.Is(err, ErrNoEndpoints))
+}
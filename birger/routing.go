@@ -0,0 +1,108 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Route sends updates for service types matching Pattern to Handler.
+//
+// Patterns are shell-style globs as understood by path.Match, such as
+// `argocd*` or `jenkins`, unless prefixed with `re:`, in which case the
+// remainder is a regular expression which must match the entire type.
+type Route struct {
+	Pattern string
+	Handler func(ServiceUpdate)
+}
+
+type typeMatcher struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+type route struct {
+	matcher typeMatcher
+	handler func(ServiceUpdate)
+}
+
+func compileTypePattern(pattern string) (typeMatcher, error) {
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile("^(?:" + strings.TrimPrefix(pattern, "re:") + ")$")
+		if err != nil {
+			return typeMatcher{}, fmt.Errorf("service type pattern %q: %v", pattern, err)
+		}
+		return typeMatcher{pattern: pattern, re: re}, nil
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return typeMatcher{}, fmt.Errorf("service type pattern %q: %v", pattern, err)
+	}
+	return typeMatcher{pattern: pattern}, nil
+}
+
+func compileTypePatterns(patterns []string) ([]typeMatcher, error) {
+	ret := make([]typeMatcher, 0, len(patterns))
+	for _, pattern := range patterns {
+		tm, err := compileTypePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, tm)
+	}
+	return ret, nil
+}
+
+func (tm typeMatcher) match(serviceType string) bool {
+	if tm.re != nil {
+		return tm.re.MatchString(serviceType)
+	}
+	matched, _ := path.Match(tm.pattern, serviceType)
+	return matched
+}
+
+func compileRoutes(routes []Route) ([]route, []typeMatcher, error) {
+	ret := make([]route, 0, len(routes))
+	matchers := make([]typeMatcher, 0, len(routes))
+	for _, r := range routes {
+		if r.Handler == nil {
+			return nil, nil, fmt.Errorf("route for %q has no handler", r.Pattern)
+		}
+		tm, err := compileTypePattern(r.Pattern)
+		if err != nil {
+			return nil, nil, err
+		}
+		ret = append(ret, route{matcher: tm, handler: r.Handler})
+		matchers = append(matchers, tm)
+	}
+	return ret, matchers, nil
+}
+
+// dispatch calls the first route whose pattern matches the update's type.
+// If no routes were registered, the update is sent to UpdateChan instead.
+func (m *ControllerManager) dispatch(update ServiceUpdate) {
+	if len(m.routes) == 0 {
+		m.UpdateChan <- update
+		return
+	}
+	for _, r := range m.routes {
+		if r.matcher.match(update.Type) {
+			r.handler(update)
+			return
+		}
+	}
+}
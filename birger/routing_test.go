@@ -0,0 +1,83 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package birger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_typeMatcher_match(t *testing.T) {
+	tests := []struct {
+		pattern     string
+		serviceType string
+		want        bool
+	}{
+		{"jenkins", "jenkins", true},
+		{"jenkins", "jenkins2", false},
+		{"argocd*", "argocd", true},
+		{"argocd*", "argocd-rollouts", true},
+		{"argocd*", "my-argocd", false},
+		{"re:argo(cd|-rollouts)", "argocd", true},
+		{"re:argo(cd|-rollouts)", "argo-rollouts", true},
+		{"re:argo(cd|-rollouts)", "argocd-extra", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.serviceType, func(t *testing.T) {
+			tm, err := compileTypePattern(tt.pattern)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, tm.match(tt.serviceType))
+		})
+	}
+}
+
+func Test_compileTypePatterns_invalid(t *testing.T) {
+	_, err := compileTypePatterns([]string{"jenkins", "argocd["})
+	require.Error(t, err)
+	_, err = compileTypePatterns([]string{"re:argocd("})
+	require.Error(t, err)
+}
+
+func Test_compileRoutes_noHandler(t *testing.T) {
+	_, _, err := compileRoutes([]Route{{Pattern: "jenkins"}})
+	require.Error(t, err)
+}
+
+func TestControllerManager_dispatch(t *testing.T) {
+	t.Run("first matching route is used", func(t *testing.T) {
+		argo := []string{}
+		other := []string{}
+		routes, subscriptions, err := compileRoutes([]Route{
+			{Pattern: "argocd*", Handler: func(u ServiceUpdate) { argo = append(argo, u.Type) }},
+			{Pattern: "*", Handler: func(u ServiceUpdate) { other = append(other, u.Type) }},
+		})
+		require.NoError(t, err)
+		m := ControllerManager{filter: ServiceFilter{subscriptions: subscriptions}, routes: routes}
+
+		require.True(t, m.filter.subscribed("whoami"))
+		m.dispatch(ServiceUpdate{Type: "argocd"})
+		m.dispatch(ServiceUpdate{Type: "jenkins"})
+		m.dispatch(ServiceUpdate{Type: "argocd-rollouts"})
+		require.Equal(t, []string{"argocd", "argocd-rollouts"}, argo)
+		require.Equal(t, []string{"jenkins"}, other)
+	})
+
+	t.Run("without routes the update channel is used", func(t *testing.T) {
+		m := ControllerManager{UpdateChan: make(chan ServiceUpdate, 1)}
+		m.dispatch(ServiceUpdate{Type: "jenkins"})
+		require.Equal(t, "jenkins", (<-m.UpdateChan).Type)
+	})
+}
@@ -14,6 +14,8 @@
 
 package birger
 
+import "github.com/OpsMx/go-app-base/util"
+
 // ServiceUpdate contains an update message sent when a new service type is
 // discovered or is no longer present in the controller.
 //
@@ -26,6 +28,6 @@ type ServiceUpdate struct {
 	Type        string
 	AgentName   string
 	Annotations map[string]string // Only set for update
-	Token       string            // Only set for update
+	Token       util.Secret       // Only set for update
 	URL         string            // Only set for update
 }
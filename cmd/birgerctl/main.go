@@ -0,0 +1,238 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// birgerctl shows what the controller would hand to birger, for debugging
+// integrations without writing Go.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/OpsMx/go-app-base/birger"
+	"github.com/OpsMx/go-app-base/version"
+	"gopkg.in/yaml.v3"
+)
+
+const usage = `usage: birgerctl <command> [flags]
+
+Commands:
+  agents       list connected agents
+  endpoints    list endpoints birger would use, and those excluded
+  credentials  have the controller issue credentials for one service
+  watch        show service updates as birger would send them
+  version      show the version and exit
+
+Run 'birgerctl <command> -h' for the flags of each command.
+The controller token is read from the config file or the CONTROLLER_TOKEN envar.
+`
+
+type commonFlags struct {
+	configFile *string
+	url        *string
+	output     *string
+}
+
+func addCommonFlags(fs *flag.FlagSet) *commonFlags {
+	return &commonFlags{
+		configFile: fs.String("config", "", "birger config file, in YAML or JSON"),
+		url:        fs.String("url", "", "controller URL, overriding the config file"),
+		output:     fs.String("o", "table", "output format: table or json"),
+	}
+}
+
+func (cf *commonFlags) config() (birger.Config, error) {
+	conf := birger.Config{}
+	if *cf.configFile != "" {
+		d, err := os.ReadFile(*cf.configFile)
+		if err != nil {
+			return conf, err
+		}
+		if err := yaml.Unmarshal(d, &conf); err != nil {
+			return conf, fmt.Errorf("parsing %s: %v", *cf.configFile, err)
+		}
+	}
+	if *cf.url != "" {
+		conf.URL = *cf.url
+	}
+	if conf.URL == "" {
+		return conf, fmt.Errorf("no controller URL in config, and -url not set")
+	}
+	if *cf.output != "table" && *cf.output != "json" {
+		return conf, fmt.Errorf("unknown output format %q", *cf.output)
+	}
+	return conf, nil
+}
+
+func splitTypes(types string) []string {
+	ret := []string{}
+	for _, t := range strings.Split(types, ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("birgerctl: ")
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+
+	var err error
+	switch os.Args[1] {
+	case "agents":
+		err = runAgents(ctx, os.Args[2:])
+	case "endpoints":
+		err = runEndpoints(ctx, os.Args[2:])
+	case "credentials":
+		err = runCredentials(ctx, os.Args[2:])
+	case "watch":
+		err = runWatch(ctx, os.Args[2:])
+	case "version":
+		fmt.Println(version.VersionString())
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func runAgents(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("agents", flag.ExitOnError)
+	cf := addCommonFlags(fs)
+	_ = fs.Parse(args)
+	conf, err := cf.config()
+	if err != nil {
+		return err
+	}
+
+	stats, err := birger.NewClient(conf).AgentStatistics(ctx)
+	if err != nil {
+		return err
+	}
+	if *cf.output == "json" {
+		return writeJSON(os.Stdout, stats.ConnectedAgents)
+	}
+	return writeAgentsTable(os.Stdout, stats.ConnectedAgents)
+}
+
+func runEndpoints(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("endpoints", flag.ExitOnError)
+	cf := addCommonFlags(fs)
+	types := fs.String("types", "*", "comma separated service type patterns, as given to birger")
+	_ = fs.Parse(args)
+	conf, err := cf.config()
+	if err != nil {
+		return err
+	}
+
+	filter, err := birger.NewServiceFilter(conf, splitTypes(*types))
+	if err != nil {
+		return err
+	}
+	stats, err := birger.NewClient(conf).AgentStatistics(ctx)
+	if err != nil {
+		return err
+	}
+	endpoints, excluded := filter.Filter(stats.ConnectedAgents)
+	if *cf.output == "json" {
+		return writeJSON(os.Stdout, struct {
+			Endpoints []birger.Endpoint        `json:"endpoints"`
+			Excluded  []birger.ExcludedService `json:"excluded"`
+		}{endpoints, excluded})
+	}
+	return writeEndpointsTable(os.Stdout, endpoints, excluded)
+}
+
+func runCredentials(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("credentials", flag.ExitOnError)
+	cf := addCommonFlags(fs)
+	agent := fs.String("agent", "", "agent name")
+	name := fs.String("name", "", "service name")
+	serviceType := fs.String("type", "", "service type")
+	_ = fs.Parse(args)
+	conf, err := cf.config()
+	if err != nil {
+		return err
+	}
+	if *agent == "" || *name == "" || *serviceType == "" {
+		return fmt.Errorf("-agent, -name, and -type are required")
+	}
+
+	cred, err := birger.NewClient(conf).ServiceCredentials(ctx, *agent, *name, *serviceType)
+	if err != nil {
+		return err
+	}
+	if *cf.output == "json" {
+		// Credential redacts its token when marshalled, but showing it
+		// is the point of this command.
+		return writeJSON(os.Stdout, struct {
+			URL      string    `json:"url"`
+			Token    string    `json:"token"`
+			IssuedAt time.Time `json:"issuedAt"`
+		}{cred.URL, cred.Token.Reveal(), cred.IssuedAt})
+	}
+	return writeCredentialTable(os.Stdout, cred)
+}
+
+func runWatch(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	cf := addCommonFlags(fs)
+	types := fs.String("types", "*", "comma separated service type patterns, as given to birger")
+	showTokens := fs.Bool("show-tokens", false, "include service tokens in the output")
+	_ = fs.Parse(args)
+	conf, err := cf.config()
+	if err != nil {
+		return err
+	}
+	patterns := splitTypes(*types)
+	if _, err := birger.NewServiceFilter(conf, patterns); err != nil {
+		return err
+	}
+
+	m := birger.MakeControllerManager(conf, patterns)
+	w := newUpdateWriter(os.Stdout, *cf.output == "json", *showTokens)
+	for {
+		select {
+		case <-ctx.Done():
+			// Drain updates so the worker is not blocked while shutting down.
+			go m.Shutdown()
+			for range m.UpdateChan {
+			}
+			return nil
+		case u := <-m.UpdateChan:
+			if err := w.write(time.Now(), u); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/OpsMx/go-app-base/birger"
+)
+
+func writeJSON(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func formatMillis(ms int64) string {
+	if ms == 0 {
+		return "-"
+	}
+	return time.UnixMilli(ms).UTC().Format(time.RFC3339)
+}
+
+func formatAnnotations(annotations map[string]string) string {
+	if len(annotations) == 0 {
+		return "-"
+	}
+	keys := make([]string, 0, len(annotations))
+	for k := range annotations {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + annotations[k]
+	}
+	return strings.Join(parts, ",")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func writeAgentsTable(w io.Writer, agents []birger.Agent) error {
+	sorted := append([]birger.Agent{}, agents...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].ConnectedAt < sorted[j].ConnectedAt
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSESSION\tVERSION\tHOSTNAME\tCONNECTED\tENDPOINTS")
+	for _, a := range sorted {
+		configured := 0
+		for _, ep := range a.Endpoints {
+			if ep.Configured {
+				configured++
+			}
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d/%d\n",
+			a.Name, orDash(a.Session), orDash(a.Version), orDash(a.Hostname),
+			formatMillis(a.ConnectedAt), configured, len(a.Endpoints))
+	}
+	return tw.Flush()
+}
+
+func writeEndpointsTable(w io.Writer, endpoints []birger.Endpoint, excluded []birger.ExcludedService) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "AGENT\tNAME\tTYPE\tSTATUS\tDETAIL")
+	for _, ep := range endpoints {
+		fmt.Fprintf(tw, "%s\t%s\t%s\tused\t%s\n", ep.AgentName, ep.Name, ep.Type, formatAnnotations(ep.Annotations))
+	}
+	for _, e := range excluded {
+		fmt.Fprintf(tw, "%s\t%s\t%s\texcluded\t%s\n", e.AgentName, e.Name, e.Type, e.Reason)
+	}
+	return tw.Flush()
+}
+
+func writeCredentialTable(w io.Writer, cred birger.Credential) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "URL\tTOKEN")
+	fmt.Fprintf(tw, "%s\t%s\n", orDash(cred.URL), orDash(cred.Token.Reveal()))
+	return tw.Flush()
+}
+
+// updateWriter prints each ServiceUpdate as it arrives, either as a
+// table row or a line of JSON.
+type updateWriter struct {
+	w          io.Writer
+	asJSON     bool
+	showTokens bool
+	wroteHead  bool
+}
+
+func newUpdateWriter(w io.Writer, asJSON bool, showTokens bool) *updateWriter {
+	return &updateWriter{w: w, asJSON: asJSON, showTokens: showTokens}
+}
+
+type updateLine struct {
+	Time        time.Time         `json:"time"`
+	Operation   string            `json:"operation"`
+	AgentName   string            `json:"agentName"`
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	URL         string            `json:"url,omitempty"`
+	Token       string            `json:"token,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+func (uw *updateWriter) write(now time.Time, u birger.ServiceUpdate) error {
+	line := updateLine{
+		Time:        now.UTC(),
+		Operation:   u.Operation,
+		AgentName:   u.AgentName,
+		Name:        u.Name,
+		Type:        u.Type,
+		URL:         u.URL,
+		Annotations: u.Annotations,
+	}
+	if uw.showTokens {
+		line.Token = u.Token.Reveal()
+	}
+
+	if uw.asJSON {
+		return json.NewEncoder(uw.w).Encode(line)
+	}
+
+	// Rows are written as they arrive, so use fixed-width columns rather
+	// than a tabwriter which would need to see every row first.
+	if !uw.wroteHead {
+		if _, err := fmt.Fprintf(uw.w, "%-20s  %-9s  %-20s  %-20s  %-16s  %s\n", "TIME", "OPERATION", "AGENT", "NAME", "TYPE", "DETAIL"); err != nil {
+			return err
+		}
+		uw.wroteHead = true
+	}
+	detail := orDash(line.URL)
+	if line.Token != "" {
+		detail += " token=" + line.Token
+	}
+	if len(line.Annotations) > 0 {
+		detail += " " + formatAnnotations(line.Annotations)
+	}
+	_, err := fmt.Fprintf(uw.w, "%-20s  %-9s  %-20s  %-20s  %-16s  %s\n",
+		line.Time.Format(time.RFC3339), line.Operation, line.AgentName, line.Name, line.Type, detail)
+	return err
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/OpsMx/go-app-base/birger"
+	"github.com/OpsMx/go-app-base/util"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteEndpointsTable(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeEndpointsTable(&buf,
+		[]birger.Endpoint{{AgentName: "smith", Name: "argo", Type: "argocd", Annotations: map[string]string{"b": "2", "a": "1"}}},
+		[]birger.ExcludedService{{AgentName: "jones", Name: "argo", Type: "argocd", Reason: "too old"}},
+	)
+	require.NoError(t, err)
+	require.Equal(t, ""+
+		"AGENT  NAME  TYPE    STATUS    DETAIL\n"+
+		"smith  argo  argocd  used      a=1,b=2\n"+
+		"jones  argo  argocd  excluded  too old\n", buf.String())
+}
+
+func TestUpdateWriter(t *testing.T) {
+	now := time.Unix(1662067531, 0)
+	u := birger.ServiceUpdate{Operation: "update", AgentName: "smith", Name: "argo", Type: "argocd", URL: "https://x", Token: util.NewSecret("secret")}
+
+	t.Run("tokens hidden by default", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, newUpdateWriter(&buf, true, false).write(now, u))
+		var got updateLine
+		require.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+		require.Equal(t, "", got.Token)
+		require.Equal(t, "https://x", got.URL)
+	})
+
+	t.Run("tokens shown when asked", func(t *testing.T) {
+		var buf bytes.Buffer
+		w := newUpdateWriter(&buf, false, true)
+		require.NoError(t, w.write(now, u))
+		require.NoError(t, w.write(now, u))
+		require.Contains(t, buf.String(), "token=secret")
+		require.Equal(t, 1, bytes.Count(buf.Bytes(), []byte("OPERATION")))
+	})
+}
+
+func TestSplitTypes(t *testing.T) {
+	require.Equal(t, []string{"argocd*", "jenkins"}, splitTypes(" argocd*, ,jenkins"))
+	require.Equal(t, []string{}, splitTypes(""))
+}
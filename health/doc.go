@@ -0,0 +1,29 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+// The `health` package provides a registry of named health checks,
+// served as JSON on /healthz and /readyz.  Anything with a
+// `Check() error` method, such as birger's ControllerManager, can be
+// registered.  A common pattern for using:
+//
+// registry := health.NewRegistry()
+// util.Check(registry.Register("controller", controllerManager))
+// util.Check(registry.Register("cache", cache, health.NonCritical(), health.WithTimeout(time.Second)))
+// registry.RegisterHandlers(mux)
+//
+// Checks are used for readiness.  Those registered with Liveness() are
+// also used for /healthz, which otherwise reports ok while the process
+// is able to serve requests.
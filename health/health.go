@@ -0,0 +1,329 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/OpsMx/go-app-base/httputil"
+)
+
+// Checker is implemented by anything which can report its health.
+type Checker interface {
+	Check() error
+}
+
+// ContextChecker is a Checker which can stop early when the check's
+// timeout expires.  If a checker implements it, CheckContext is used
+// instead of Check.
+type ContextChecker interface {
+	Checker
+	CheckContext(ctx context.Context) error
+}
+
+// CheckerFunc adapts a function to a Checker.
+type CheckerFunc func() error
+
+// Check implements Checker.
+func (f CheckerFunc) Check() error {
+	return f()
+}
+
+// Status is the outcome of a check, or of a whole report.
+type Status string
+
+const (
+	// StatusOK means the check passed.
+	StatusOK Status = "ok"
+	// StatusWarn means a non-critical check failed.
+	StatusWarn Status = "warn"
+	// StatusFail means a critical check failed.
+	StatusFail Status = "fail"
+)
+
+var (
+	defaultTimeout       = 5 * time.Second
+	defaultCacheDuration = 5 * time.Second
+)
+
+// CheckOption changes how a check is run.
+type CheckOption func(*check)
+
+// NonCritical marks a check whose failure is reported, but does not
+// make the service unhealthy.
+func NonCritical() CheckOption {
+	return func(c *check) {
+		c.critical = false
+	}
+}
+
+// Liveness includes a check in /healthz as well as /readyz.  Only
+// use this for failures which restarting the process would fix.
+func Liveness() CheckOption {
+	return func(c *check) {
+		c.liveness = true
+	}
+}
+
+// WithTimeout sets how long to wait for the check.  The default is 5
+// seconds.
+func WithTimeout(d time.Duration) CheckOption {
+	return func(c *check) {
+		c.timeout = d
+	}
+}
+
+// WithCacheDuration sets how long a check's result is reused before it
+// is run again, so frequent probes do not overload what is checked.
+// The default is 5 seconds, and 0 disables caching.
+func WithCacheDuration(d time.Duration) CheckOption {
+	return func(c *check) {
+		c.cacheFor = d
+	}
+}
+
+// Result is the outcome of one check.
+type Result struct {
+	Name      string    `json:"name"`
+	Status    Status    `json:"status"`
+	Critical  bool      `json:"critical"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+	// DurationMilliseconds is how long the check took to run.
+	DurationMilliseconds int64 `json:"durationMilliseconds"`
+}
+
+// Report is the outcome of a set of checks.  Its status is the worst
+// status of the checks.
+type Report struct {
+	Status Status   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+// Healthy returns true unless a critical check failed.
+func (r Report) Healthy() bool {
+	return r.Status != StatusFail
+}
+
+type check struct {
+	name     string
+	checker  Checker
+	critical bool
+	liveness bool
+	timeout  time.Duration
+	cacheFor time.Duration
+
+	lock     sync.Mutex
+	last     *Result
+	inflight chan struct{}
+}
+
+// Registry holds named checks.  It is safe for concurrent use.
+type Registry struct {
+	lock   sync.RWMutex
+	checks []*check
+	now    func() time.Time
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{now: time.Now}
+}
+
+// Register adds a check.  Checks are critical unless NonCritical() is
+// used.  Names must be unique.
+func (r *Registry) Register(name string, checker Checker, opts ...CheckOption) error {
+	c := &check{
+		name:     name,
+		checker:  checker,
+		critical: true,
+		timeout:  defaultTimeout,
+		cacheFor: defaultCacheDuration,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.timeout <= 0 {
+		return fmt.Errorf("health check %q: timeout must be positive", name)
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, existing := range r.checks {
+		if existing.name == name {
+			return fmt.Errorf("health check %q is already registered", name)
+		}
+	}
+	r.checks = append(r.checks, c)
+	return nil
+}
+
+// Ready runs all the checks, concurrently.
+func (r *Registry) Ready(ctx context.Context) Report {
+	return r.run(ctx, false)
+}
+
+// Live runs only the checks registered with Liveness().
+func (r *Registry) Live(ctx context.Context) Report {
+	return r.run(ctx, true)
+}
+
+func (r *Registry) run(ctx context.Context, livenessOnly bool) Report {
+	r.lock.RLock()
+	checks := make([]*check, 0, len(r.checks))
+	for _, c := range r.checks {
+		if !livenessOnly || c.liveness {
+			checks = append(checks, c)
+		}
+	}
+	r.lock.RUnlock()
+
+	report := Report{Status: StatusOK, Checks: make([]Result, len(checks))}
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c *check) {
+			defer wg.Done()
+			report.Checks[i] = c.result(ctx, r.now)
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		if result.Status == StatusFail {
+			report.Status = StatusFail
+		} else if result.Status == StatusWarn && report.Status == StatusOK {
+			report.Status = StatusWarn
+		}
+	}
+	return report
+}
+
+// result returns the cached result if it is recent enough, otherwise
+// waits for the check to run.  Only one run of a check is in progress
+// at a time; callers which arrive during a run wait for it.
+func (c *check) result(ctx context.Context, now func() time.Time) Result {
+	c.lock.Lock()
+	if c.last != nil && now().Sub(c.last.CheckedAt) < c.cacheFor {
+		ret := *c.last
+		c.lock.Unlock()
+		return ret
+	}
+	if c.inflight == nil {
+		c.inflight = make(chan struct{})
+		go c.run(now)
+	}
+	done := c.inflight
+	c.lock.Unlock()
+
+	t := time.NewTimer(c.timeout)
+	defer t.Stop()
+	select {
+	case <-done:
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return *c.last
+	case <-t.C:
+		return c.resultFor(now(), fmt.Errorf("timed out after %v", c.timeout), c.timeout)
+	case <-ctx.Done():
+		return c.resultFor(now(), ctx.Err(), 0)
+	}
+}
+
+func (c *check) run(now func() time.Time) {
+	started := now()
+	err := c.call()
+	result := c.resultFor(now(), err, now().Sub(started))
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.last = &result
+	close(c.inflight)
+	c.inflight = nil
+}
+
+func (c *check) call() (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("health check %q panicked: %v", c.name, p)
+			err = fmt.Errorf("check panicked: %v", p)
+		}
+	}()
+	if cc, ok := c.checker.(ContextChecker); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+		defer cancel()
+		return cc.CheckContext(ctx)
+	}
+	return c.checker.Check()
+}
+
+// resultFor returns a result for err, which is ok if err is nil.
+func (c *check) resultFor(at time.Time, err error, took time.Duration) Result {
+	result := Result{
+		Name:                 c.name,
+		Status:               StatusOK,
+		Critical:             c.critical,
+		CheckedAt:            at,
+		DurationMilliseconds: took.Milliseconds(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+		result.Status = StatusWarn
+		if c.critical {
+			result.Status = StatusFail
+		}
+	}
+	return result
+}
+
+// HealthzHandler serves the liveness report.
+func (r *Registry) HealthzHandler() http.Handler {
+	return r.handler(r.Live)
+}
+
+// ReadyzHandler serves the readiness report.
+func (r *Registry) ReadyzHandler() http.Handler {
+	return r.handler(r.Ready)
+}
+
+// RegisterHandlers adds /healthz and /readyz to mux.
+func (r *Registry) RegisterHandlers(mux *http.ServeMux) {
+	mux.Handle("/healthz", r.HealthzHandler())
+	mux.Handle("/readyz", r.ReadyzHandler())
+}
+
+// handler responds with 200 if the report is healthy, otherwise 503,
+// with the report as JSON.
+func (r *Registry) handler(run func(context.Context) Report) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet && req.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			httputil.SetRequestError(w, req, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		report := run(req.Context())
+		statusCode := http.StatusOK
+		if !report.Healthy() {
+			statusCode = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		httputil.WriteJSON(w, req, statusCode, report)
+	})
+}
@@ -0,0 +1,214 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type contextChecker struct{}
+
+func (contextChecker) Check() error {
+	return errors.New("Check should not be called")
+}
+
+func (contextChecker) CheckContext(ctx context.Context) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func failing(message string) Checker {
+	return CheckerFunc(func() error { return errors.New(message) })
+}
+
+var passing = CheckerFunc(func() error { return nil })
+
+func TestRegistry_Ready(t *testing.T) {
+	tests := []struct {
+		name       string
+		register   func(r *Registry)
+		wantStatus Status
+		wantChecks map[string]Status
+	}{
+		{
+			"no checks",
+			func(r *Registry) {},
+			StatusOK,
+			map[string]Status{},
+		}, {
+			"all passing",
+			func(r *Registry) {
+				require.NoError(t, r.Register("a", passing))
+				require.NoError(t, r.Register("b", passing, NonCritical()))
+			},
+			StatusOK,
+			map[string]Status{"a": StatusOK, "b": StatusOK},
+		}, {
+			"non-critical failure warns",
+			func(r *Registry) {
+				require.NoError(t, r.Register("a", passing))
+				require.NoError(t, r.Register("b", failing("meh"), NonCritical()))
+			},
+			StatusWarn,
+			map[string]Status{"a": StatusOK, "b": StatusWarn},
+		}, {
+			"critical failure fails",
+			func(r *Registry) {
+				require.NoError(t, r.Register("a", failing("down")))
+				require.NoError(t, r.Register("b", failing("meh"), NonCritical()))
+			},
+			StatusFail,
+			map[string]Status{"a": StatusFail, "b": StatusWarn},
+		}, {
+			"panic fails",
+			func(r *Registry) {
+				require.NoError(t, r.Register("a", CheckerFunc(func() error { panic("boom") })))
+			},
+			StatusFail,
+			map[string]Status{"a": StatusFail},
+		}, {
+			"context checker times out",
+			func(r *Registry) {
+				require.NoError(t, r.Register("a", contextChecker{}, WithTimeout(10*time.Millisecond)))
+			},
+			StatusFail,
+			map[string]Status{"a": StatusFail},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry()
+			tt.register(r)
+			report := r.Ready(context.Background())
+			require.Equal(t, tt.wantStatus, report.Status)
+			got := map[string]Status{}
+			for _, result := range report.Checks {
+				got[result.Name] = result.Status
+				require.Equal(t, result.Status == StatusOK, result.Error == "")
+			}
+			require.Equal(t, tt.wantChecks, got)
+		})
+	}
+}
+
+func TestRegistry_Register(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.Register("a", passing))
+	require.EqualError(t, r.Register("a", passing), `health check "a" is already registered`)
+	require.Error(t, r.Register("b", passing, WithTimeout(0)))
+}
+
+func TestRegistry_timeout(t *testing.T) {
+	release := make(chan struct{})
+	var calls int32
+	r := NewRegistry()
+	require.NoError(t, r.Register("slow", CheckerFunc(func() error {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return nil
+	}), WithTimeout(10*time.Millisecond)))
+
+	report := r.Ready(context.Background())
+	require.Equal(t, StatusFail, report.Status)
+	require.Equal(t, "timed out after 10ms", report.Checks[0].Error)
+
+	// A second probe waits on the run already in progress.
+	report = r.Ready(context.Background())
+	require.Equal(t, StatusFail, report.Status)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	close(release)
+	require.Eventually(t, func() bool {
+		return r.Ready(context.Background()).Status == StatusOK
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
+
+func TestRegistry_cache(t *testing.T) {
+	var lock sync.Mutex
+	now := time.Unix(1700000000, 0)
+	var calls int
+	r := NewRegistry()
+	r.now = func() time.Time {
+		lock.Lock()
+		defer lock.Unlock()
+		return now
+	}
+	require.NoError(t, r.Register("counted", CheckerFunc(func() error {
+		calls++
+		return nil
+	}), WithCacheDuration(time.Minute)))
+	require.NoError(t, r.Register("uncached", passing, WithCacheDuration(0)))
+
+	r.Ready(context.Background())
+	r.Ready(context.Background())
+	require.Equal(t, 1, calls)
+
+	lock.Lock()
+	now = now.Add(time.Minute)
+	lock.Unlock()
+	r.Ready(context.Background())
+	require.Equal(t, 2, calls)
+}
+
+func TestRegistry_handlers(t *testing.T) {
+	r := NewRegistry()
+	require.NoError(t, r.Register("process", passing, Liveness()))
+	require.NoError(t, r.Register("database", failing("connection refused")))
+	mux := http.NewServeMux()
+	r.RegisterHandlers(mux)
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantReport Status
+		wantChecks []string
+	}{
+		{"healthz only runs liveness checks", http.MethodGet, "/healthz", http.StatusOK, StatusOK, []string{"process"}},
+		{"readyz runs all checks", http.MethodGet, "/readyz", http.StatusServiceUnavailable, StatusFail, []string{"process", "database"}},
+		{"POST not allowed", http.MethodPost, "/readyz", http.StatusMethodNotAllowed, "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, nil))
+			require.Equal(t, tt.wantStatus, w.Code)
+			if tt.wantReport == "" {
+				return
+			}
+			require.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+			var report Report
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+			require.Equal(t, tt.wantReport, report.Status)
+			names := []string{}
+			for _, result := range report.Checks {
+				names = append(names, result.Name)
+			}
+			require.Equal(t, tt.wantChecks, names)
+		})
+	}
+}
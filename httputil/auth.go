@@ -0,0 +1,575 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	// Register the hash functions used by the supported algorithms.
+	_ "crypto/sha512"
+
+	"github.com/OpsMx/go-app-base/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// AuthConfig controls how Bearer tokens are verified.  A token is
+// accepted if it matches one of StaticTokens, or is a JWT signed by
+// HMACKey or a key in JWKSFile, using one of Algorithms.
+// All times are in seconds.  If 0, a default will be used.
+type AuthConfig struct {
+	// StaticTokens maps a subject name to its token.
+	StaticTokens map[string]util.Secret `json:"staticTokens,omitempty" yaml:"staticTokens,omitempty"`
+	// HMACKey is used to verify HS256, HS384, and HS512 tokens.  It must
+	// be at least as long as the hash output, so 32 bytes for HS256.
+	HMACKey util.Secret `json:"hmacKey,omitempty" yaml:"hmacKey,omitempty"`
+	// JWKSFile is a JSON Web Key Set file, which is reloaded when it
+	// changes.  RSA, EC, and oct keys are supported.  RSA keys must be
+	// at least 2048 bits, and oct keys at least 32 bytes.
+	JWKSFile              string   `json:"jwksFile,omitempty" yaml:"jwksFile,omitempty"`
+	JWKSReloadSeconds     int      `json:"jwksReloadSeconds,omitempty" yaml:"jwksReloadSeconds,omitempty"`
+	Algorithms            []string `json:"algorithms,omitempty" yaml:"algorithms,omitempty"`
+	Issuer                string   `json:"issuer,omitempty" yaml:"issuer,omitempty"`
+	Audience              string   `json:"audience,omitempty" yaml:"audience,omitempty"`
+	ClockSkewSeconds      int      `json:"clockSkewSeconds,omitempty" yaml:"clockSkewSeconds,omitempty"`
+	AllowMissingExpiresAt bool     `json:"allowMissingExpiresAt,omitempty" yaml:"allowMissingExpiresAt,omitempty"`
+}
+
+var defaultAuthConfig = AuthConfig{
+	JWKSReloadSeconds: 60,
+	Algorithms:        []string{"HS256", "HS384", "HS512", "RS256", "RS384", "RS512", "ES256", "ES384", "ES512"},
+	ClockSkewSeconds:  60,
+}
+
+func (c *AuthConfig) applyDefaults() {
+	if c.JWKSReloadSeconds == 0 {
+		c.JWKSReloadSeconds = defaultAuthConfig.JWKSReloadSeconds
+	}
+	if len(c.Algorithms) == 0 {
+		c.Algorithms = defaultAuthConfig.Algorithms
+	}
+	if c.ClockSkewSeconds == 0 {
+		c.ClockSkewSeconds = defaultAuthConfig.ClockSkewSeconds
+	}
+}
+
+// Claims are the verified claims of a request's token.  For static
+// tokens, only Subject is set and Static is true.
+type Claims struct {
+	Subject   string
+	Issuer    string
+	Audience  []string
+	ExpiresAt time.Time
+	IssuedAt  time.Time
+	Scopes    []string
+	Static    bool
+	// Raw holds all the token's claims.
+	Raw map[string]interface{}
+}
+
+// HasScope returns true if the claims include scope.
+func (c *Claims) HasScope(scope string) bool {
+	return util.Contains(c.Scopes, scope)
+}
+
+type claimsKey struct{}
+
+// ClaimsFromContext returns the claims verified by an Authenticator.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	c, ok := ctx.Value(claimsKey{}).(*Claims)
+	return c, ok
+}
+
+// jwtAlgorithm describes a supported signing algorithm.  ES algorithms
+// may only be used with keys on their curve.
+type jwtAlgorithm struct {
+	kty   string
+	hash  crypto.Hash
+	curve string
+}
+
+var jwtAlgorithms = map[string]jwtAlgorithm{
+	"HS256": {"oct", crypto.SHA256, ""},
+	"HS384": {"oct", crypto.SHA384, ""},
+	"HS512": {"oct", crypto.SHA512, ""},
+	"RS256": {"RSA", crypto.SHA256, ""},
+	"RS384": {"RSA", crypto.SHA384, ""},
+	"RS512": {"RSA", crypto.SHA512, ""},
+	"ES256": {"EC", crypto.SHA256, "P-256"},
+	"ES384": {"EC", crypto.SHA384, "P-384"},
+	"ES512": {"EC", crypto.SHA512, "P-521"},
+}
+
+// minHMACKeyBytes is the shortest HMAC key accepted, the output size of
+// SHA-256.  Each HS algorithm also requires a key at least as long as
+// its hash output.
+const minHMACKeyBytes = 32
+
+// minRSAKeyBits is the smallest RSA modulus accepted.
+const minRSAKeyBits = 2048
+
+// jwk is a parsed key from a JWKS.  key is []byte, *rsa.PublicKey,
+// or *ecdsa.PublicKey.
+type jwk struct {
+	kid string
+	kty string
+	alg string
+	key interface{}
+}
+
+// Authenticator verifies Bearer tokens.  Use Middleware() to require
+// them on requests, and Run() to reload the JWKS file.
+type Authenticator struct {
+	conf       AuthConfig
+	algorithms map[string]bool
+	now        func() time.Time
+
+	lock    sync.RWMutex
+	keys    []jwk
+	jwksSum [sha256.Size]byte
+}
+
+// NewAuthenticator returns an Authenticator, loading the JWKS file if
+// one is configured.
+func NewAuthenticator(conf AuthConfig) (*Authenticator, error) {
+	conf.applyDefaults()
+	a := &Authenticator{
+		conf:       conf,
+		algorithms: map[string]bool{},
+		now:        time.Now,
+	}
+	for _, alg := range conf.Algorithms {
+		if _, found := jwtAlgorithms[alg]; !found {
+			return nil, fmt.Errorf("unsupported JWT algorithm %q", alg)
+		}
+		a.algorithms[alg] = true
+	}
+	if !conf.HMACKey.IsZero() && len(conf.HMACKey.Reveal()) < minHMACKeyBytes {
+		return nil, fmt.Errorf("HMAC key must be at least %d bytes", minHMACKeyBytes)
+	}
+	if len(conf.StaticTokens) == 0 && conf.HMACKey.IsZero() && conf.JWKSFile == "" {
+		return nil, fmt.Errorf("no static tokens, HMAC key, or JWKS file configured")
+	}
+	if conf.JWKSFile != "" {
+		if _, err := a.ReloadJWKS(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// Run reloads the JWKS file every JWKSReloadSeconds until ctx is done.
+// Errors are logged, and the current keys continue to be used.
+func (a *Authenticator) Run(ctx context.Context) {
+	if a.conf.JWKSFile == "" {
+		return
+	}
+	ticker := time.NewTicker(time.Duration(a.conf.JWKSReloadSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := a.ReloadJWKS()
+			if err != nil {
+				log.Printf("reloading JWKS: %v", err)
+				continue
+			}
+			if changed {
+				log.Printf("reloaded JWKS from %s", a.conf.JWKSFile)
+			}
+		}
+	}
+}
+
+// ReloadJWKS reads the JWKS file, and if it has changed and is valid,
+// starts using it.  It returns true if the keys changed.
+func (a *Authenticator) ReloadJWKS() (bool, error) {
+	d, err := os.ReadFile(a.conf.JWKSFile)
+	if err != nil {
+		return false, fmt.Errorf("reading JWKS: %v", err)
+	}
+	sum := sha256.Sum256(d)
+	a.lock.RLock()
+	unchanged := a.keys != nil && sum == a.jwksSum
+	a.lock.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	keys, err := parseJWKS(d)
+	if err != nil {
+		return false, err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.keys = keys
+	a.jwksSum = sum
+	return true, nil
+}
+
+func parseJWKS(d []byte) ([]jwk, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Alg string `json:"alg"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+			K   string `json:"k"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(d, &set); err != nil {
+		return nil, fmt.Errorf("decoding JWKS: %v", err)
+	}
+	keys := make([]jwk, 0, len(set.Keys))
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key := jwk{kid: k.Kid, kty: k.Kty, alg: k.Alg}
+		var err error
+		switch k.Kty {
+		case "RSA":
+			key.key, err = parseRSAJWK(k.N, k.E)
+		case "EC":
+			key.key, err = parseECJWK(k.Crv, k.X, k.Y)
+		case "oct":
+			key.key, err = parseOctJWK(k.K)
+		default:
+			err = fmt.Errorf("unsupported key type %q", k.Kty)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("JWKS key %d (%q): %v", i, k.Kid, err)
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS has no signing keys")
+	}
+	return keys, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("missing value")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func parseRSAJWK(n string, e string) (*rsa.PublicKey, error) {
+	modulus, err := decodeBigInt(n)
+	if err != nil {
+		return nil, fmt.Errorf("modulus: %v", err)
+	}
+	exponent, err := decodeBigInt(e)
+	if err != nil {
+		return nil, fmt.Errorf("exponent: %v", err)
+	}
+	if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+		return nil, fmt.Errorf("exponent too large")
+	}
+	if modulus.BitLen() < minRSAKeyBits {
+		return nil, fmt.Errorf("key must be at least %d bits", minRSAKeyBits)
+	}
+	return &rsa.PublicKey{N: modulus, E: int(exponent.Int64())}, nil
+}
+
+func parseOctJWK(k string) ([]byte, error) {
+	secret, err := base64.RawURLEncoding.DecodeString(k)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret) < minHMACKeyBytes {
+		return nil, fmt.Errorf("key must be at least %d bytes", minHMACKeyBytes)
+	}
+	return secret, nil
+}
+
+func parseECJWK(crv string, x string, y string) (*ecdsa.PublicKey, error) {
+	var curve elliptic.Curve
+	switch crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("unsupported curve %q", crv)
+	}
+	px, err := decodeBigInt(x)
+	if err != nil {
+		return nil, fmt.Errorf("x: %v", err)
+	}
+	py, err := decodeBigInt(y)
+	if err != nil {
+		return nil, fmt.Errorf("y: %v", err)
+	}
+	if !curve.IsOnCurve(px, py) {
+		return nil, fmt.Errorf("point is not on curve %s", crv)
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: px, Y: py}, nil
+}
+
+var errInvalidToken = errors.New("invalid token")
+
+// Authenticate verifies a token, returning its claims.
+func (a *Authenticator) Authenticate(token string) (*Claims, error) {
+	for subject, static := range a.conf.StaticTokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(static.Reveal())) == 1 {
+			return &Claims{Subject: subject, Static: true}, nil
+		}
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+	var header struct {
+		Alg  string          `json:"alg"`
+		Kid  string          `json:"kid"`
+		Crit json.RawMessage `json:"crit"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", errInvalidToken, err)
+	}
+	// No header extensions are understood, so any marked critical
+	// must be rejected (RFC 7515 section 4.1.11).
+	if header.Crit != nil {
+		return nil, fmt.Errorf("%w: critical header extensions not supported", errInvalidToken)
+	}
+	if !a.algorithms[header.Alg] {
+		return nil, fmt.Errorf("%w: algorithm %q not allowed", errInvalidToken, header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", errInvalidToken, err)
+	}
+	if !a.verifySignature(header.Alg, header.Kid, parts[0]+"."+parts[1], signature) {
+		return nil, fmt.Errorf("%w: signature not valid", errInvalidToken)
+	}
+
+	var raw map[string]interface{}
+	if err := decodeJWTPart(parts[1], &raw); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", errInvalidToken, err)
+	}
+	claims, err := a.checkClaims(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidToken, err)
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	d, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(d, v)
+}
+
+// verifySignature tries each key which could have signed the token.
+func (a *Authenticator) verifySignature(alg string, kid string, signed string, signature []byte) bool {
+	spec := jwtAlgorithms[alg]
+	var candidates []interface{}
+	if spec.kty == "oct" && !a.conf.HMACKey.IsZero() && kid == "" {
+		candidates = append(candidates, []byte(a.conf.HMACKey.Reveal()))
+	}
+	a.lock.RLock()
+	for _, k := range a.keys {
+		if k.kty != spec.kty || (k.alg != "" && k.alg != alg) || (kid != "" && k.kid != kid) {
+			continue
+		}
+		candidates = append(candidates, k.key)
+	}
+	a.lock.RUnlock()
+
+	h := spec.hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+	for _, key := range candidates {
+		switch k := key.(type) {
+		case []byte:
+			if len(k) < spec.hash.Size() {
+				continue
+			}
+			mac := hmac.New(spec.hash.New, k)
+			mac.Write([]byte(signed))
+			if hmac.Equal(mac.Sum(nil), signature) {
+				return true
+			}
+		case *rsa.PublicKey:
+			if rsa.VerifyPKCS1v15(k, spec.hash, digest, signature) == nil {
+				return true
+			}
+		case *ecdsa.PublicKey:
+			size := (k.Curve.Params().BitSize + 7) / 8
+			if k.Curve.Params().Name != spec.curve || len(signature) != 2*size {
+				continue
+			}
+			r := new(big.Int).SetBytes(signature[:size])
+			s := new(big.Int).SetBytes(signature[size:])
+			if ecdsa.Verify(k, digest, r, s) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *Authenticator) checkClaims(raw map[string]interface{}) (*Claims, error) {
+	claims := &Claims{Raw: raw}
+	claims.Subject, _ = raw["sub"].(string)
+	claims.Issuer, _ = raw["iss"].(string)
+	switch aud := raw["aud"].(type) {
+	case string:
+		claims.Audience = []string{aud}
+	case []interface{}:
+		for _, v := range aud {
+			if s, ok := v.(string); ok {
+				claims.Audience = append(claims.Audience, s)
+			}
+		}
+	}
+	switch scope := raw["scope"].(type) {
+	case string:
+		claims.Scopes = strings.Fields(scope)
+	}
+	if scp, ok := raw["scp"].([]interface{}); ok {
+		for _, v := range scp {
+			if s, ok := v.(string); ok {
+				claims.Scopes = append(claims.Scopes, s)
+			}
+		}
+	}
+
+	now := a.now()
+	skew := time.Duration(a.conf.ClockSkewSeconds) * time.Second
+	if exp, ok := numericDate(raw["exp"]); ok {
+		claims.ExpiresAt = exp
+		if !now.Before(exp.Add(skew)) {
+			return nil, fmt.Errorf("token expired")
+		}
+	} else if !a.conf.AllowMissingExpiresAt {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	if nbf, ok := numericDate(raw["nbf"]); ok && now.Add(skew).Before(nbf) {
+		return nil, fmt.Errorf("token not yet valid")
+	}
+	if iat, ok := numericDate(raw["iat"]); ok {
+		claims.IssuedAt = iat
+	}
+	if a.conf.Issuer != "" && claims.Issuer != a.conf.Issuer {
+		return nil, fmt.Errorf("issuer %q not accepted", claims.Issuer)
+	}
+	if a.conf.Audience != "" && !util.Contains(claims.Audience, a.conf.Audience) {
+		return nil, fmt.Errorf("audience not accepted")
+	}
+	return claims, nil
+}
+
+func numericDate(v interface{}) (time.Time, bool) {
+	f, ok := v.(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	sec := int64(f)
+	return time.Unix(sec, int64((f-float64(sec))*1e9)), true
+}
+
+// Middleware requires a valid Bearer token on each request, responding
+// with 401 if it is missing or invalid.  The verified claims are added
+// to the request's context; see ClaimsFromContext().
+func (a *Authenticator) Middleware() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, found := bearerToken(r)
+			if !found {
+				w.Header().Set("WWW-Authenticate", `Bearer`)
+				SetRequestError(w, r, http.StatusUnauthorized, "authorization required")
+				return
+			}
+			claims, err := a.Authenticate(token)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				SetRequestError(w, r, http.StatusUnauthorized, "invalid token")
+				return
+			}
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("enduser.id", claims.Subject))
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+		})
+	}
+}
+
+// RequireScopes responds with 403 unless the request's claims include
+// all the scopes.  It must be used after an Authenticator's Middleware().
+// Static tokens have no scopes.
+func RequireScopes(scopes ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims, found := ClaimsFromContext(r.Context())
+			if !found {
+				w.Header().Set("WWW-Authenticate", `Bearer`)
+				SetRequestError(w, r, http.StatusUnauthorized, "authorization required")
+				return
+			}
+			for _, scope := range scopes {
+				if !claims.HasScope(scope) {
+					w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, strings.Join(scopes, " ")))
+					SetRequestError(w, r, http.StatusForbidden, "missing scope "+scope)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !found || !strings.EqualFold(scheme, "bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
@@ -0,0 +1,346 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/OpsMx/go-app-base/util"
+	"github.com/stretchr/testify/require"
+)
+
+var testAuthNow = time.Unix(1700000000, 0)
+
+// signTestJWT signs claims with key, which is []byte, *rsa.PrivateKey,
+// or *ecdsa.PrivateKey.
+func signTestJWT(t *testing.T, alg string, kid string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	header := map[string]interface{}{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	return signTestJWTHeader(t, header, key, claims)
+}
+
+// signTestJWTHeader is signTestJWT with a caller supplied header, which
+// must include alg.
+func signTestJWTHeader(t *testing.T, header map[string]interface{}, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	alg := header["alg"].(string)
+	h, err := json.Marshal(header)
+	require.NoError(t, err)
+	c, err := json.Marshal(claims)
+	require.NoError(t, err)
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	hash := jwtAlgorithms[alg].hash
+	var signature []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(hash.New, k)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := hash.New()
+		digest.Write([]byte(signed))
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, hash, digest.Sum(nil))
+		require.NoError(t, err)
+	case *ecdsa.PrivateKey:
+		digest := hash.New()
+		digest.Write([]byte(signed))
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest.Sum(nil))
+		require.NoError(t, err)
+		size := (k.Curve.Params().BitSize + 7) / 8
+		signature = make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(kid string, k *rsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+}
+
+func ecJWK(kid string, crv string, k *ecdsa.PrivateKey) map[string]string {
+	size := (k.Curve.Params().BitSize + 7) / 8
+	x := make([]byte, size)
+	y := make([]byte, size)
+	k.X.FillBytes(x)
+	k.Y.FillBytes(y)
+	return map[string]string{"kty": "EC", "kid": kid, "crv": crv, "x": b64(x), "y": b64(y)}
+}
+
+func writeJWKS(t *testing.T, path string, keys ...map[string]string) {
+	t.Helper()
+	d, err := json.Marshal(map[string]interface{}{"keys": keys})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, d, 0600))
+}
+
+func TestAuthenticator_Authenticate(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ec256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ec384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	otherRSA, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	hmacKey := []byte("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+	octKey := []byte("fedcba9876543210fedcba9876543210fedcba9876543210fedcba9876543210")
+
+	jwksFile := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwksFile,
+		rsaJWK("rsa", rsaKey),
+		ecJWK("ec256", "P-256", ec256),
+		ecJWK("ec384", "P-384", ec384),
+		map[string]string{"kty": "oct", "kid": "oct", "k": b64(octKey)},
+	)
+
+	a, err := NewAuthenticator(AuthConfig{
+		StaticTokens: map[string]util.Secret{"ci": util.NewSecret("static-token")},
+		HMACKey:      util.NewSecret(string(hmacKey)),
+		JWKSFile:     jwksFile,
+		Issuer:       "https://issuer",
+		Audience:     "api",
+	})
+	require.NoError(t, err)
+	a.now = func() time.Time { return testAuthNow }
+
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{
+			"sub":   "alice",
+			"iss":   "https://issuer",
+			"aud":   []string{"other", "api"},
+			"exp":   testAuthNow.Add(time.Hour).Unix(),
+			"iat":   testAuthNow.Unix(),
+			"scope": "read write",
+		}
+	}
+	with := func(key string, value interface{}) map[string]interface{} {
+		c := valid()
+		if value == nil {
+			delete(c, key)
+		} else {
+			c[key] = value
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantSub string
+	}{
+		{"static", "static-token", "ci"},
+		{"HS256 config key", signTestJWT(t, "HS256", "", hmacKey, valid()), "alice"},
+		{"HS512 config key", signTestJWT(t, "HS512", "", hmacKey, valid()), "alice"},
+		{"HS384 JWKS key", signTestJWT(t, "HS384", "oct", octKey, valid()), "alice"},
+		{"RS256", signTestJWT(t, "RS256", "rsa", rsaKey, valid()), "alice"},
+		{"RS512 without kid", signTestJWT(t, "RS512", "", rsaKey, valid()), "alice"},
+		{"ES256", signTestJWT(t, "ES256", "ec256", ec256, valid()), "alice"},
+		{"ES384", signTestJWT(t, "ES384", "ec384", ec384, valid()), "alice"},
+		{"within clock skew", signTestJWT(t, "RS256", "rsa", rsaKey, with("exp", testAuthNow.Add(-30*time.Second).Unix())), "alice"},
+		{"string audience", signTestJWT(t, "RS256", "rsa", rsaKey, with("aud", "api")), "alice"},
+
+		{"wrong static token", "static-tokem", ""},
+		{"garbage", "a.b.c", ""},
+		{"alg none", b64([]byte(`{"alg":"none"}`)) + "." + b64([]byte(`{"sub":"x"}`)) + ".", ""},
+		{"wrong key", signTestJWT(t, "RS256", "rsa", otherRSA, valid()), ""},
+		{"unknown kid", signTestJWT(t, "RS256", "nope", rsaKey, valid()), ""},
+		{"key type mismatch", signTestJWT(t, "ES256", "rsa", ec256, valid()), ""},
+		{"ES256 with a P-384 key", signTestJWT(t, "ES256", "ec384", ec384, valid()), ""},
+		{"ES384 with a P-256 key", signTestJWT(t, "ES384", "ec256", ec256, valid()), ""},
+		{"HS512 with a key shorter than the hash", signTestJWT(t, "HS512", "", hmacKey[:32], valid()), ""},
+		{"HS256 with an empty key", signTestJWT(t, "HS256", "", []byte{}, valid()), ""},
+		{"expired", signTestJWT(t, "RS256", "rsa", rsaKey, with("exp", testAuthNow.Add(-2*time.Minute).Unix())), ""},
+		{"no expiry", signTestJWT(t, "RS256", "rsa", rsaKey, with("exp", nil)), ""},
+		{"not yet valid", signTestJWT(t, "RS256", "rsa", rsaKey, with("nbf", testAuthNow.Add(time.Hour).Unix())), ""},
+		{"wrong issuer", signTestJWT(t, "RS256", "rsa", rsaKey, with("iss", "https://evil")), ""},
+		{"wrong audience", signTestJWT(t, "RS256", "rsa", rsaKey, with("aud", "other")), ""},
+		{"critical header", signTestJWTHeader(t, map[string]interface{}{"alg": "RS256", "kid": "rsa", "crit": []string{"exp"}, "exp": 1}, rsaKey, valid()), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := a.Authenticate(tt.token)
+			if tt.wantSub == "" {
+				require.ErrorIs(t, err, errInvalidToken)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantSub, claims.Subject)
+			if !claims.Static {
+				require.Equal(t, []string{"read", "write"}, claims.Scopes)
+				require.True(t, claims.ExpiresAt.After(testAuthNow.Add(-time.Minute)))
+			}
+		})
+	}
+
+	t.Run("algorithm not allowed", func(t *testing.T) {
+		b, err := NewAuthenticator(AuthConfig{JWKSFile: jwksFile, Algorithms: []string{"ES256"}})
+		require.NoError(t, err)
+		b.now = a.now
+		_, err = b.Authenticate(signTestJWT(t, "RS256", "rsa", rsaKey, valid()))
+		require.ErrorIs(t, err, errInvalidToken)
+		_, err = b.Authenticate(signTestJWT(t, "ES256", "ec256", ec256, valid()))
+		require.NoError(t, err)
+	})
+}
+
+func TestNewAuthenticator_errors(t *testing.T) {
+	dir := t.TempDir()
+	bad := filepath.Join(dir, "bad.json")
+	require.NoError(t, os.WriteFile(bad, []byte(`{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`), 0600))
+	emptyOct := filepath.Join(dir, "empty-oct.json")
+	require.NoError(t, os.WriteFile(emptyOct, []byte(`{"keys":[{"kty":"oct","kid":"x"}]}`), 0600))
+	shortOct := filepath.Join(dir, "short-oct.json")
+	require.NoError(t, os.WriteFile(shortOct, []byte(`{"keys":[{"kty":"oct","k":"`+b64([]byte("short"))+`"}]}`), 0600))
+	weakRSAKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	require.NoError(t, err)
+	weakRSA := filepath.Join(dir, "weak-rsa.json")
+	writeJWKS(t, weakRSA, rsaJWK("weak", weakRSAKey))
+
+	tests := []struct {
+		name string
+		conf AuthConfig
+	}{
+		{"nothing configured", AuthConfig{}},
+		{"unknown algorithm", AuthConfig{HMACKey: util.NewSecret("0123456789abcdef0123456789abcdef"), Algorithms: []string{"none"}}},
+		{"missing JWKS", AuthConfig{JWKSFile: filepath.Join(dir, "missing.json")}},
+		{"point not on curve", AuthConfig{JWKSFile: bad}},
+		{"empty oct key", AuthConfig{JWKSFile: emptyOct}},
+		{"short oct key", AuthConfig{JWKSFile: shortOct}},
+		{"1024 bit RSA key", AuthConfig{JWKSFile: weakRSA}},
+		{"short HMAC key", AuthConfig{HMACKey: util.NewSecret("short")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAuthenticator(tt.conf)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestAuthenticator_ReloadJWKS(t *testing.T) {
+	first, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	second, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, path, rsaJWK("k1", first))
+
+	a, err := NewAuthenticator(AuthConfig{JWKSFile: path})
+	require.NoError(t, err)
+	claims := map[string]interface{}{"sub": "bob", "exp": time.Now().Add(time.Hour).Unix()}
+	_, err = a.Authenticate(signTestJWT(t, "RS256", "k2", second, claims))
+	require.Error(t, err)
+
+	changed, err := a.ReloadJWKS()
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	writeJWKS(t, path, rsaJWK("k2", second))
+	changed, err = a.ReloadJWKS()
+	require.NoError(t, err)
+	require.True(t, changed)
+	_, err = a.Authenticate(signTestJWT(t, "RS256", "k2", second, claims))
+	require.NoError(t, err)
+
+	// An invalid file leaves the current keys in use.
+	require.NoError(t, os.WriteFile(path, []byte(`{"keys":[]}`), 0600))
+	_, err = a.ReloadJWKS()
+	require.Error(t, err)
+	_, err = a.Authenticate(signTestJWT(t, "RS256", "k2", second, claims))
+	require.NoError(t, err)
+}
+
+func TestAuthenticator_Middleware(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	a, err := NewAuthenticator(AuthConfig{
+		StaticTokens: map[string]util.Secret{"ci": util.NewSecret("static-token")},
+		HMACKey:      util.NewSecret(string(key)),
+	})
+	require.NoError(t, err)
+	token := signTestJWT(t, "HS256", "", key, map[string]interface{}{
+		"sub":   "alice",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"scope": "read",
+	})
+
+	handler := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, found := ClaimsFromContext(r.Context())
+		require.True(t, found)
+		_, _ = w.Write([]byte(claims.Subject))
+	}), a.Middleware())
+	scoped := Chain(handler, a.Middleware(), RequireScopes("read"))
+	writeScoped := Chain(handler, a.Middleware(), RequireScopes("read", "write"))
+
+	tests := []struct {
+		name          string
+		handler       http.Handler
+		authorization string
+		wantStatus    int
+		wantBody      string
+		wantChallenge string
+	}{
+		{"no header", handler, "", http.StatusUnauthorized, "", `Bearer`},
+		{"basic auth", handler, "Basic YTpi", http.StatusUnauthorized, "", `Bearer`},
+		{"invalid token", handler, "Bearer nope", http.StatusUnauthorized, "", `Bearer error="invalid_token"`},
+		{"static token", handler, "Bearer static-token", http.StatusOK, "ci", ""},
+		{"jwt", handler, "bearer " + token, http.StatusOK, "alice", ""},
+		{"has scope", scoped, "Bearer " + token, http.StatusOK, "alice", ""},
+		{"missing scope", writeScoped, "Bearer " + token, http.StatusForbidden, "", `Bearer error="insufficient_scope", scope="read write"`},
+		{"static token has no scopes", scoped, "Bearer static-token", http.StatusForbidden, "", `Bearer error="insufficient_scope", scope="read"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, r)
+			require.Equal(t, tt.wantStatus, w.Code)
+			require.Equal(t, tt.wantChallenge, w.Header().Get("WWW-Authenticate"))
+			if tt.wantBody != "" {
+				require.Equal(t, tt.wantBody, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("RequireScopes without authentication", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		RequireScopes("read")(handler).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		require.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+}
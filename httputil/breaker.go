@@ -0,0 +1,276 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrCircuitOpen is returned, wrapped with the host name, when a request
+// is rejected because the circuit breaker for its host is open.  Use
+// errors.Is() to detect it; http.Client wraps it in a *url.Error.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// BreakerConfig controls a circuit breaker transport.
+// All times are in seconds.  If 0, a default will be used.
+//
+// After FailureThreshold consecutive failures to a host, its circuit
+// opens and requests fail immediately with ErrCircuitOpen.  After
+// OpenSeconds, up to HalfOpenRequests trial requests are let through;
+// if they succeed the circuit closes, otherwise it opens again.
+//
+// Transport errors, and responses with one of FailureStatusCodes, are
+// failures.  Requests cancelled by the caller are not counted, but those
+// which pass their deadline, including an http.Client Timeout, are.
+type BreakerConfig struct {
+	FailureThreshold   int   `json:"failureThreshold,omitempty" yaml:"failureThreshold,omitempty"`
+	OpenSeconds        int   `json:"openSeconds,omitempty" yaml:"openSeconds,omitempty"`
+	HalfOpenRequests   int   `json:"halfOpenRequests,omitempty" yaml:"halfOpenRequests,omitempty"`
+	FailureStatusCodes []int `json:"failureStatusCodes,omitempty" yaml:"failureStatusCodes,omitempty"`
+}
+
+var defaultBreakerConfig = BreakerConfig{
+	FailureThreshold: 5,
+	OpenSeconds:      30,
+	HalfOpenRequests: 1,
+	FailureStatusCodes: []int{
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	},
+}
+
+func (c *BreakerConfig) applyDefaults() {
+	if c.FailureThreshold == 0 {
+		c.FailureThreshold = defaultBreakerConfig.FailureThreshold
+	}
+	if c.OpenSeconds == 0 {
+		c.OpenSeconds = defaultBreakerConfig.OpenSeconds
+	}
+	if c.HalfOpenRequests == 0 {
+		c.HalfOpenRequests = defaultBreakerConfig.HalfOpenRequests
+	}
+	if len(c.FailureStatusCodes) == 0 {
+		c.FailureStatusCodes = defaultBreakerConfig.FailureStatusCodes
+	}
+}
+
+// BreakerState is the state of one host's circuit.
+type BreakerState int
+
+const (
+	// BreakerClosed lets all requests through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen rejects all requests.
+	BreakerOpen
+	// BreakerHalfOpen lets a limited number of trial requests through.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// WithCircuitBreaker adds a circuit breaker to a client.  If also using
+// WithRetry(), add the circuit breaker first so each retry is counted,
+// and requests rejected by an open circuit are not retried.
+func WithCircuitBreaker(conf BreakerConfig) ClientOption {
+	return WithTransportWrapper(func(next http.RoundTripper) http.RoundTripper {
+		return NewBreakerTransport(next, conf)
+	})
+}
+
+type hostBreaker struct {
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	trials   int
+}
+
+// BreakerTransport is an http.RoundTripper which keeps a circuit breaker
+// for each upstream host.  State changes are logged, counted in the
+// `http.client.circuit_breaker.transitions` metric, and added as events
+// to the current span.
+type BreakerTransport struct {
+	next        http.RoundTripper
+	conf        BreakerConfig
+	now         func() time.Time
+	transitions metric.Int64Counter
+
+	lock  sync.Mutex
+	hosts map[string]*hostBreaker
+}
+
+// NewBreakerTransport returns a BreakerTransport which sends requests using next.
+func NewBreakerTransport(next http.RoundTripper, conf BreakerConfig) *BreakerTransport {
+	conf.applyDefaults()
+	transitions, err := otel.Meter(meterName).Int64Counter(
+		"http.client.circuit_breaker.transitions",
+		metric.WithDescription("Circuit breaker state changes, by host and new state"),
+	)
+	if err != nil {
+		otel.Handle(err)
+	}
+	return &BreakerTransport{
+		next:        next,
+		conf:        conf,
+		now:         time.Now,
+		transitions: transitions,
+		hosts:       map[string]*hostBreaker{},
+	}
+}
+
+// State returns the current state of the circuit for host.
+func (bt *BreakerTransport) State(host string) BreakerState {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	if hb, found := bt.hosts[host]; found {
+		return hb.state
+	}
+	return BreakerClosed
+}
+
+// RoundTrip implements http.RoundTripper.
+func (bt *BreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	host := req.URL.Host
+
+	if !bt.allow(ctx, host) {
+		trace.SpanFromContext(ctx).AddEvent("circuit_breaker.rejected", trace.WithAttributes(
+			attribute.String("server.address", host),
+		))
+		return nil, fmt.Errorf("%s: %w", host, ErrCircuitOpen)
+	}
+
+	resp, err := bt.next.RoundTrip(req)
+	switch {
+	case err != nil && errors.Is(ctx.Err(), context.Canceled):
+		bt.release(host)
+	case bt.failed(resp, err):
+		bt.recordFailure(ctx, host)
+	default:
+		bt.recordSuccess(ctx, host)
+	}
+	return resp, err
+}
+
+func (bt *BreakerTransport) failed(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	for _, code := range bt.conf.FailureStatusCodes {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+func (bt *BreakerTransport) allow(ctx context.Context, host string) bool {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	hb, found := bt.hosts[host]
+	if !found {
+		hb = &hostBreaker{}
+		bt.hosts[host] = hb
+	}
+	switch hb.state {
+	case BreakerOpen:
+		if bt.now().Sub(hb.openedAt) < time.Duration(bt.conf.OpenSeconds)*time.Second {
+			return false
+		}
+		bt.transition(ctx, host, hb, BreakerHalfOpen)
+		hb.trials = 1
+		return true
+	case BreakerHalfOpen:
+		if hb.trials >= bt.conf.HalfOpenRequests {
+			return false
+		}
+		hb.trials++
+		return true
+	}
+	return true
+}
+
+// release gives back a half-open trial which did not complete.
+func (bt *BreakerTransport) release(host string) {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	if hb := bt.hosts[host]; hb.state == BreakerHalfOpen && hb.trials > 0 {
+		hb.trials--
+	}
+}
+
+func (bt *BreakerTransport) recordFailure(ctx context.Context, host string) {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	hb := bt.hosts[host]
+	hb.failures++
+	if hb.state == BreakerHalfOpen || (hb.state == BreakerClosed && hb.failures >= bt.conf.FailureThreshold) {
+		hb.openedAt = bt.now()
+		hb.trials = 0
+		bt.transition(ctx, host, hb, BreakerOpen)
+	}
+}
+
+func (bt *BreakerTransport) recordSuccess(ctx context.Context, host string) {
+	bt.lock.Lock()
+	defer bt.lock.Unlock()
+	hb := bt.hosts[host]
+	hb.failures = 0
+	if hb.state == BreakerHalfOpen {
+		hb.trials = 0
+		bt.transition(ctx, host, hb, BreakerClosed)
+	}
+}
+
+// transition must be called with the lock held.
+func (bt *BreakerTransport) transition(ctx context.Context, host string, hb *hostBreaker, to BreakerState) {
+	from := hb.state
+	if from == to {
+		return
+	}
+	hb.state = to
+	log.Printf("circuit breaker for %s: %s -> %s", host, from, to)
+	attrs := []attribute.KeyValue{
+		attribute.String("server.address", host),
+		attribute.String("circuit_breaker.state", to.String()),
+	}
+	if bt.transitions != nil {
+		bt.transitions.Add(ctx, 1, metric.WithAttributes(attrs...))
+	}
+	trace.SpanFromContext(ctx).AddEvent("circuit_breaker.state_change", trace.WithAttributes(
+		append(attrs, attribute.String("circuit_breaker.previous_state", from.String()))...,
+	))
+}
@@ -0,0 +1,200 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// fakeUpstream answers with status, or fails with an error if status is 0.
+type fakeUpstream struct {
+	status int
+	calls  int
+}
+
+func (fu *fakeUpstream) RoundTrip(req *http.Request) (*http.Response, error) {
+	fu.calls++
+	if fu.status == 0 {
+		return nil, fmt.Errorf("connection refused")
+	}
+	return &http.Response{StatusCode: fu.status, Body: http.NoBody, Request: req}, nil
+}
+
+func TestBreakerTransport(t *testing.T) {
+	upstream := &fakeUpstream{}
+	now := time.Unix(1662067531, 0)
+	bt := NewBreakerTransport(upstream, BreakerConfig{FailureThreshold: 3, OpenSeconds: 10})
+	bt.now = func() time.Time { return now }
+
+	get := func(host string) error {
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+"/", nil)
+		resp, err := bt.RoundTrip(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// Failures below the threshold leave the circuit closed, and a
+	// success resets the count.
+	upstream.status = 503
+	require.NoError(t, get("agent"))
+	require.NoError(t, get("agent"))
+	upstream.status = 200
+	require.NoError(t, get("agent"))
+	upstream.status = 0
+	require.Error(t, get("agent"))
+	require.Error(t, get("agent"))
+	require.Equal(t, BreakerClosed, bt.State("agent"))
+
+	// The third consecutive failure opens it, and requests then fail fast.
+	require.Error(t, get("agent"))
+	require.Equal(t, BreakerOpen, bt.State("agent"))
+	calls := upstream.calls
+	err := get("agent")
+	require.True(t, errors.Is(err, ErrCircuitOpen))
+	require.Equal(t, calls, upstream.calls)
+
+	// Other hosts are not affected.
+	upstream.status = 200
+	require.NoError(t, get("controller"))
+	require.Equal(t, BreakerClosed, bt.State("controller"))
+
+	// After OpenSeconds a failed trial opens it again.
+	now = now.Add(10 * time.Second)
+	upstream.status = 502
+	require.NoError(t, get("agent"))
+	require.Equal(t, BreakerOpen, bt.State("agent"))
+	require.ErrorIs(t, get("agent"), ErrCircuitOpen)
+
+	// ... and a successful one closes it.
+	now = now.Add(10 * time.Second)
+	upstream.status = 200
+	require.NoError(t, get("agent"))
+	require.Equal(t, BreakerClosed, bt.State("agent"))
+	require.NoError(t, get("agent"))
+}
+
+func TestBreakerTransport_halfOpenLimit(t *testing.T) {
+	now := time.Unix(1662067531, 0)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	bt := NewBreakerTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if req.Header.Get("block") != "" {
+			close(started)
+			<-release
+		}
+		return nil, fmt.Errorf("down")
+	}), BreakerConfig{FailureThreshold: 1, OpenSeconds: 10})
+	bt.now = func() time.Time { return now }
+
+	req := httptest.NewRequest(http.MethodGet, "http://agent/", nil)
+	_, err := bt.RoundTrip(req)
+	require.Error(t, err)
+	require.Equal(t, BreakerOpen, bt.State("agent"))
+
+	now = now.Add(10 * time.Second)
+	done := make(chan struct{})
+	go func() {
+		blocked := req.Clone(context.Background())
+		blocked.Header.Set("block", "yes")
+		_, _ = bt.RoundTrip(blocked)
+		close(done)
+	}()
+	<-started
+	require.Equal(t, BreakerHalfOpen, bt.State("agent"))
+	_, err = bt.RoundTrip(req)
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	close(release)
+	<-done
+	require.Equal(t, BreakerOpen, bt.State("agent"))
+}
+
+func TestBreakerTransport_cancelledNotCounted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	bt := NewBreakerTransport(roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, req.Context().Err()
+	}), BreakerConfig{FailureThreshold: 1})
+	req := httptest.NewRequest(http.MethodGet, "http://agent/", nil).WithContext(ctx)
+	_, err := bt.RoundTrip(req)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, BreakerClosed, bt.State("agent"))
+}
+
+func TestBreakerTransport_timeoutCounted(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	bt := NewBreakerTransport(http.DefaultTransport, BreakerConfig{FailureThreshold: 1})
+	client := &http.Client{Transport: bt, Timeout: 50 * time.Millisecond}
+	_, err := client.Get(server.URL)
+	require.Error(t, err)
+	require.Equal(t, BreakerOpen, bt.State(server.Listener.Addr().String()))
+}
+
+func TestBreakerTransport_spanEvents(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	ctx, span := provider.Tracer("test").Start(context.Background(), "call")
+
+	bt := NewBreakerTransport(&fakeUpstream{}, BreakerConfig{FailureThreshold: 1})
+	req := httptest.NewRequest(http.MethodGet, "http://agent/", nil).WithContext(ctx)
+	_, err := bt.RoundTrip(req)
+	require.Error(t, err)
+	_, err = bt.RoundTrip(req)
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	span.End()
+
+	events := recorder.Ended()[0].Events()
+	require.Len(t, events, 2)
+	require.Equal(t, "circuit_breaker.state_change", events[0].Name)
+	require.Equal(t, "circuit_breaker.rejected", events[1].Name)
+}
+
+func TestRetryTransport_circuitOpenNotRetried(t *testing.T) {
+	upstream := &fakeUpstream{}
+	client := NewClient(
+		WithTransportWrapper(func(http.RoundTripper) http.RoundTripper { return upstream }),
+		WithCircuitBreaker(BreakerConfig{FailureThreshold: 1}),
+		WithRetry(RetryConfig{MaxAttempts: 5, InitialBackoffMilliseconds: 1}),
+	)
+	_, err := client.Get("http://agent/")
+	require.ErrorIs(t, err, ErrCircuitOpen)
+	require.Equal(t, 1, upstream.calls)
+}
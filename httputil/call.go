@@ -0,0 +1,173 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/OpsMx/go-app-base/util"
+)
+
+// CallOptions controls a CallJSON() or GetJSON() request.
+type CallOptions struct {
+	// Token, if set, is sent as a Bearer token.
+	Token util.Secret
+	// Header holds additional request headers, such as If-None-Match.
+	Header http.Header
+	// MaxResponseBytes limits the size of the response body which will
+	// be read.  If 0, a default of 10 MiB is used.
+	MaxResponseBytes int64
+}
+
+const defaultMaxResponseBytes = 10 << 20
+
+// Response is the result of a successful call.  If the request was
+// conditional and the server replied 304 Not Modified, NotModified is
+// true and Body is the zero value.
+type Response[T any] struct {
+	StatusCode  int
+	Header      http.Header
+	NotModified bool
+	Body        T
+}
+
+// ResponseError is returned when the server replies with a status
+// other than 2xx.  If the body was in the format written by SetError()
+// or WriteProblem(), Message holds the server's error message and, for
+// problem details, Problem holds the full details.
+type ResponseError struct {
+	StatusCode int
+	Message    string
+	Problem    *Problem
+	Header     http.Header
+	// Body holds up to the first 4 KiB of the response.
+	Body []byte
+}
+
+func (e *ResponseError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("http status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("http status %d: %s", e.StatusCode, e.Message)
+}
+
+// CallJSON sends request as JSON using method, and decodes a JSON
+// response into Resp.  Non-2xx responses are returned as a *ResponseError.
+func CallJSON[Req any, Resp any](ctx context.Context, client *http.Client, method string, url string, request Req, opts CallOptions) (*Response[Resp], error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling request: %v", err)
+	}
+	return doJSON[Resp](ctx, client, method, url, body, opts)
+}
+
+// GetJSON makes a GET request and decodes a JSON response into Resp.
+// Non-2xx responses are returned as a *ResponseError.
+func GetJSON[Resp any](ctx context.Context, client *http.Client, url string, opts CallOptions) (*Response[Resp], error) {
+	return doJSON[Resp](ctx, client, http.MethodGet, url, nil, opts)
+}
+
+func doJSON[Resp any](ctx context.Context, client *http.Client, method string, url string, body []byte, opts CallOptions) (*Response[Resp], error) {
+	if opts.MaxResponseBytes == 0 {
+		opts.MaxResponseBytes = defaultMaxResponseBytes
+	}
+
+	var bodyReader io.Reader
+	if body != nil {
+		bodyReader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bodyReader)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range opts.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("accept", "application/json, "+ProblemContentType)
+	if body != nil {
+		req.Header.Set("content-type", "application/json")
+	}
+	if !opts.Token.IsZero() {
+		req.Header.Set("authorization", "Bearer "+opts.Token.Reveal())
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	ret := &Response[Resp]{StatusCode: resp.StatusCode, Header: resp.Header}
+	if resp.StatusCode == http.StatusNotModified && isConditional(req) {
+		ret.NotModified = true
+		return ret, nil
+	}
+	if !StatusCodeOK(resp.StatusCode) {
+		return nil, readResponseError(resp)
+	}
+
+	data, err := io.ReadAll(&limitedReader{r: resp.Body, n: opts.MaxResponseBytes})
+	if err != nil {
+		if err == errBodyTooLarge {
+			return nil, fmt.Errorf("response body larger than %d bytes", opts.MaxResponseBytes)
+		}
+		return nil, fmt.Errorf("reading body: %v", err)
+	}
+	if err := json.Unmarshal(data, &ret.Body); err != nil {
+		return nil, fmt.Errorf("decoding response JSON: %v", err)
+	}
+	return ret, nil
+}
+
+func isConditional(req *http.Request) bool {
+	return req.Header.Get("if-none-match") != "" || req.Header.Get("if-modified-since") != ""
+}
+
+func readResponseError(resp *http.Response) *ResponseError {
+	e := &ResponseError{StatusCode: resp.StatusCode, Header: resp.Header}
+	e.Body, _ = io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("content-type"))
+	switch {
+	case mediaType == ProblemContentType:
+		var p Problem
+		if err := json.Unmarshal(e.Body, &p); err == nil {
+			e.Problem = &p
+			e.Message = p.Detail
+			if e.Message == "" {
+				e.Message = p.Title
+			}
+		}
+	case isJSONContentType(resp.Header.Get("content-type")):
+		var he httpError
+		if err := json.Unmarshal(e.Body, &he); err == nil && he.Status == "error" {
+			if s, ok := he.Error.(string); ok {
+				e.Message = s
+			} else if d, err := json.Marshal(he.Error); err == nil {
+				e.Message = string(d)
+			}
+		}
+	case strings.HasPrefix(mediaType, "text/"):
+		e.Message = strings.TrimSpace(string(e.Body))
+	}
+	return e
+}
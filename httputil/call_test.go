@@ -0,0 +1,150 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/OpsMx/go-app-base/util"
+	"github.com/stretchr/testify/require"
+)
+
+type testCredentialRequest struct {
+	Name string `json:"name"`
+}
+
+type testCredentialResponse struct {
+	URL   string `json:"url"`
+	Token string `json:"token"`
+}
+
+func callTestServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/credentials", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("authorization") != "Bearer abc" {
+			SetError(w, http.StatusUnauthorized, "bad token")
+			return
+		}
+		var req testCredentialRequest
+		if !ReadJSON(w, r, &req, DecodeOptions{Strict: true}) {
+			return
+		}
+		WriteJSON(w, r, http.StatusOK, testCredentialResponse{URL: "https://" + req.Name, Token: "t-" + req.Name})
+	})
+	mux.HandleFunc("/cached", func(w http.ResponseWriter, r *http.Request) {
+		WriteJSONWithETag(w, r, testCredentialResponse{URL: "https://cached"})
+	})
+	mux.HandleFunc("/problem", func(w http.ResponseWriter, r *http.Request) {
+		WriteProblem(w, r, Problem{Status: http.StatusConflict, Type: "https://opsmx.com/problems/busy", Detail: "agent is busy", Extensions: map[string]interface{}{"retryIn": 5}})
+	})
+	mux.HandleFunc("/structured", func(w http.ResponseWriter, r *http.Request) {
+		SetError(w, http.StatusBadRequest, map[string]string{"field": "name"})
+	})
+	mux.HandleFunc("/text", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "upstream exploded", http.StatusBadGateway)
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		WriteJSON(w, r, http.StatusOK, testCredentialResponse{URL: strings.Repeat("x", 1000)})
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCallJSON(t *testing.T) {
+	server := callTestServer(t)
+	client := NewClient()
+	ctx := context.Background()
+
+	resp, err := CallJSON[testCredentialRequest, testCredentialResponse](ctx, client, http.MethodPost, server.URL+"/credentials",
+		testCredentialRequest{Name: "argo"}, CallOptions{Token: util.NewSecret("abc")})
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, testCredentialResponse{URL: "https://argo", Token: "t-argo"}, resp.Body)
+
+	_, err = CallJSON[testCredentialRequest, testCredentialResponse](ctx, client, http.MethodPost, server.URL+"/credentials",
+		testCredentialRequest{}, CallOptions{Token: util.NewSecret("wrong")})
+	var respErr *ResponseError
+	require.ErrorAs(t, err, &respErr)
+	require.Equal(t, http.StatusUnauthorized, respErr.StatusCode)
+	require.Equal(t, "bad token", respErr.Message)
+	require.EqualError(t, err, "http status 401: bad token")
+}
+
+func TestGetJSON(t *testing.T) {
+	server := callTestServer(t)
+	client := NewClient()
+	ctx := context.Background()
+
+	t.Run("conditional", func(t *testing.T) {
+		resp, err := GetJSON[testCredentialResponse](ctx, client, server.URL+"/cached", CallOptions{})
+		require.NoError(t, err)
+		require.False(t, resp.NotModified)
+		require.Equal(t, "https://cached", resp.Body.URL)
+		etag := resp.Header.Get("etag")
+
+		resp, err = GetJSON[testCredentialResponse](ctx, client, server.URL+"/cached", CallOptions{Header: http.Header{"If-None-Match": {etag}}})
+		require.NoError(t, err)
+		require.True(t, resp.NotModified)
+		require.Equal(t, http.StatusNotModified, resp.StatusCode)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			path       string
+			wantStatus int
+			wantMsg    string
+		}{
+			{"/problem", http.StatusConflict, "agent is busy"},
+			{"/structured", http.StatusBadRequest, `{"field":"name"}`},
+			{"/text", http.StatusBadGateway, "upstream exploded"},
+			{"/missing", http.StatusNotFound, "404 page not found"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.path, func(t *testing.T) {
+				_, err := GetJSON[testCredentialResponse](ctx, client, server.URL+tt.path, CallOptions{})
+				var respErr *ResponseError
+				require.ErrorAs(t, err, &respErr)
+				require.Equal(t, tt.wantStatus, respErr.StatusCode)
+				require.Equal(t, tt.wantMsg, respErr.Message)
+			})
+		}
+
+		_, err := GetJSON[testCredentialResponse](ctx, client, server.URL+"/problem", CallOptions{})
+		var respErr *ResponseError
+		require.ErrorAs(t, err, &respErr)
+		require.Equal(t, "https://opsmx.com/problems/busy", respErr.Problem.Type)
+		require.Equal(t, float64(5), respErr.Problem.Extensions["retryIn"])
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		_, err := GetJSON[testCredentialResponse](ctx, client, server.URL+"/large", CallOptions{MaxResponseBytes: 100})
+		require.ErrorContains(t, err, "larger than 100 bytes")
+	})
+}
+
+func TestProblem_roundTrip(t *testing.T) {
+	p := Problem{Type: "about:blank", Title: "Conflict", Status: 409, Detail: "busy", TraceID: "abc", Extensions: map[string]interface{}{"retryIn": float64(5)}}
+	d, err := p.MarshalJSON()
+	require.NoError(t, err)
+	var got Problem
+	require.NoError(t, got.UnmarshalJSON(d))
+	require.Equal(t, p, got)
+	require.Error(t, got.UnmarshalJSON([]byte(`{"status":"teapot"}`)))
+}
@@ -0,0 +1,334 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// CertReloaderConfig names the files a CertReloader watches.  CertFile
+// and KeyFile must be given together.  CAFile, if set, is a PEM bundle
+// of roots used to verify peers.
+// All times are in seconds.  If 0, a default will be used.
+type CertReloaderConfig struct {
+	CertFile            string `json:"certFile,omitempty" yaml:"certFile,omitempty"`
+	KeyFile             string `json:"keyFile,omitempty" yaml:"keyFile,omitempty"`
+	CAFile              string `json:"caFile,omitempty" yaml:"caFile,omitempty"`
+	PollIntervalSeconds int    `json:"pollIntervalSeconds,omitempty" yaml:"pollIntervalSeconds,omitempty"`
+}
+
+var defaultCertReloaderConfig = CertReloaderConfig{
+	PollIntervalSeconds: 60,
+}
+
+func (c *CertReloaderConfig) applyDefaults() {
+	if c.PollIntervalSeconds == 0 {
+		c.PollIntervalSeconds = defaultCertReloaderConfig.PollIntervalSeconds
+	}
+}
+
+// CertReloader keeps a certificate and CA bundle loaded from disk, and
+// reloads them when the files change, so rotated certificates are used
+// without restarting.  New files are only used once they are valid: the
+// key must match the certificate, the certificate must not have expired,
+// and the CA bundle must contain at least one certificate.  Until then,
+// the previous material continues to be served.
+//
+// Use ClientTLSConfig() or ServerTLSConfig() to build a tls.Config which
+// uses it, or set the hooks on a tls.Config directly.
+type CertReloader struct {
+	conf CertReloaderConfig
+	now  func() time.Time
+
+	lock    sync.RWMutex
+	cert    *tls.Certificate
+	roots   *x509.CertPool
+	certSum [sha256.Size]byte
+	caSum   [sha256.Size]byte
+}
+
+// NewCertReloader loads the files named in conf, returning an error
+// if they are missing or invalid.
+func NewCertReloader(conf CertReloaderConfig) (*CertReloader, error) {
+	conf.applyDefaults()
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return nil, fmt.Errorf("certFile and keyFile must be set together")
+	}
+	if conf.CertFile == "" && conf.CAFile == "" {
+		return nil, fmt.Errorf("no certificate or CA files to watch")
+	}
+	r := &CertReloader{conf: conf, now: time.Now}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Run checks for changed files every PollIntervalSeconds until ctx is done.
+// Errors are logged, and the current material continues to be used.
+func (r *CertReloader) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(r.conf.PollIntervalSeconds) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			changed, err := r.Reload()
+			if err != nil {
+				log.Printf("reloading certificates: %v", err)
+				continue
+			}
+			if changed {
+				log.Printf("reloaded certificates")
+			}
+		}
+	}
+}
+
+// Reload reads the files, and if they have changed and are valid, starts
+// using them.  It returns true if anything changed.
+func (r *CertReloader) Reload() (bool, error) {
+	var certPEM, keyPEM, caPEM []byte
+	var err error
+	if r.conf.CertFile != "" {
+		if certPEM, err = os.ReadFile(r.conf.CertFile); err != nil {
+			return false, fmt.Errorf("reading certificate: %v", err)
+		}
+		if keyPEM, err = os.ReadFile(r.conf.KeyFile); err != nil {
+			return false, fmt.Errorf("reading key: %v", err)
+		}
+	}
+	if r.conf.CAFile != "" {
+		if caPEM, err = os.ReadFile(r.conf.CAFile); err != nil {
+			return false, fmt.Errorf("reading CA bundle: %v", err)
+		}
+	}
+	// The key is included so a rotation is noticed even if only the
+	// second of the two files has been written when the first is read.
+	certSum := sha256.Sum256(append(append([]byte{}, certPEM...), keyPEM...))
+	caSum := sha256.Sum256(caPEM)
+
+	r.lock.RLock()
+	certChanged := certPEM != nil && (r.cert == nil || certSum != r.certSum)
+	caChanged := caPEM != nil && (r.roots == nil || caSum != r.caSum)
+	r.lock.RUnlock()
+	if !certChanged && !caChanged {
+		return false, nil
+	}
+
+	var cert *tls.Certificate
+	if certChanged {
+		if cert, err = r.parseCertificate(certPEM, keyPEM); err != nil {
+			return false, err
+		}
+	}
+	var roots *x509.CertPool
+	if caChanged {
+		if roots, err = parseCABundle(caPEM); err != nil {
+			return false, err
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if cert != nil {
+		r.cert = cert
+		r.certSum = certSum
+	}
+	if roots != nil {
+		r.roots = roots
+		r.caSum = caSum
+	}
+	return true, nil
+}
+
+func (r *CertReloader) parseCertificate(certPEM []byte, keyPEM []byte) (*tls.Certificate, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("loading certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parsing certificate: %v", err)
+	}
+	if r.now().After(leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate %q expired at %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+	}
+	cert.Leaf = leaf
+	return &cert, nil
+}
+
+func parseCABundle(caPEM []byte) (*x509.CertPool, error) {
+	certs, err := parsePEMCertificates(caPEM)
+	if err != nil {
+		return nil, fmt.Errorf("loading CA bundle: %v", err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("loading CA bundle: no certificates found")
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool, nil
+}
+
+// Certificate returns the current certificate, or nil if none is configured.
+func (r *CertReloader) Certificate() *tls.Certificate {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.cert
+}
+
+// RootCAs returns the current CA bundle, or nil if none is configured.
+func (r *CertReloader) RootCAs() *x509.CertPool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.roots
+}
+
+// GetCertificate implements tls.Config.GetCertificate for servers.
+func (r *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if cert := r.Certificate(); cert != nil {
+		return cert, nil
+	}
+	return nil, fmt.Errorf("no server certificate configured")
+}
+
+// GetClientCertificate implements tls.Config.GetClientCertificate.
+// If no certificate is configured, none is sent.
+func (r *CertReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if cert := r.Certificate(); cert != nil {
+		return cert, nil
+	}
+	return &tls.Certificate{}, nil
+}
+
+// VerifyConnection implements tls.Config.VerifyConnection for clients,
+// verifying the server's certificate and name against the current CA
+// bundle.  Since the CA bundle replaces normal verification, the
+// tls.Config must also set InsecureSkipVerify, as ClientTLSConfig() does.
+//
+// The name checked is the one sent to the server, which is the dialed
+// host name.  No name is sent when dialing an IP address, so the
+// connection fails; use ClientTLSConfig() with a base ServerName instead.
+func (r *CertReloader) VerifyConnection(cs tls.ConnectionState) error {
+	return r.verifyServer(cs, "")
+}
+
+// verifyServer checks the server's certificate is valid for serverName,
+// which may be a DNS name or an IP address, or if that is empty, for the
+// name sent to the server.  If there is neither, it fails, rather than
+// accepting any certificate issued by the CA.
+func (r *CertReloader) verifyServer(cs tls.ConnectionState, serverName string) error {
+	if serverName == "" {
+		serverName = cs.ServerName
+	}
+	if serverName == "" {
+		return fmt.Errorf("no server name to verify the certificate against; set tls.Config.ServerName when connecting by IP address")
+	}
+	return r.verifyPeer(cs, serverName, x509.ExtKeyUsageServerAuth)
+}
+
+// verifyClientConnection is the server side equivalent of VerifyConnection.
+// Whether a certificate is required is left to tls.Config.ClientAuth.
+func (r *CertReloader) verifyClientConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return nil
+	}
+	return r.verifyPeer(cs, "", x509.ExtKeyUsageClientAuth)
+}
+
+func (r *CertReloader) verifyPeer(cs tls.ConnectionState, dnsName string, usage x509.ExtKeyUsage) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("peer presented no certificate")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range cs.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+		Roots:         r.RootCAs(),
+		Intermediates: intermediates,
+		DNSName:       dnsName,
+		CurrentTime:   r.now(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	})
+	return err
+}
+
+// ClientTLSConfig returns a copy of base, which may be nil, that presents
+// the current certificate and, if a CA file is configured, verifies
+// servers using the current CA bundle instead of base.RootCAs.  Servers
+// are verified against base.ServerName if set, which may be an IP
+// address, otherwise against the dialed host name.
+func (r *CertReloader) ClientTLSConfig(base *tls.Config) *tls.Config {
+	c := cloneTLSConfig(base)
+	if r.conf.CertFile != "" {
+		c.Certificates = nil
+		c.GetClientCertificate = r.GetClientCertificate
+	}
+	if r.conf.CAFile != "" {
+		serverName := c.ServerName
+		c.InsecureSkipVerify = true
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			return r.verifyServer(cs, serverName)
+		}
+	}
+	return c
+}
+
+// ServerTLSConfig returns a copy of base, which may be nil, that serves
+// the current certificate and, if a CA file is configured, verifies
+// client certificates using the current CA bundle instead of
+// base.ClientCAs.  base.ClientAuth still decides whether clients must
+// present a certificate.
+func (r *CertReloader) ServerTLSConfig(base *tls.Config) *tls.Config {
+	c := cloneTLSConfig(base)
+	if r.conf.CertFile != "" {
+		c.Certificates = nil
+		c.GetCertificate = r.GetCertificate
+	}
+	if r.conf.CAFile != "" {
+		// Verification is moved into VerifyConnection so it uses the
+		// current bundle, so only ask the TLS stack to request the
+		// certificate.
+		switch c.ClientAuth {
+		case tls.VerifyClientCertIfGiven:
+			c.ClientAuth = tls.RequestClientCert
+		case tls.RequireAndVerifyClientCert:
+			c.ClientAuth = tls.RequireAnyClientCert
+		}
+		c.ClientCAs = nil
+		c.VerifyConnection = r.verifyClientConnection
+	}
+	return c
+}
+
+func cloneTLSConfig(base *tls.Config) *tls.Config {
+	if base == nil {
+		return &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return base.Clone()
+}
@@ -0,0 +1,293 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testPKI struct {
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+}
+
+func newTestPKI(t *testing.T, name string) *testPKI {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testPKI{ca: ca, caKey: key}
+}
+
+// issue returns PEM encoded certificate and key for localhost, usable
+// by both clients and servers.
+func (p *testPKI) issue(t *testing.T, serial int64, notAfter time.Time) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, &key.PublicKey, p.caKey)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func (p *testPKI) caPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: p.ca.Raw})
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, data, 0600))
+}
+
+func TestNewCertReloader_invalidConfig(t *testing.T) {
+	_, err := NewCertReloader(CertReloaderConfig{})
+	require.Error(t, err)
+	_, err = NewCertReloader(CertReloaderConfig{CertFile: "cert.pem"})
+	require.Error(t, err)
+	_, err = NewCertReloader(CertReloaderConfig{CAFile: filepath.Join(t.TempDir(), "missing.pem")})
+	require.Error(t, err)
+}
+
+func TestCertReloader_Reload(t *testing.T) {
+	dir := t.TempDir()
+	conf := CertReloaderConfig{
+		CertFile: filepath.Join(dir, "tls.crt"),
+		KeyFile:  filepath.Join(dir, "tls.key"),
+		CAFile:   filepath.Join(dir, "ca.crt"),
+	}
+	pki := newTestPKI(t, "ca")
+	certPEM, keyPEM := pki.issue(t, 10, time.Now().Add(time.Hour))
+	writeTestFile(t, conf.CertFile, certPEM)
+	writeTestFile(t, conf.KeyFile, keyPEM)
+	writeTestFile(t, conf.CAFile, pki.caPEM())
+
+	r, err := NewCertReloader(conf)
+	require.NoError(t, err)
+	require.Equal(t, int64(10), r.Certificate().Leaf.SerialNumber.Int64())
+
+	changed, err := r.Reload()
+	require.NoError(t, err)
+	require.False(t, changed)
+
+	t.Run("mismatched key is not used", func(t *testing.T) {
+		newCertPEM, _ := pki.issue(t, 11, time.Now().Add(time.Hour))
+		writeTestFile(t, conf.CertFile, newCertPEM)
+		_, err := r.Reload()
+		require.Error(t, err)
+		require.Equal(t, int64(10), r.Certificate().Leaf.SerialNumber.Int64())
+	})
+
+	t.Run("expired certificate is not used", func(t *testing.T) {
+		newCertPEM, newKeyPEM := pki.issue(t, 12, time.Now().Add(-time.Hour))
+		writeTestFile(t, conf.CertFile, newCertPEM)
+		writeTestFile(t, conf.KeyFile, newKeyPEM)
+		_, err := r.Reload()
+		require.ErrorContains(t, err, "expired")
+		require.Equal(t, int64(10), r.Certificate().Leaf.SerialNumber.Int64())
+	})
+
+	t.Run("empty CA bundle is not used", func(t *testing.T) {
+		writeTestFile(t, conf.CertFile, certPEM)
+		writeTestFile(t, conf.KeyFile, keyPEM)
+		writeTestFile(t, conf.CAFile, []byte("\n"))
+		_, err := r.Reload()
+		require.Error(t, err)
+		require.NotNil(t, r.RootCAs())
+	})
+
+	t.Run("valid rotation", func(t *testing.T) {
+		newCertPEM, newKeyPEM := pki.issue(t, 13, time.Now().Add(time.Hour))
+		writeTestFile(t, conf.CertFile, newCertPEM)
+		writeTestFile(t, conf.KeyFile, newKeyPEM)
+		writeTestFile(t, conf.CAFile, pki.caPEM())
+		changed, err := r.Reload()
+		require.NoError(t, err)
+		require.True(t, changed)
+		require.Equal(t, int64(13), r.Certificate().Leaf.SerialNumber.Int64())
+	})
+}
+
+func TestCertReloader_mutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	conf := CertReloaderConfig{
+		CertFile: filepath.Join(dir, "tls.crt"),
+		KeyFile:  filepath.Join(dir, "tls.key"),
+		CAFile:   filepath.Join(dir, "ca.crt"),
+	}
+	install := func(pki *testPKI, serial int64) {
+		certPEM, keyPEM := pki.issue(t, serial, time.Now().Add(time.Hour))
+		writeTestFile(t, conf.CertFile, certPEM)
+		writeTestFile(t, conf.KeyFile, keyPEM)
+		writeTestFile(t, conf.CAFile, pki.caPEM())
+	}
+	install(newTestPKI(t, "first"), 1)
+
+	r, err := NewCertReloader(conf)
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	serverConfig := r.ServerTLSConfig(&tls.Config{ClientAuth: tls.RequireAndVerifyClientCert})
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			_, _ = w.Write([]byte(req.TLS.PeerCertificates[0].SerialNumber.String()))
+		}),
+		ReadHeaderTimeout: time.Second,
+		ErrorLog:          log.New(io.Discard, "", 0),
+	}
+	go func() { _ = server.Serve(tls.NewListener(listener, serverConfig)) }()
+	defer server.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+	url := "https://localhost:" + port
+
+	// Each request uses a new client, so a new connection is made.
+	get := func(tlsConfig *tls.Config) (int64, error) {
+		resp, err := NewClient(WithTLSConfig(tlsConfig)).Get(url)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].SerialNumber.Int64(), nil
+	}
+
+	clientConfig := r.ClientTLSConfig(nil)
+	serial, err := get(clientConfig)
+	require.NoError(t, err)
+	require.Equal(t, int64(1), serial)
+
+	// A client without a certificate is rejected.
+	oldRoots := r.RootCAs()
+	_, err = get(&tls.Config{RootCAs: oldRoots, MinVersion: tls.VersionTLS12})
+	require.Error(t, err)
+
+	// Rotate to an entirely new CA; both sides pick it up.
+	install(newTestPKI(t, "second"), 2)
+	changed, err := r.Reload()
+	require.NoError(t, err)
+	require.True(t, changed)
+	serial, err = get(clientConfig)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), serial)
+
+	// A client still trusting only the old CA rejects the server.
+	stale := r.ClientTLSConfig(nil)
+	stale.InsecureSkipVerify = false
+	stale.VerifyConnection = nil
+	stale.RootCAs = oldRoots
+	_, err = get(stale)
+	require.Error(t, err)
+}
+
+func TestCertReloader_ClientTLSConfig_serverName(t *testing.T) {
+	dir := t.TempDir()
+	conf := CertReloaderConfig{
+		CertFile: filepath.Join(dir, "tls.crt"),
+		KeyFile:  filepath.Join(dir, "tls.key"),
+		CAFile:   filepath.Join(dir, "ca.crt"),
+	}
+	pki := newTestPKI(t, "names")
+	certPEM, keyPEM := pki.issue(t, 1, time.Now().Add(time.Hour))
+	writeTestFile(t, conf.CertFile, certPEM)
+	writeTestFile(t, conf.KeyFile, keyPEM)
+	writeTestFile(t, conf.CAFile, pki.caPEM())
+	r, err := NewCertReloader(conf)
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{
+		Handler:           http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
+		ReadHeaderTimeout: time.Second,
+		ErrorLog:          log.New(io.Discard, "", 0),
+	}
+	go func() { _ = server.Serve(tls.NewListener(listener, r.ServerTLSConfig(nil))) }()
+	defer server.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+
+	// The certificate is for localhost and 127.0.0.1.
+	tests := []struct {
+		name       string
+		host       string
+		serverName string
+		wantErr    string
+	}{
+		{"dialed host name", "localhost", "", ""},
+		{"dialed IP without a server name", "127.0.0.1", "", "no server name"},
+		{"configured IP matches IP SAN", "127.0.0.1", "127.0.0.1", ""},
+		{"configured DNS name", "127.0.0.1", "localhost", ""},
+		{"configured name not in certificate", "127.0.0.1", "other.example.com", "certificate is valid for"},
+		{"configured IP not in certificate", "localhost", "10.1.2.3", "certificate is valid for"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := &tls.Config{ServerName: tt.serverName, MinVersion: tls.VersionTLS12}
+			resp, err := NewClient(WithTLSConfig(r.ClientTLSConfig(base))).Get("https://" + net.JoinHostPort(tt.host, port))
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			resp.Body.Close()
+		})
+	}
+
+	// VerifyConnection alone uses the name sent to the server.
+	err = r.VerifyConnection(tls.ConnectionState{})
+	require.ErrorContains(t, err, "no server name")
+}
@@ -17,4 +17,5 @@ package httputil
 // `httputil` holds a set of commonly used http functions, like making a
 // httpClient that is configured with more sane default timeouts,
 // optionally with a global or per-connection TLS configuration,
+// a matching server with graceful shutdown, Bearer token authentication,
 // and error checking and reporting.
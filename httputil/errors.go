@@ -16,9 +16,14 @@ package httputil
 
 import (
 	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
 
-	"log"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // StatusCodeOK returns true if the error code provided is between
@@ -30,9 +35,10 @@ func StatusCodeOK(statusCode int) bool {
 // httpError defines a simple struct to return JSON formatted error
 // messages.
 type httpError struct {
-	Status string      `json:"status,omitempty" yaml:"status,omitempty"`
-	Code   int         `json:"code,omitempty" yaml:"code,omitempty"`
-	Error  interface{} `json:"error,omitempty" yaml:"error,omitempty"`
+	Status  string      `json:"status,omitempty" yaml:"status,omitempty"`
+	Code    int         `json:"code,omitempty" yaml:"code,omitempty"`
+	Error   interface{} `json:"error,omitempty" yaml:"error,omitempty"`
+	TraceID string      `json:"traceId,omitempty" yaml:"traceId,omitempty"`
 }
 
 // SetError returns a JSON error message with a Status field set to 'error',
@@ -44,9 +50,12 @@ type httpError struct {
 //
 // The content-type will be set to application/json.
 func SetError(w http.ResponseWriter, statusCode int, message interface{}) {
-	w.Header().Set("content-type", "application/json")
+	writeErrorJSON(w, "application/json", statusCode, httpError{Status: "error", Code: statusCode, Error: message})
+}
+
+func writeErrorJSON(w http.ResponseWriter, contentType string, statusCode int, m interface{}) {
+	w.Header().Set("content-type", contentType)
 	w.WriteHeader(statusCode)
-	m := httpError{Status: "error", Code: statusCode, Error: message}
 	d, err := json.Marshal(m)
 	if err != nil {
 		log.Printf("marshalling error json: %v", err)
@@ -60,3 +69,149 @@ func SetError(w http.ResponseWriter, statusCode int, message interface{}) {
 		log.Printf("writing error json: %v", err)
 	}
 }
+
+// ProblemContentType is the media type of RFC 7807 problem details.
+const ProblemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details object.  Type identifies the
+// kind of error, and defaults to "about:blank", in which case Title
+// should be the HTTP status text.  Extensions are added as additional
+// members, and cannot replace the standard ones.
+type Problem struct {
+	Type       string
+	Title      string
+	Status     int
+	Detail     string
+	Instance   string
+	TraceID    string
+	Extensions map[string]interface{}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (p Problem) MarshalJSON() ([]byte, error) {
+	m := make(map[string]interface{}, len(p.Extensions)+6)
+	for k, v := range p.Extensions {
+		m[k] = v
+	}
+	set := func(key string, value interface{}, present bool) {
+		if present {
+			m[key] = value
+		} else {
+			delete(m, key)
+		}
+	}
+	set("type", p.Type, p.Type != "")
+	set("title", p.Title, p.Title != "")
+	set("status", p.Status, p.Status != 0)
+	set("detail", p.Detail, p.Detail != "")
+	set("instance", p.Instance, p.Instance != "")
+	set("traceId", p.TraceID, p.TraceID != "")
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.  Members other than the
+// standard ones are placed in Extensions.
+func (p *Problem) UnmarshalJSON(data []byte) error {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	*p = Problem{}
+	fields := map[string]interface{}{
+		"type":     &p.Type,
+		"title":    &p.Title,
+		"status":   &p.Status,
+		"detail":   &p.Detail,
+		"instance": &p.Instance,
+		"traceId":  &p.TraceID,
+	}
+	for k, v := range m {
+		if field, found := fields[k]; found {
+			if err := json.Unmarshal(v, field); err != nil {
+				return fmt.Errorf("problem member %q: %v", k, err)
+			}
+			continue
+		}
+		var ext interface{}
+		if err := json.Unmarshal(v, &ext); err != nil {
+			return err
+		}
+		if p.Extensions == nil {
+			p.Extensions = map[string]interface{}{}
+		}
+		p.Extensions[k] = ext
+	}
+	return nil
+}
+
+// WriteProblem sends p, filling in any missing Type, Title, and trace ID.
+// If the request's Accept header asks for application/problem+json, it
+// is sent as-is; otherwise it is sent in the format used by SetError(),
+// with Detail, or Title if there is none, as the error.
+//
+// As with SetError(), nothing should be written before or after.
+func WriteProblem(w http.ResponseWriter, r *http.Request, p Problem) {
+	if p.Status == 0 {
+		p.Status = http.StatusInternalServerError
+	}
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	if p.TraceID == "" {
+		if sc := trace.SpanContextFromContext(r.Context()); sc.HasTraceID() {
+			p.TraceID = sc.TraceID().String()
+		}
+	}
+
+	if acceptsProblem(r) {
+		writeErrorJSON(w, ProblemContentType, p.Status, p)
+		return
+	}
+	var message interface{} = p.Detail
+	if p.Detail == "" {
+		message = p.Title
+	}
+	if extra, found := p.Extensions["error"]; found {
+		message = extra
+	}
+	writeErrorJSON(w, "application/json", p.Status, httpError{Status: "error", Code: p.Status, Error: message, TraceID: p.TraceID})
+}
+
+// SetRequestError is SetError(), but it uses the request to choose
+// between the SetError() format and RFC 7807 problem details, and to
+// include the trace ID.  String and error messages become the problem's
+// detail; anything else is sent as its `error` member.
+func SetRequestError(w http.ResponseWriter, r *http.Request, statusCode int, message interface{}) {
+	p := Problem{Status: statusCode}
+	switch m := message.(type) {
+	case string:
+		p.Detail = m
+	case error:
+		p.Detail = m.Error()
+	case nil:
+	default:
+		p.Extensions = map[string]interface{}{"error": m}
+	}
+	WriteProblem(w, r, p)
+}
+
+// acceptsProblem returns true if the Accept header includes
+// application/problem+json with a non-zero quality.
+func acceptsProblem(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediaType != ProblemContentType {
+			continue
+		}
+		if q, found := params["q"]; found {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
@@ -0,0 +1,104 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestSetError(t *testing.T) {
+	w := httptest.NewRecorder()
+	SetError(w, http.StatusNotFound, "no such thing")
+	require.Equal(t, http.StatusNotFound, w.Code)
+	require.Equal(t, "application/json", w.Header().Get("content-type"))
+	require.JSONEq(t, `{"status":"error","code":404,"error":"no such thing"}`, w.Body.String())
+}
+
+func TestWriteProblem(t *testing.T) {
+	provider := sdktrace.NewTracerProvider()
+	ctx, span := provider.Tracer("test").Start(context.Background(), "request")
+	defer span.End()
+	traceID := span.SpanContext().TraceID().String()
+
+	problem := Problem{
+		Type:       "https://opsmx.com/problems/out-of-credit",
+		Status:     http.StatusForbidden,
+		Detail:     "balance is 30, cost is 50",
+		Instance:   "/account/12345/msgs/abc",
+		Extensions: map[string]interface{}{"balance": 30, "status": "ignored"},
+	}
+
+	t.Run("problem+json", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		req.Header.Set("Accept", "application/json, application/problem+json;q=0.9")
+		w := httptest.NewRecorder()
+		WriteProblem(w, req, problem)
+		require.Equal(t, http.StatusForbidden, w.Code)
+		require.Equal(t, ProblemContentType, w.Header().Get("content-type"))
+		require.JSONEq(t, `{
+			"type": "https://opsmx.com/problems/out-of-credit",
+			"title": "Forbidden",
+			"status": 403,
+			"detail": "balance is 30, cost is 50",
+			"instance": "/account/12345/msgs/abc",
+			"traceId": "`+traceID+`",
+			"balance": 30
+		}`, w.Body.String())
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+		req.Header.Set("Accept", "application/json")
+		w := httptest.NewRecorder()
+		WriteProblem(w, req, problem)
+		require.Equal(t, "application/json", w.Header().Get("content-type"))
+		require.JSONEq(t, `{"status":"error","code":403,"error":"balance is 30, cost is 50","traceId":"`+traceID+`"}`, w.Body.String())
+	})
+}
+
+func TestSetRequestError(t *testing.T) {
+	tests := []struct {
+		name    string
+		accept  string
+		message interface{}
+		want    string
+	}{
+		{"string legacy", "", "bad input", `{"status":"error","code":400,"error":"bad input"}`},
+		{"map legacy", "", map[string]string{"field": "name"}, `{"status":"error","code":400,"error":{"field":"name"}}`},
+		{"nil legacy", "", nil, `{"status":"error","code":400,"error":"Bad Request"}`},
+		{"string problem", ProblemContentType, "bad input", `{"type":"about:blank","title":"Bad Request","status":400,"detail":"bad input"}`},
+		{"error problem", ProblemContentType, http.ErrBodyNotAllowed, `{"type":"about:blank","title":"Bad Request","status":400,"detail":"http: request method or response status code does not allow body"}`},
+		{"map problem", ProblemContentType, map[string]string{"field": "name"}, `{"type":"about:blank","title":"Bad Request","status":400,"error":{"field":"name"}}`},
+		{"problem refused", ProblemContentType + ";q=0", "bad input", `{"status":"error","code":400,"error":"bad input"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			SetRequestError(w, req, http.StatusBadRequest, tt.message)
+			require.Equal(t, http.StatusBadRequest, w.Code)
+			require.JSONEq(t, tt.want, w.Body.String())
+		})
+	}
+}
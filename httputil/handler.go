@@ -0,0 +1,161 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/felixge/httpsnoop"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// HTTPError is an error which should be sent to the client with Status.
+// Message is shown to the client, while Err is the internal cause, which
+// is logged and recorded on the span but not sent.
+type HTTPError struct {
+	Status  int
+	Message string
+	Err     error
+}
+
+// NewHTTPError returns an HTTPError.  cause may be nil.
+func NewHTTPError(status int, message string, cause error) *HTTPError {
+	return &HTTPError{Status: status, Message: message, Err: cause}
+}
+
+func (e *HTTPError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%d %s: %v", e.Status, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%d %s", e.Status, e.Message)
+}
+
+// Unwrap returns the internal cause.
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// ValidationError reports that a request was understood, but its content
+// is not acceptable.  It is sent as a 400 error, with Fields, which maps
+// field names to what is wrong with them, as the `fields` member.
+type ValidationError struct {
+	Message string
+	Fields  map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Fields) == 0 {
+		return e.Message
+	}
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, k+": "+e.Fields[k])
+	}
+	return e.Message + " (" + strings.Join(parts, ", ") + ")"
+}
+
+// HandlerFunc is an http.Handler which returns an error rather than
+// writing one itself.  If it returns an error before writing anything,
+// the error is sent using WriteProblem():
+//
+//   - an *HTTPError is sent with its Status and Message;
+//   - a *ValidationError is sent as 400 with its fields;
+//   - if the client went away, nothing is sent;
+//   - if a deadline passed, 503 is sent; and
+//   - any other error is sent as a 500 with a generic message.
+//
+// Errors are recorded on the active span, and server errors are logged.
+// If the handler had already started its response, the error is only
+// logged and recorded.
+type HandlerFunc func(w http.ResponseWriter, r *http.Request) error
+
+// ServeHTTP implements http.Handler.
+func (f HandlerFunc) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wroteHeader := false
+	ww := httpsnoop.Wrap(w, httpsnoop.Hooks{
+		WriteHeader: func(next httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+			return func(code int) {
+				wroteHeader = true
+				next(code)
+			}
+		},
+		Write: func(next httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+			return func(b []byte) (int, error) {
+				wroteHeader = true
+				return next(b)
+			}
+		},
+	})
+
+	err := f(ww, r)
+	if err == nil {
+		return
+	}
+
+	p, send := problemForError(r, err)
+	span := trace.SpanFromContext(r.Context())
+	span.RecordError(err, trace.WithAttributes(attribute.Int("http.response.status_code", p.Status)))
+	if p.Status >= 500 {
+		span.SetStatus(codes.Error, p.Title)
+		log.Printf("%s %s: %v %s", r.Method, r.URL.Path, err, logContext(r.Context()))
+	}
+
+	if wroteHeader {
+		log.Printf("%s %s: error after response started: %v %s", r.Method, r.URL.Path, err, logContext(r.Context()))
+		return
+	}
+	if send {
+		WriteProblem(w, r, p)
+	}
+}
+
+// problemForError returns the problem to send for err, and false if
+// nothing should be sent.
+func problemForError(r *http.Request, err error) (Problem, bool) {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return Problem{Status: httpErr.Status, Detail: httpErr.Message}, true
+	}
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		p := Problem{Status: http.StatusBadRequest, Detail: validationErr.Message}
+		if len(validationErr.Fields) > 0 {
+			p.Extensions = map[string]interface{}{"fields": validationErr.Fields}
+		}
+		return p, true
+	}
+	if errors.Is(err, context.Canceled) && r.Context().Err() != nil {
+		// 499 is the de-facto status for a client which closed the
+		// request, used only for the span.
+		return Problem{Status: 499}, false
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return Problem{Status: http.StatusServiceUnavailable, Detail: "request timed out"}, true
+	}
+	return Problem{Status: http.StatusInternalServerError, Detail: "internal server error"}, true
+}
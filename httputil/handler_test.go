@@ -0,0 +1,107 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestHTTPError(t *testing.T) {
+	cause := fmt.Errorf("row not found")
+	err := NewHTTPError(http.StatusNotFound, "no such pipeline", cause)
+	require.Equal(t, "404 no such pipeline: row not found", err.Error())
+	require.ErrorIs(t, err, cause)
+	require.Equal(t, "409 conflict", NewHTTPError(http.StatusConflict, "conflict", nil).Error())
+}
+
+func TestValidationError(t *testing.T) {
+	err := &ValidationError{Message: "invalid pipeline", Fields: map[string]string{"name": "required", "id": "too long"}}
+	require.Equal(t, "invalid pipeline (id: too long, name: required)", err.Error())
+}
+
+func TestHandlerFunc(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name       string
+		ctx        context.Context
+		err        error
+		write      bool
+		wantCode   int
+		wantBody   string
+		wantStatus codes.Code
+	}{
+		{"no error", context.Background(), nil, true, 200, "ok", codes.Unset},
+		{"http error", context.Background(), NewHTTPError(404, "no such pipeline", fmt.Errorf("secret detail")), false, 404,
+			`{"type":"about:blank","title":"Not Found","status":404,"detail":"no such pipeline"}`, codes.Unset},
+		{"wrapped http error", context.Background(), fmt.Errorf("loading: %w", NewHTTPError(409, "conflict", nil)), false, 409,
+			`{"type":"about:blank","title":"Conflict","status":409,"detail":"conflict"}`, codes.Unset},
+		{"validation error", context.Background(), &ValidationError{Message: "invalid", Fields: map[string]string{"name": "required"}}, false, 400,
+			`{"type":"about:blank","title":"Bad Request","status":400,"detail":"invalid","fields":{"name":"required"}}`, codes.Unset},
+		{"deadline", context.Background(), fmt.Errorf("querying: %w", context.DeadlineExceeded), false, 503,
+			`{"type":"about:blank","title":"Service Unavailable","status":503,"detail":"request timed out"}`, codes.Error},
+		{"client went away", cancelled, context.Canceled, false, 200, "", codes.Unset},
+		{"other error", context.Background(), fmt.Errorf("database password is hunter2"), false, 500,
+			`{"type":"about:blank","title":"Internal Server Error","status":500,"detail":"internal server error"}`, codes.Error},
+		{"error after writing", context.Background(), fmt.Errorf("stream broke"), true, 200, "ok", codes.Error},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLog(t)
+			recorder := tracetest.NewSpanRecorder()
+			provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+			ctx, span := provider.Tracer("test").Start(tt.ctx, "request")
+
+			h := HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				if tt.write {
+					_, _ = w.Write([]byte("ok"))
+				}
+				return tt.err
+			})
+			req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+			req.Header.Set("Accept", ProblemContentType)
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			span.End()
+
+			require.Equal(t, tt.wantCode, w.Code)
+			if tt.wantBody != "" && tt.wantBody[0] == '{' {
+				var got map[string]interface{}
+				require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+				require.Equal(t, span.SpanContext().TraceID().String(), got["traceId"])
+				delete(got, "traceId")
+				d, err := json.Marshal(got)
+				require.NoError(t, err)
+				require.JSONEq(t, tt.wantBody, string(d))
+			} else {
+				require.Equal(t, tt.wantBody, w.Body.String())
+			}
+			ended := recorder.Ended()[0]
+			require.Equal(t, tt.wantStatus, ended.Status().Code)
+			require.Equal(t, tt.err != nil, len(ended.Events()) == 1)
+		})
+	}
+}
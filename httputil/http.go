@@ -16,103 +16,289 @@ package httputil
 
 import (
 	"crypto/tls"
+	"log"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/metric/noop"
+	"golang.org/x/net/http2"
 )
 
-// ClientConfig defines various timeouts we will want to change.
-// All times are in seconds.  If 0, a default will be used.
+// ClientConfig defines various timeouts and connection pool limits we
+// will want to change.  All times are in seconds.  If 0, a default will
+// be used.  A negative IdleConnectionTimeout means idle connections are
+// kept until the server closes them, a negative KeepAlivePeriod disables
+// TCP keep-alives, and a negative HTTP2ReadIdleTimeout disables HTTP/2
+// health checks.
+//
+// HTTP/2 is used when the server supports it, unless DisableHTTP2 is set.
+// If the server does not respond to a ping within HTTP2PingTimeout after
+// a connection has been idle for HTTP2ReadIdleTimeout, the connection is
+// closed, so a dead connection is not reused.
 type ClientConfig struct {
-	DialTimeout           int `json:"dialTimeout,omitempty" yaml:"dialTimeout,omitempty"`
-	ClientTimeout         int `json:"clientTimeout,omitempty" yaml:"clientTimeout,omitempty"`
-	TLSHandshakeTimeout   int `json:"tlsHandshakeTimeout,omitempty" yaml:"tlsHandshakeTimeout,omitempty"`
-	ResponseHeaderTimeout int `json:"responseHeaderTimeout,omitempty" yaml:"responseHeaderTimeout,omitempty"`
-	MaxIdleConnections    int `json:"maxIdleConnections,omitempty" yaml:"maxIdleConnections,omitempty"`
+	DialTimeout               int  `json:"dialTimeout,omitempty" yaml:"dialTimeout,omitempty"`
+	ClientTimeout             int  `json:"clientTimeout,omitempty" yaml:"clientTimeout,omitempty"`
+	TLSHandshakeTimeout       int  `json:"tlsHandshakeTimeout,omitempty" yaml:"tlsHandshakeTimeout,omitempty"`
+	ResponseHeaderTimeout     int  `json:"responseHeaderTimeout,omitempty" yaml:"responseHeaderTimeout,omitempty"`
+	MaxIdleConnections        int  `json:"maxIdleConnections,omitempty" yaml:"maxIdleConnections,omitempty"`
+	MaxIdleConnectionsPerHost int  `json:"maxIdleConnectionsPerHost,omitempty" yaml:"maxIdleConnectionsPerHost,omitempty"`
+	MaxConnectionsPerHost     int  `json:"maxConnectionsPerHost,omitempty" yaml:"maxConnectionsPerHost,omitempty"`
+	IdleConnectionTimeout     int  `json:"idleConnectionTimeout,omitempty" yaml:"idleConnectionTimeout,omitempty"`
+	KeepAlivePeriod           int  `json:"keepAlivePeriod,omitempty" yaml:"keepAlivePeriod,omitempty"`
+	HTTP2ReadIdleTimeout      int  `json:"http2ReadIdleTimeout,omitempty" yaml:"http2ReadIdleTimeout,omitempty"`
+	HTTP2PingTimeout          int  `json:"http2PingTimeout,omitempty" yaml:"http2PingTimeout,omitempty"`
+	DisableHTTP2              bool `json:"disableHTTP2,omitempty" yaml:"disableHTTP2,omitempty"`
+}
+
+// builtinClientConfig is used for any values not set by SetClientConfig().
+// MaxConnectionsPerHost is 0, which is unlimited.
+var builtinClientConfig = ClientConfig{
+	DialTimeout:               15,
+	ClientTimeout:             60,
+	TLSHandshakeTimeout:       15,
+	ResponseHeaderTimeout:     60,
+	MaxIdleConnections:        100,
+	MaxIdleConnectionsPerHost: 10,
+	IdleConnectionTimeout:     90,
+	KeepAlivePeriod:           30,
+	HTTP2ReadIdleTimeout:      30,
+	HTTP2PingTimeout:          15,
 }
 
+// defaultsLock guards defaultTLSConfig and defaultClientConfig, which
+// may be changed while other goroutines are creating clients.
+var defaultsLock sync.RWMutex
+
 var defaultTLSConfig *tls.Config
 
-var defaultClientConfig = &ClientConfig{
-	DialTimeout:           15,
-	ClientTimeout:         60,
-	TLSHandshakeTimeout:   15,
-	ResponseHeaderTimeout: 60,
-	MaxIdleConnections:    5,
+var defaultClientConfig = func() *ClientConfig {
+	c := builtinClientConfig
+	return &c
+}()
+
+// currentDefaults returns a copy of the global client configuration
+// and the global TLS configuration.
+func currentDefaults() (ClientConfig, *tls.Config) {
+	defaultsLock.RLock()
+	defer defaultsLock.RUnlock()
+	if defaultClientConfig == nil {
+		return builtinClientConfig, defaultTLSConfig
+	}
+	return *defaultClientConfig, defaultTLSConfig
 }
 
+// applyDefaults fills in any unset values from the global configuration.
 func (c *ClientConfig) applyDefaults() {
+	defaults, _ := currentDefaults()
+	c.applyDefaultsFrom(defaults)
+}
+
+func (c *ClientConfig) applyDefaultsFrom(defaults ClientConfig) {
 	if c.DialTimeout == 0 {
-		c.DialTimeout = defaultClientConfig.DialTimeout
+		c.DialTimeout = defaults.DialTimeout
 	}
 	if c.ClientTimeout == 0 {
-		c.ClientTimeout = defaultClientConfig.ClientTimeout
+		c.ClientTimeout = defaults.ClientTimeout
 	}
 	if c.TLSHandshakeTimeout == 0 {
-		c.TLSHandshakeTimeout = defaultClientConfig.TLSHandshakeTimeout
+		c.TLSHandshakeTimeout = defaults.TLSHandshakeTimeout
 	}
 	if c.ResponseHeaderTimeout == 0 {
-		c.ResponseHeaderTimeout = defaultClientConfig.ResponseHeaderTimeout
+		c.ResponseHeaderTimeout = defaults.ResponseHeaderTimeout
 	}
 	if c.MaxIdleConnections == 0 {
-		c.MaxIdleConnections = defaultClientConfig.MaxIdleConnections
+		c.MaxIdleConnections = defaults.MaxIdleConnections
+	}
+	if c.MaxIdleConnectionsPerHost == 0 {
+		c.MaxIdleConnectionsPerHost = defaults.MaxIdleConnectionsPerHost
+	}
+	if c.MaxConnectionsPerHost == 0 {
+		c.MaxConnectionsPerHost = defaults.MaxConnectionsPerHost
+	}
+	if c.IdleConnectionTimeout == 0 {
+		c.IdleConnectionTimeout = defaults.IdleConnectionTimeout
+	}
+	if c.KeepAlivePeriod == 0 {
+		c.KeepAlivePeriod = defaults.KeepAlivePeriod
+	}
+	if c.HTTP2ReadIdleTimeout == 0 {
+		c.HTTP2ReadIdleTimeout = defaults.HTTP2ReadIdleTimeout
+	}
+	if c.HTTP2PingTimeout == 0 {
+		c.HTTP2PingTimeout = defaults.HTTP2PingTimeout
 	}
+	// A client cannot turn HTTP/2 back on if it is disabled globally.
+	c.DisableHTTP2 = c.DisableHTTP2 || defaults.DisableHTTP2
 }
 
-// SetClientConfig will replace the current clientConfig for all future clients
-// returned by NewHTTPClient().  Generally, this will be set once, and probably
-// not changed per connection.  It is not going to be thread-safe, in that
-// setting the config and then calling NewHTTPClient() could be a race.
-func SetClientConfig(c ClientConfig) {
-	if defaultClientConfig == nil {
-		defaultClientConfig = &ClientConfig{}
+// seconds converts a config value to a duration, where negative values
+// mean 0, which disables the setting.
+func seconds(n int) time.Duration {
+	if n < 0 {
+		return 0
 	}
-	*defaultClientConfig = c
-	defaultClientConfig.applyDefaults()
+	return time.Duration(n) * time.Second
 }
 
-// SetTLSConfig sets the default TLS configuration used by NewHTTPClient().
-// This will generally be set once for adding custom CA roots or other
-// configuration used throughout the application.
+// SetClientConfig will replace the global ClientConfig, which is used
+// for any values not given to NewClient(), and for all clients returned
+// by NewHTTPClient().  Unset values use the built-in defaults.  Clients
+// which have already been created are not changed.
 //
-// NewHTTPClient() also allows per-client TLS configuration, if desired.
+// Libraries should prefer passing WithClientConfig() to NewClient() so
+// they do not change the timeouts of other clients in the process.
+func SetClientConfig(c ClientConfig) {
+	c.applyDefaultsFrom(builtinClientConfig)
+	defaultsLock.Lock()
+	defer defaultsLock.Unlock()
+	defaultClientConfig = &c
+}
+
+// SetTLSConfig sets the default TLS configuration used by NewClient()
+// and NewHTTPClient().  This will generally be set once for adding
+// custom CA roots or other configuration used throughout the application.
+//
+// NewClient() also allows per-client TLS configuration, if desired.
 func SetTLSConfig(tlsconfig *tls.Config) {
+	defaultsLock.Lock()
+	defer defaultsLock.Unlock()
 	defaultTLSConfig = tlsconfig
 }
 
+// ClientOption changes how NewClient() builds a client.
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	config     *ClientConfig
+	tlsConfig  *tls.Config
+	transports []func(http.RoundTripper) http.RoundTripper
+}
+
+// WithClientConfig sets the timeouts and pool sizes for one client.
+// Any values which are 0 use the global ClientConfig.
+func WithClientConfig(c ClientConfig) ClientOption {
+	return func(o *clientOptions) {
+		o.config = &c
+	}
+}
+
+// WithTLSConfig sets the TLS configuration for one client, replacing
+// the global TLS configuration.  See MergeDefaultTLSConfig() to add
+// to the global configuration instead.
+func WithTLSConfig(tlsConfig *tls.Config) ClientOption {
+	return func(o *clientOptions) {
+		o.tlsConfig = tlsConfig
+	}
+}
+
+// WithTransportWrapper wraps the client's transport, for example to add
+// headers or retries.  Wrappers are applied in the order given, so the
+// last one added sees each request first.  The transport being wrapped
+// already includes tracing.
+func WithTransportWrapper(wrap func(http.RoundTripper) http.RoundTripper) ClientOption {
+	return func(o *clientOptions) {
+		o.transports = append(o.transports, wrap)
+	}
+}
+
+// NewClient returns a new http.Client configured by opts.  Anything not
+// set using an option comes from the global configuration, as set by
+// SetClientConfig() and SetTLSConfig(), at the time it is called.
+// Each client has its own transport and connection pool, and is
+// not affected by later changes to the global configuration.
+//
+// Requests are traced, and recorded in the http.client.request.duration
+// histogram and http.client.active_requests counter, labelled by method,
+// server address and port, and status code and class, or error.type if
+// no response was received.
+//
+// Redirects are not followed; the redirect response is returned instead.
+func NewClient(opts ...ClientOption) *http.Client {
+	defaults, defaultTLS := currentDefaults()
+	o := clientOptions{tlsConfig: defaultTLS}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	conf := defaults
+	if o.config != nil {
+		conf = *o.config
+		conf.applyDefaultsFrom(defaults)
+	}
+
+	base := newBaseTransport(conf, o.tlsConfig)
+	var transport http.RoundTripper = otelhttp.NewTransport(newMetricsTransport(base),
+		otelhttp.WithMeterProvider(noop.NewMeterProvider()))
+	for _, wrap := range o.transports {
+		transport = wrap(transport)
+	}
+
+	return &http.Client{
+		Timeout:   time.Duration(conf.ClientTimeout) * time.Second,
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// newBaseTransport returns the transport which makes connections,
+// before tracing and any wrappers are added.  The TLS config is cloned,
+// as enabling HTTP/2 changes it.
+func newBaseTransport(conf ClientConfig, tlsConfig *tls.Config) *http.Transport {
+	dialer := net.Dialer{
+		Timeout:   time.Duration(conf.DialTimeout) * time.Second,
+		KeepAlive: time.Duration(conf.KeepAlivePeriod) * time.Second,
+	}
+	t := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   time.Duration(conf.TLSHandshakeTimeout) * time.Second,
+		TLSClientConfig:       tlsConfig.Clone(),
+		ResponseHeaderTimeout: time.Duration(conf.ResponseHeaderTimeout) * time.Second,
+		ExpectContinueTimeout: time.Second,
+		MaxIdleConns:          conf.MaxIdleConnections,
+		MaxIdleConnsPerHost:   conf.MaxIdleConnectionsPerHost,
+		MaxConnsPerHost:       conf.MaxConnectionsPerHost,
+		IdleConnTimeout:       seconds(conf.IdleConnectionTimeout),
+	}
+	configureHTTP2(t, conf)
+	return t
+}
+
+// configureHTTP2 enables HTTP/2 with health checks on t, or disables it.
+// Since t has a custom dialer and TLS config, the standard library would
+// otherwise only use HTTP/1.1, without any way to set these timeouts.
+func configureHTTP2(t *http.Transport, conf ClientConfig) {
+	if conf.DisableHTTP2 {
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		return
+	}
+	t2, err := http2.ConfigureTransports(t)
+	if err != nil {
+		log.Printf("configuring HTTP/2, using HTTP/1.1 only: %v", err)
+		return
+	}
+	t2.ReadIdleTimeout = seconds(conf.HTTP2ReadIdleTimeout)
+	t2.PingTimeout = seconds(conf.HTTP2PingTimeout)
+}
+
 // NewHTTPClient returns a new http.Client that is configured with
 // sane timeouts, a global TLS configuration, and optionally a per-client
-// TLS config.
+// TLS config.  It is the same as NewClient(WithTLSConfig(tlsConfig)),
+// except that a nil tlsConfig uses the global one.
 //
 // Generally, the global config will have things like custom CA roots,
 // and we will want to trust those for every outgoing conneciton.
 // A per-client TLS config would be used where we are talking to a
 // specific API, and want to insert our certificates or a custom
-// CA root for just that connection.
-//
-// Future changes should allow merging tls configs, so we can add to
-// the base default rather than replace it entirely.
+// CA root for just that connection.  A per-client config replaces the
+// global one entirely; use MergeDefaultTLSConfig() to build one which
+// adds to it instead.
 func NewHTTPClient(tlsConfig *tls.Config) *http.Client {
 	if tlsConfig == nil {
-		tlsConfig = defaultTLSConfig
-	}
-	dialer := net.Dialer{Timeout: time.Duration(defaultClientConfig.DialTimeout) * time.Second}
-	client := &http.Client{
-		Timeout: time.Duration(defaultClientConfig.ClientTimeout) * time.Second,
-		Transport: otelhttp.NewTransport(&http.Transport{
-			Dial:                  dialer.Dial,
-			DialContext:           dialer.DialContext,
-			TLSHandshakeTimeout:   time.Duration(defaultClientConfig.TLSHandshakeTimeout) * time.Second,
-			TLSClientConfig:       tlsConfig,
-			ResponseHeaderTimeout: time.Duration(defaultClientConfig.ResponseHeaderTimeout) * time.Second,
-			ExpectContinueTimeout: time.Second,
-			MaxIdleConns:          defaultClientConfig.MaxIdleConnections,
-		}),
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
+		return NewClient()
 	}
-	return client
+	return NewClient(WithTLSConfig(tlsConfig))
 }
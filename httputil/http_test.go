@@ -17,7 +17,12 @@ package httputil
 import (
 	"crypto/tls"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -45,6 +50,12 @@ func Test_StatusCodeOK(t *testing.T) {
 }
 
 func TestClientConfig_applyDefaults(t *testing.T) {
+	defaults := *defaultClientConfig
+	with := func(set func(c *ClientConfig)) ClientConfig {
+		c := defaults
+		set(&c)
+		return c
+	}
 	tests := []struct {
 		name     string
 		provided ClientConfig
@@ -53,62 +64,49 @@ func TestClientConfig_applyDefaults(t *testing.T) {
 		{
 			"all defaults",
 			ClientConfig{},
-			*defaultClientConfig,
+			defaults,
 		}, {
 			"DialTimeout set",
 			ClientConfig{DialTimeout: 1234},
-			ClientConfig{
-				DialTimeout:           1234,
-				ClientTimeout:         defaultClientConfig.DialTimeout,
-				TLSHandshakeTimeout:   defaultClientConfig.TLSHandshakeTimeout,
-				ResponseHeaderTimeout: defaultClientConfig.ResponseHeaderTimeout,
-				MaxIdleConnections:    defaultClientConfig.MaxIdleConnections,
-			},
+			with(func(c *ClientConfig) { c.DialTimeout = 1234 }),
 		}, {
 			"ClientTimeout set",
 			ClientConfig{ClientTimeout: 1234},
-			ClientConfig{
-				DialTimeout:           defaultClientConfig.DialTimeout,
-				ClientTimeout:         1234,
-				TLSHandshakeTimeout:   defaultClientConfig.TLSHandshakeTimeout,
-				ResponseHeaderTimeout: defaultClientConfig.ResponseHeaderTimeout,
-				MaxIdleConnections:    defaultClientConfig.MaxIdleConnections,
-			},
+			with(func(c *ClientConfig) { c.ClientTimeout = 1234 }),
 		}, {
 			"TLSHandshakeTimeout set",
 			ClientConfig{TLSHandshakeTimeout: 1234},
-			ClientConfig{
-				DialTimeout:           defaultClientConfig.DialTimeout,
-				ClientTimeout:         defaultClientConfig.DialTimeout,
-				TLSHandshakeTimeout:   1234,
-				ResponseHeaderTimeout: defaultClientConfig.ResponseHeaderTimeout,
-				MaxIdleConnections:    defaultClientConfig.MaxIdleConnections,
-			},
+			with(func(c *ClientConfig) { c.TLSHandshakeTimeout = 1234 }),
 		}, {
 			"ResponseHeaderTimeout set",
 			ClientConfig{ResponseHeaderTimeout: 1234},
-			ClientConfig{
-				DialTimeout:           defaultClientConfig.DialTimeout,
-				ClientTimeout:         defaultClientConfig.DialTimeout,
-				TLSHandshakeTimeout:   defaultClientConfig.TLSHandshakeTimeout,
-				ResponseHeaderTimeout: 1234,
-				MaxIdleConnections:    defaultClientConfig.MaxIdleConnections,
-			},
+			with(func(c *ClientConfig) { c.ResponseHeaderTimeout = 1234 }),
 		}, {
 			"MaxIdleConnections set",
 			ClientConfig{MaxIdleConnections: 1234},
-			ClientConfig{
-				DialTimeout:           defaultClientConfig.DialTimeout,
-				ClientTimeout:         defaultClientConfig.DialTimeout,
-				TLSHandshakeTimeout:   defaultClientConfig.TLSHandshakeTimeout,
-				ResponseHeaderTimeout: defaultClientConfig.ResponseHeaderTimeout,
-				MaxIdleConnections:    1234,
-			},
+			with(func(c *ClientConfig) { c.MaxIdleConnections = 1234 }),
+		}, {
+			"pool limits set",
+			ClientConfig{MaxIdleConnectionsPerHost: 50, MaxConnectionsPerHost: 200, IdleConnectionTimeout: -1},
+			with(func(c *ClientConfig) {
+				c.MaxIdleConnectionsPerHost = 50
+				c.MaxConnectionsPerHost = 200
+				c.IdleConnectionTimeout = -1
+			}),
+		}, {
+			"keep-alive and HTTP/2 set",
+			ClientConfig{KeepAlivePeriod: 5, HTTP2ReadIdleTimeout: -1, HTTP2PingTimeout: 3, DisableHTTP2: true},
+			with(func(c *ClientConfig) {
+				c.KeepAlivePeriod = 5
+				c.HTTP2ReadIdleTimeout = -1
+				c.HTTP2PingTimeout = 3
+				c.DisableHTTP2 = true
+			}),
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			found := tt.wanted
+			found := tt.provided
 			found.applyDefaults()
 			require.Equal(t, tt.wanted, found)
 		})
@@ -121,6 +119,7 @@ func Test_SetClientConfig(t *testing.T) {
 		c := ClientConfig{DialTimeout: 9876}
 		SetClientConfig(c)
 		require.Equal(t, 9876, defaultClientConfig.DialTimeout)
+		require.Equal(t, builtinClientConfig.ClientTimeout, defaultClientConfig.ClientTimeout)
 	})
 }
 
@@ -132,3 +131,116 @@ func Test_SetTLSConfig(t *testing.T) {
 		require.NotNil(t, defaultTLSConfig)
 	})
 }
+
+type headerTransport struct {
+	name  string
+	inner http.RoundTripper
+}
+
+func (ht headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req.Header.Add("x-wrapped", ht.name)
+	return ht.inner.RoundTrip(req)
+}
+
+func TestNewClient(t *testing.T) {
+	SetClientConfig(ClientConfig{ClientTimeout: 30})
+	t.Cleanup(func() { SetClientConfig(ClientConfig{}) })
+
+	t.Run("global defaults", func(t *testing.T) {
+		c := NewClient()
+		require.Equal(t, 30*time.Second, c.Timeout)
+	})
+
+	t.Run("per-client config", func(t *testing.T) {
+		a := NewClient(WithClientConfig(ClientConfig{ClientTimeout: 5}))
+		b := NewClient(WithClientConfig(ClientConfig{ClientTimeout: 7}))
+		require.Equal(t, 5*time.Second, a.Timeout)
+		require.Equal(t, 7*time.Second, b.Timeout)
+		require.NotSame(t, a.Transport, b.Transport)
+	})
+
+	t.Run("transport wrappers", func(t *testing.T) {
+		var got []string
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got = r.Header.Values("x-wrapped")
+		}))
+		defer server.Close()
+
+		c := NewClient(
+			WithTransportWrapper(func(rt http.RoundTripper) http.RoundTripper { return headerTransport{"first", rt} }),
+			WithTransportWrapper(func(rt http.RoundTripper) http.RoundTripper { return headerTransport{"second", rt} }),
+		)
+		resp, err := c.Get(server.URL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, []string{"second", "first"}, got)
+	})
+
+	t.Run("concurrent with SetClientConfig", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				SetClientConfig(ClientConfig{ClientTimeout: 30 + i})
+				SetTLSConfig(nil)
+			}(i)
+			go func() {
+				defer wg.Done()
+				_ = NewHTTPClient(nil)
+			}()
+		}
+		wg.Wait()
+	})
+}
+
+func Test_newBaseTransport(t *testing.T) {
+	conf := ClientConfig{
+		MaxIdleConnections:        100,
+		MaxIdleConnectionsPerHost: 20,
+		MaxConnectionsPerHost:     40,
+		IdleConnectionTimeout:     -1,
+		KeepAlivePeriod:           30,
+		HTTP2ReadIdleTimeout:      30,
+		HTTP2PingTimeout:          15,
+	}
+	shared := &tls.Config{MinVersion: tls.VersionTLS12}
+	tr := newBaseTransport(conf, shared)
+	require.Equal(t, 100, tr.MaxIdleConns)
+	require.Equal(t, 20, tr.MaxIdleConnsPerHost)
+	require.Equal(t, 40, tr.MaxConnsPerHost)
+	require.Equal(t, time.Duration(0), tr.IdleConnTimeout)
+	require.Nil(t, tr.Dial) //nolint:staticcheck // checking the deprecated field is not set
+	require.Contains(t, tr.TLSClientConfig.NextProtos, "h2")
+	require.Empty(t, shared.NextProtos, "shared TLS config must not be changed")
+}
+
+func TestNewClient_http2(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.Proto))
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	tlsConfig := server.Client().Transport.(*http.Transport).TLSClientConfig
+
+	tests := []struct {
+		name      string
+		conf      ClientConfig
+		wantProto string
+	}{
+		{"HTTP/2 by default", ClientConfig{}, "HTTP/2.0"},
+		{"HTTP/2 disabled", ClientConfig{DisableHTTP2: true}, "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewClient(WithClientConfig(tt.conf), WithTLSConfig(tlsConfig))
+			resp, err := client.Get(server.URL)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			require.Equal(t, tt.wantProto, string(body))
+		})
+	}
+}
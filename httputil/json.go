@@ -0,0 +1,238 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DecodeOptions controls how DecodeJSON() reads a request.
+type DecodeOptions struct {
+	// MaxBytes limits the size of the body.  If 0, a default of 1 MiB
+	// is used.
+	MaxBytes int64
+	// Strict rejects fields which are not in the destination struct.
+	Strict bool
+	// Validate, if set, is called after decoding.  It is called in
+	// addition to the destination's own Validate(), if it has one.
+	Validate func(v interface{}) error
+}
+
+const defaultMaxBodyBytes = 1 << 20
+
+// Validator is implemented by request types which can check their own
+// content once decoded.  Returning a *ValidationError allows field
+// details to be sent to the client.
+type Validator interface {
+	Validate() error
+}
+
+var errBodyTooLarge = errors.New("request body too large")
+
+// limitedReader returns errBodyTooLarge once more than n bytes are read.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errBodyTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// DecodeJSON reads the request body as JSON into v, then validates it.
+// The errors returned are suitable for returning from a HandlerFunc:
+//
+//   - 415 if the content type is not JSON;
+//   - 413 if the body is larger than MaxBytes;
+//   - 400 if the body is empty, is not valid JSON, does not match v,
+//     or, when Strict, has unknown fields; and
+//   - a *ValidationError if validation fails.
+func DecodeJSON(r *http.Request, v interface{}, opts DecodeOptions) error {
+	if !isJSONContentType(r.Header.Get("content-type")) {
+		return NewHTTPError(http.StatusUnsupportedMediaType, "content type must be application/json", nil)
+	}
+	if opts.MaxBytes == 0 {
+		opts.MaxBytes = defaultMaxBodyBytes
+	}
+	if r.Body == nil {
+		return NewHTTPError(http.StatusBadRequest, "request body is empty", nil)
+	}
+
+	dec := json.NewDecoder(&limitedReader{r: r.Body, n: opts.MaxBytes})
+	if opts.Strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v); err != nil {
+		return decodeError(err, opts.MaxBytes)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if errors.Is(err, errBodyTooLarge) {
+			return decodeError(err, opts.MaxBytes)
+		}
+		return NewHTTPError(http.StatusBadRequest, "request body must contain a single JSON value", err)
+	}
+
+	if validator, ok := v.(Validator); ok {
+		if err := validator.Validate(); err != nil {
+			return validationError(err)
+		}
+	}
+	if opts.Validate != nil {
+		if err := opts.Validate(v); err != nil {
+			return validationError(err)
+		}
+	}
+	return nil
+}
+
+// ReadJSON is DecodeJSON(), but sends any error using SetRequestError().
+// It returns false if an error was sent, in which case the handler
+// should return without writing anything more.
+func ReadJSON(w http.ResponseWriter, r *http.Request, v interface{}, opts DecodeOptions) bool {
+	err := DecodeJSON(r, v, opts)
+	if err == nil {
+		return true
+	}
+	p, _ := problemForError(r, err)
+	WriteProblem(w, r, p)
+	return false
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" ||
+		(strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"))
+}
+
+func decodeError(err error, maxBytes int64) error {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		return NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body must not be larger than %d bytes", maxBytes), err)
+	case errors.Is(err, io.EOF):
+		return NewHTTPError(http.StatusBadRequest, "request body is empty", err)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return NewHTTPError(http.StatusBadRequest, "request body contains incomplete JSON", err)
+	case errors.As(err, &syntaxErr):
+		return NewHTTPError(http.StatusBadRequest, fmt.Sprintf("request body contains invalid JSON at offset %d", syntaxErr.Offset), err)
+	case errors.As(err, &typeErr):
+		if typeErr.Field != "" {
+			return NewHTTPError(http.StatusBadRequest, fmt.Sprintf("field %q must be %s", typeErr.Field, typeErr.Type), err)
+		}
+		return NewHTTPError(http.StatusBadRequest, fmt.Sprintf("request body must be %s", typeErr.Type), err)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// encoding/json does not have a type for this error.
+		return NewHTTPError(http.StatusBadRequest, "request body contains "+strings.TrimPrefix(err.Error(), "json: "), err)
+	}
+	return NewHTTPError(http.StatusBadRequest, "request body could not be decoded", err)
+}
+
+func validationError(err error) error {
+	var validationErr *ValidationError
+	var httpErr *HTTPError
+	if errors.As(err, &validationErr) || errors.As(err, &httpErr) {
+		return err
+	}
+	return &ValidationError{Message: err.Error()}
+}
+
+// WriteJSON sends v as a JSON response with statusCode.  If v cannot be
+// marshalled, a 500 error is sent instead.
+func WriteJSON(w http.ResponseWriter, r *http.Request, statusCode int, v interface{}) {
+	d, ok := marshalResponse(w, r, v)
+	if !ok {
+		return
+	}
+	writeJSONBody(w, r, statusCode, d)
+}
+
+// WriteJSONWithETag sends v as a 200 JSON response with an ETag computed
+// from its content.  If the request's If-None-Match matches, a 304 with
+// no body is sent instead.
+func WriteJSONWithETag(w http.ResponseWriter, r *http.Request, v interface{}) {
+	d, ok := marshalResponse(w, r, v)
+	if !ok {
+		return
+	}
+	sum := sha256.Sum256(d)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	w.Header().Set("etag", etag)
+	if etagMatches(r.Header.Get("if-none-match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeJSONBody(w, r, http.StatusOK, d)
+}
+
+func marshalResponse(w http.ResponseWriter, r *http.Request, v interface{}) ([]byte, bool) {
+	d, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("marshalling response json: %v %s", err, logContext(r.Context()))
+		SetRequestError(w, r, http.StatusInternalServerError, "internal server error")
+		return nil, false
+	}
+	return d, true
+}
+
+func writeJSONBody(w http.ResponseWriter, r *http.Request, statusCode int, d []byte) {
+	w.Header().Set("content-type", "application/json; charset=utf-8")
+	w.Header().Set("x-content-type-options", "nosniff")
+	w.Header().Set("content-length", strconv.Itoa(len(d)))
+	w.WriteHeader(statusCode)
+	if r.Method == http.MethodHead {
+		return
+	}
+	CheckedWrite(w, d)
+}
+
+// etagMatches implements the weak comparison used for If-None-Match.
+func etagMatches(ifNoneMatch string, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == want {
+			return true
+		}
+	}
+	return false
+}
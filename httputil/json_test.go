@@ -0,0 +1,167 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testPipeline struct {
+	Name  string `json:"name"`
+	Steps int    `json:"steps"`
+}
+
+func (p *testPipeline) Validate() error {
+	if p.Name == "" {
+		return &ValidationError{Message: "invalid pipeline", Fields: map[string]string{"name": "required"}}
+	}
+	return nil
+}
+
+func TestDecodeJSON(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		opts        DecodeOptions
+		wantStatus  int
+		wantMessage string
+	}{
+		{"valid", "application/json", `{"name":"deploy","steps":3}`, DecodeOptions{}, 0, ""},
+		{"vendor type", "application/vnd.opsmx+json; charset=utf-8", `{"name":"deploy"}`, DecodeOptions{}, 0, ""},
+		{"unknown field allowed", "application/json", `{"name":"deploy","x":1}`, DecodeOptions{}, 0, ""},
+		{"unknown field strict", "application/json", `{"name":"deploy","x":1}`, DecodeOptions{Strict: true}, 400, `request body contains unknown field "x"`},
+		{"wrong content type", "text/plain", `{"name":"deploy"}`, DecodeOptions{}, 415, "content type must be application/json"},
+		{"missing content type", "", `{"name":"deploy"}`, DecodeOptions{}, 415, "content type must be application/json"},
+		{"too large", "application/json", `{"name":"` + strings.Repeat("x", 100) + `"}`, DecodeOptions{MaxBytes: 50}, 413, "request body must not be larger than 50 bytes"},
+		{"exactly the limit", "application/json", `{"name":"deploy"}`, DecodeOptions{MaxBytes: 17}, 0, ""},
+		{"trailing data over the limit", "application/json", `{"name":"deploy"} ` + strings.Repeat(" ", 100), DecodeOptions{MaxBytes: 20}, 413, "request body must not be larger than 20 bytes"},
+		{"empty", "application/json", ``, DecodeOptions{}, 400, "request body is empty"},
+		{"truncated", "application/json", `{"name":`, DecodeOptions{}, 400, "request body contains incomplete JSON"},
+		{"syntax", "application/json", `{"name" "deploy"}`, DecodeOptions{}, 400, "request body contains invalid JSON at offset 9"},
+		{"wrong type", "application/json", `{"name":"deploy","steps":"three"}`, DecodeOptions{}, 400, `field "steps" must be int`},
+		{"two values", "application/json", `{"name":"a"}{"name":"b"}`, DecodeOptions{}, 400, "request body must contain a single JSON value"},
+		{"own validation", "application/json", `{"steps":3}`, DecodeOptions{}, -1, "invalid pipeline"},
+		{"hook validation", "application/json", `{"name":"deploy","steps":30}`, DecodeOptions{Validate: func(v interface{}) error {
+			if v.(*testPipeline).Steps > 10 {
+				return fmt.Errorf("too many steps")
+			}
+			return nil
+		}}, -1, "too many steps"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("content-type", tt.contentType)
+			}
+			var p testPipeline
+			err := DecodeJSON(req, &p, tt.opts)
+			switch tt.wantStatus {
+			case 0:
+				require.NoError(t, err)
+				require.Equal(t, "deploy", p.Name)
+			case -1:
+				var validationErr *ValidationError
+				require.ErrorAs(t, err, &validationErr)
+				require.Equal(t, tt.wantMessage, validationErr.Message)
+			default:
+				var httpErr *HTTPError
+				require.ErrorAs(t, err, &httpErr)
+				require.Equal(t, tt.wantStatus, httpErr.Status)
+				require.Equal(t, tt.wantMessage, httpErr.Message)
+			}
+		})
+	}
+}
+
+func TestReadJSON(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{}`))
+	req.Header.Set("content-type", "application/json")
+	w := httptest.NewRecorder()
+	var p testPipeline
+	require.False(t, ReadJSON(w, req, &p, DecodeOptions{}))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.JSONEq(t, `{"status":"error","code":400,"error":"invalid pipeline"}`, w.Body.String())
+
+	req = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"name":"deploy"}`))
+	req.Header.Set("content-type", "application/json")
+	w = httptest.NewRecorder()
+	require.True(t, ReadJSON(w, req, &p, DecodeOptions{}))
+	require.Equal(t, 200, w.Code)
+	require.Zero(t, w.Body.Len())
+}
+
+func TestWriteJSON(t *testing.T) {
+	w := httptest.NewRecorder()
+	WriteJSON(w, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusCreated, testPipeline{Name: "deploy"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.Equal(t, "application/json; charset=utf-8", w.Header().Get("content-type"))
+	require.Equal(t, "nosniff", w.Header().Get("x-content-type-options"))
+	require.Equal(t, "27", w.Header().Get("content-length"))
+	require.JSONEq(t, `{"name":"deploy","steps":0}`, w.Body.String())
+
+	t.Run("HEAD", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		WriteJSON(w, httptest.NewRequest(http.MethodHead, "/", nil), http.StatusOK, testPipeline{Name: "deploy"})
+		require.Equal(t, "27", w.Header().Get("content-length"))
+		require.Zero(t, w.Body.Len())
+	})
+
+	t.Run("unmarshallable", func(t *testing.T) {
+		captureLog(t)
+		w := httptest.NewRecorder()
+		WriteJSON(w, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusOK, map[string]interface{}{"f": func() {}})
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+		var body httpError
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		require.Equal(t, "internal server error", body.Error)
+	})
+}
+
+func TestWriteJSONWithETag(t *testing.T) {
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set("if-none-match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		WriteJSONWithETag(w, req, testPipeline{Name: "deploy"})
+		return w
+	}
+
+	first := get("")
+	require.Equal(t, http.StatusOK, first.Code)
+	etag := first.Header().Get("etag")
+	require.NotEmpty(t, etag)
+
+	for _, inm := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		w := get(inm)
+		require.Equal(t, http.StatusNotModified, w.Code, inm)
+		require.Zero(t, w.Body.Len())
+		require.Equal(t, etag, w.Header().Get("etag"))
+	}
+
+	w := get(`"other"`)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, first.Body.String(), w.Body.String())
+}
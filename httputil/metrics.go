@@ -0,0 +1,211 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+const meterName = "github.com/OpsMx/go-app-base/httputil"
+
+// durationBuckets are the histogram boundaries, in seconds, recommended
+// by the OpenTelemetry HTTP semantic conventions.
+var durationBuckets = []float64{.005, .01, .025, .05, .075, .1, .25, .5, .75, 1, 2.5, 5, 7.5, 10}
+
+type httpInstruments struct {
+	serverDuration metric.Float64Histogram
+	serverActive   metric.Int64UpDownCounter
+	clientDuration metric.Float64Histogram
+	clientActive   metric.Int64UpDownCounter
+}
+
+var (
+	instrumentsOnce sync.Once
+	instruments     httpInstruments
+)
+
+// httpMetrics returns the instruments, created once from the global
+// MeterProvider.  Instruments created before otel.SetMeterProvider() is
+// called use the provider set later.
+func httpMetrics() *httpInstruments {
+	instrumentsOnce.Do(func() {
+		meter := otel.Meter(meterName)
+		var err error
+		instruments.serverDuration, err = meter.Float64Histogram(
+			"http.server.request.duration",
+			metric.WithUnit("s"),
+			metric.WithDescription("Duration of HTTP server requests"),
+			metric.WithExplicitBucketBoundaries(durationBuckets...),
+		)
+		if err != nil {
+			otel.Handle(err)
+		}
+		instruments.serverActive, err = meter.Int64UpDownCounter(
+			"http.server.active_requests",
+			metric.WithUnit("{request}"),
+			metric.WithDescription("Number of active HTTP server requests"),
+		)
+		if err != nil {
+			otel.Handle(err)
+		}
+		instruments.clientDuration, err = meter.Float64Histogram(
+			"http.client.request.duration",
+			metric.WithUnit("s"),
+			metric.WithDescription("Duration of HTTP client requests, until the response headers are received"),
+			metric.WithExplicitBucketBoundaries(durationBuckets...),
+		)
+		if err != nil {
+			otel.Handle(err)
+		}
+		instruments.clientActive, err = meter.Int64UpDownCounter(
+			"http.client.active_requests",
+			metric.WithUnit("{request}"),
+			metric.WithDescription("Number of active HTTP client requests"),
+		)
+		if err != nil {
+			otel.Handle(err)
+		}
+	})
+	return &instruments
+}
+
+// knownMethods limits the values of http.request.method, so requests
+// with made-up methods cannot create unbounded metric series.
+var knownMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+func methodAttribute(method string) attribute.KeyValue {
+	if method == "" {
+		method = http.MethodGet
+	}
+	if !knownMethods[method] {
+		method = "_OTHER"
+	}
+	return attribute.String("http.request.method", method)
+}
+
+// statusAttributes returns the status code and class, such as "2xx",
+// and for server errors, error.type.
+func statusAttributes(statusCode int) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.Int("http.response.status_code", statusCode),
+		attribute.String("http.response.status_class", strconv.Itoa(statusCode/100)+"xx"),
+	}
+	if statusCode >= 500 {
+		attrs = append(attrs, attribute.String("error.type", strconv.Itoa(statusCode)))
+	}
+	return attrs
+}
+
+// ServerMetrics records the http.server.request.duration histogram and
+// http.server.active_requests counter, following the OpenTelemetry
+// semantic conventions, with the response's status class added.
+// Servers returned by NewServer() already use it.
+func ServerMetrics() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m := httpMetrics()
+			scheme := "http"
+			if r.TLS != nil {
+				scheme = "https"
+			}
+			attrs := []attribute.KeyValue{
+				methodAttribute(r.Method),
+				attribute.String("url.scheme", scheme),
+			}
+			ctx := r.Context()
+			m.serverActive.Add(ctx, 1, metric.WithAttributes(attrs...))
+			defer m.serverActive.Add(ctx, -1, metric.WithAttributes(attrs...))
+
+			stats := httpsnoop.CaptureMetrics(next, w, r)
+			attrs = append(attrs, statusAttributes(stats.Code)...)
+			m.serverDuration.Record(ctx, stats.Duration.Seconds(), metric.WithAttributes(attrs...))
+		})
+	}
+}
+
+// metricsTransport records the http.client.request.duration histogram
+// and http.client.active_requests counter for each request sent.
+type metricsTransport struct {
+	next http.RoundTripper
+}
+
+func newMetricsTransport(next http.RoundTripper) http.RoundTripper {
+	return &metricsTransport{next: next}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *metricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m := httpMetrics()
+	ctx := req.Context()
+	attrs := []attribute.KeyValue{
+		methodAttribute(req.Method),
+		attribute.String("url.scheme", req.URL.Scheme),
+	}
+	host, port, err := net.SplitHostPort(req.URL.Host)
+	if err != nil {
+		host = req.URL.Host
+		port = ""
+	}
+	attrs = append(attrs, attribute.String("server.address", host))
+	if p, err := strconv.Atoi(port); err == nil {
+		attrs = append(attrs, attribute.Int("server.port", p))
+	}
+	m.clientActive.Add(ctx, 1, metric.WithAttributes(attrs...))
+	defer m.clientActive.Add(ctx, -1, metric.WithAttributes(attrs...))
+
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	elapsed := time.Since(start)
+	if err != nil {
+		attrs = append(attrs, attribute.String("error.type", errorType(err)))
+	} else {
+		attrs = append(attrs, statusAttributes(resp.StatusCode)...)
+	}
+	m.clientDuration.Record(ctx, elapsed.Seconds(), metric.WithAttributes(attrs...))
+	return resp, err
+}
+
+// errorType returns a low-cardinality description of a transport error.
+func errorType(err error) string {
+	var ne net.Error
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	}
+	return "_OTHER"
+}
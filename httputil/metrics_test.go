@@ -0,0 +1,175 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	metricsdk "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+var (
+	testReaderOnce sync.Once
+	testReader     *metricsdk.ManualReader
+)
+
+// testMetricReader sets the global MeterProvider once for the package's
+// tests, since instruments stay bound to the first one set.
+func testMetricReader() *metricsdk.ManualReader {
+	testReaderOnce.Do(func() {
+		testReader = metricsdk.NewManualReader()
+		otel.SetMeterProvider(metricsdk.NewMeterProvider(metricsdk.WithReader(testReader)))
+	})
+	return testReader
+}
+
+// collectMetric returns the named metric's data, or nil.
+func collectMetric(t *testing.T, reader *metricsdk.ManualReader, name string) metricdata.Aggregation {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	require.NoError(t, reader.Collect(context.Background(), &rm))
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name == name {
+				return m.Data
+			}
+		}
+	}
+	return nil
+}
+
+// histogramCount returns the number of values recorded with attrs.
+func histogramCount(t *testing.T, data metricdata.Aggregation, attrs ...attribute.KeyValue) uint64 {
+	t.Helper()
+	h, ok := data.(metricdata.Histogram[float64])
+	require.True(t, ok, "not a float64 histogram: %T", data)
+	want := attribute.NewSet(attrs...)
+	for _, dp := range h.DataPoints {
+		if dp.Attributes.Equals(&want) {
+			return dp.Count
+		}
+	}
+	return 0
+}
+
+func TestHTTPMetrics(t *testing.T) {
+	reader := testMetricReader()
+	s, err := NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	require.NoError(t, err)
+	addr, cancel, done := startTestServer(t, s)
+	defer func() {
+		cancel()
+		require.NoError(t, <-done)
+	}()
+
+	client := NewClient()
+	for _, path := range []string{"/ok", "/ok", "/fail"} {
+		resp, err := client.Get("http://" + addr + path)
+		require.NoError(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	_, port := splitTestAddr(t, addr)
+	serverOK := []attribute.KeyValue{
+		attribute.String("http.request.method", "GET"),
+		attribute.String("url.scheme", "http"),
+		attribute.Int("http.response.status_code", 200),
+		attribute.String("http.response.status_class", "2xx"),
+	}
+	serverFail := []attribute.KeyValue{
+		attribute.String("http.request.method", "GET"),
+		attribute.String("url.scheme", "http"),
+		attribute.Int("http.response.status_code", 502),
+		attribute.String("http.response.status_class", "5xx"),
+		attribute.String("error.type", "502"),
+	}
+	data := collectMetric(t, reader, "http.server.request.duration")
+	require.NotNil(t, data)
+	require.Equal(t, uint64(2), histogramCount(t, data, serverOK...))
+	require.Equal(t, uint64(1), histogramCount(t, data, serverFail...))
+
+	clientOK := []attribute.KeyValue{
+		attribute.String("http.request.method", "GET"),
+		attribute.String("url.scheme", "http"),
+		attribute.String("server.address", "127.0.0.1"),
+		attribute.Int("server.port", port),
+		attribute.Int("http.response.status_code", 200),
+		attribute.String("http.response.status_class", "2xx"),
+	}
+	data = collectMetric(t, reader, "http.client.request.duration")
+	require.NotNil(t, data)
+	require.Equal(t, uint64(2), histogramCount(t, data, clientOK...))
+
+	// Requests are no longer active once complete.
+	active, ok := collectMetric(t, reader, "http.server.active_requests").(metricdata.Sum[int64])
+	require.True(t, ok)
+	for _, dp := range active.DataPoints {
+		require.Equal(t, int64(0), dp.Value)
+	}
+
+	// otelhttp's own metrics are not recorded as well.
+	require.Nil(t, collectMetric(t, reader, "http.server.duration"))
+	require.Nil(t, collectMetric(t, reader, "http.client.duration"))
+}
+
+func TestMetricsAttributes(t *testing.T) {
+	tests := []struct {
+		method     string
+		wantMethod string
+	}{
+		{"", "GET"},
+		{"POST", "POST"},
+		{"PURGE", "_OTHER"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			require.Equal(t, tt.wantMethod, methodAttribute(tt.method).Value.AsString())
+		})
+	}
+
+	require.Len(t, statusAttributes(404), 2)
+	require.Equal(t, "4xx", statusAttributes(404)[1].Value.AsString())
+	require.Len(t, statusAttributes(503), 3)
+
+	require.Equal(t, "canceled", errorType(context.Canceled))
+	require.Equal(t, "timeout", errorType(context.DeadlineExceeded))
+	require.Equal(t, "_OTHER", errorType(io.EOF))
+}
+
+func splitTestAddr(t *testing.T, addr string) (string, int) {
+	t.Helper()
+	host, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	p, err := strconv.Atoi(port)
+	require.NoError(t, err)
+	return host, p
+}
@@ -0,0 +1,396 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/felixge/httpsnoop"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Middleware wraps a handler to add behaviour before or after it.
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps h with each middleware.  The first middleware given is
+// the outermost, so sees each request first.  A typical chain is:
+//
+//	Chain(mux, RequestID(), AccessLog(), Recover(), Gzip())
+func Chain(h http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// RequestIDHeader is the header used to pass request IDs.
+const RequestIDHeader = "X-Request-Id"
+
+type requestIDKey struct{}
+
+// RequestID uses the request's X-Request-Id header, or generates a new
+// ID if it is missing or unreasonable, and adds it to the request's
+// context, the response headers, and the active span.
+func RequestID() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(RequestIDHeader)
+			if !validRequestID(id) {
+				id = newRequestID()
+			}
+			w.Header().Set(RequestIDHeader, id)
+			trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("http.request_id", id))
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+		})
+	}
+}
+
+// RequestIDFromContext returns the request ID set by RequestID(), or
+// an empty string.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("generating request ID: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// logContext returns the request and trace IDs for log lines.
+func logContext(ctx context.Context) string {
+	var parts []string
+	if id := RequestIDFromContext(ctx); id != "" {
+		parts = append(parts, "request_id="+id)
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		parts = append(parts, "trace_id="+sc.TraceID().String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// AccessLog logs each request once it completes, with its status,
+// size, duration, and request and trace IDs.
+func AccessLog() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			m := httpsnoop.CaptureMetrics(next, w, r)
+			log.Printf("%s %s %s %d %d %s %s",
+				r.RemoteAddr, r.Method, r.URL.RequestURI(), m.Code, m.Written, m.Duration, logContext(r.Context()))
+		})
+	}
+}
+
+// Recover turns a panic in the handler into a 500 error, sent using
+// SetRequestError(), and logs it with a stack trace.  If the handler had already
+// started its response, the connection is closed instead.
+func Recover() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			wroteHeader := false
+			w = httpsnoop.Wrap(w, httpsnoop.Hooks{
+				WriteHeader: func(f httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+					return func(code int) {
+						wroteHeader = true
+						f(code)
+					}
+				},
+				Write: func(f httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+					return func(b []byte) (int, error) {
+						wroteHeader = true
+						return f(b)
+					}
+				},
+			})
+			defer func() {
+				p := recover()
+				if p == nil {
+					return
+				}
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				log.Printf("panic serving %s %s: %v %s\n%s", r.Method, r.URL.Path, p, logContext(r.Context()), debug.Stack())
+				span := trace.SpanFromContext(r.Context())
+				span.AddEvent("panic", trace.WithAttributes(attribute.String("panic.value", strings.TrimSpace(fmtPanic(p)))))
+				span.SetStatus(codes.Error, "panic")
+				if wroteHeader {
+					panic(http.ErrAbortHandler)
+				}
+				SetRequestError(w, r, http.StatusInternalServerError, "internal server error")
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func fmtPanic(p interface{}) string {
+	switch v := p.(type) {
+	case error:
+		return v.Error()
+	case string:
+		return v
+	}
+	return "non-error panic"
+}
+
+// CORSConfig controls which cross-origin requests are allowed.
+// All times are in seconds.  If 0, a default will be used.
+type CORSConfig struct {
+	// AllowedOrigins may include "*" to allow any origin.
+	AllowedOrigins   []string `json:"allowedOrigins,omitempty" yaml:"allowedOrigins,omitempty"`
+	AllowedMethods   []string `json:"allowedMethods,omitempty" yaml:"allowedMethods,omitempty"`
+	AllowedHeaders   []string `json:"allowedHeaders,omitempty" yaml:"allowedHeaders,omitempty"`
+	ExposedHeaders   []string `json:"exposedHeaders,omitempty" yaml:"exposedHeaders,omitempty"`
+	AllowCredentials bool     `json:"allowCredentials,omitempty" yaml:"allowCredentials,omitempty"`
+	MaxAge           int      `json:"maxAge,omitempty" yaml:"maxAge,omitempty"`
+}
+
+var defaultCORSConfig = CORSConfig{
+	AllowedMethods: []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+	AllowedHeaders: []string{"Accept", "Authorization", "Content-Type", RequestIDHeader},
+	MaxAge:         600,
+}
+
+func (c *CORSConfig) applyDefaults() {
+	if len(c.AllowedMethods) == 0 {
+		c.AllowedMethods = defaultCORSConfig.AllowedMethods
+	}
+	if len(c.AllowedHeaders) == 0 {
+		c.AllowedHeaders = defaultCORSConfig.AllowedHeaders
+	}
+	if c.MaxAge == 0 {
+		c.MaxAge = defaultCORSConfig.MaxAge
+	}
+}
+
+// CORS adds cross-origin headers for allowed origins, and answers
+// preflight requests without calling the handler.  Requests from other
+// origins are passed on without CORS headers, so browsers will block them.
+func CORS(conf CORSConfig) Middleware {
+	conf.applyDefaults()
+	allowAny := false
+	origins := map[string]bool{}
+	for _, o := range conf.AllowedOrigins {
+		if o == "*" {
+			allowAny = true
+		}
+		origins[strings.ToLower(o)] = true
+	}
+	methods := strings.Join(conf.AllowedMethods, ", ")
+	headers := strings.Join(conf.AllowedHeaders, ", ")
+	exposed := strings.Join(conf.ExposedHeaders, ", ")
+	maxAge := strconv.Itoa(conf.MaxAge)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			w.Header().Add("Vary", "Origin")
+			if origin == "" || !(allowAny || origins[strings.ToLower(origin)]) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if allowAny && !conf.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if conf.AllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+				w.Header().Set("Access-Control-Allow-Methods", methods)
+				w.Header().Set("Access-Control-Allow-Headers", headers)
+				w.Header().Set("Access-Control-Max-Age", maxAge)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			if exposed != "" {
+				w.Header().Set("Access-Control-Expose-Headers", exposed)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+var gzipWriters = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(io.Discard)
+	},
+}
+
+// Gzip compresses responses for clients which accept it.  Responses
+// which already have a Content-Encoding, or which have no body, are
+// sent unchanged.  The decision is put off until the first non-empty
+// Write, so a handler which only calls WriteHeader() sends no
+// Content-Encoding.  Flush() is supported, so streams are compressed
+// as they are written.
+func Gzip() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if !acceptsGzip(r) || r.Method == http.MethodHead {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			gw := &gzipResponse{w: w}
+			defer gw.close()
+			next.ServeHTTP(httpsnoop.Wrap(w, httpsnoop.Hooks{
+				WriteHeader: func(httpsnoop.WriteHeaderFunc) httpsnoop.WriteHeaderFunc {
+					return gw.writeHeader
+				},
+				Write: func(httpsnoop.WriteFunc) httpsnoop.WriteFunc {
+					return gw.write
+				},
+				Flush: func(httpsnoop.FlushFunc) httpsnoop.FlushFunc {
+					return gw.flush
+				},
+				ReadFrom: func(httpsnoop.ReadFromFunc) httpsnoop.ReadFromFunc {
+					return func(src io.Reader) (int64, error) {
+						return io.Copy(writerFunc(gw.write), src)
+					}
+				},
+			}), r)
+		})
+	}
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			return strings.ReplaceAll(params, " ", "") != "q=0"
+		}
+	}
+	return false
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+// gzipResponse holds back the status code until there is a body to
+// compress, or the handler flushes or returns.
+type gzipResponse struct {
+	w           http.ResponseWriter
+	gz          *gzip.Writer
+	code        int
+	wroteHeader bool
+}
+
+func (g *gzipResponse) writeHeader(code int) {
+	if g.wroteHeader || g.code != 0 {
+		return
+	}
+	if code < 200 {
+		g.w.WriteHeader(code)
+		return
+	}
+	g.code = code
+}
+
+// sendHeader writes the held status code, first setting up compression
+// if compress is true and the response can have a body.
+func (g *gzipResponse) sendHeader(compress bool) {
+	g.wroteHeader = true
+	code := g.code
+	if code == 0 {
+		code = http.StatusOK
+	}
+	h := g.w.Header()
+	if compress && h.Get("Content-Encoding") == "" && code != http.StatusNoContent && code != http.StatusNotModified {
+		h.Set("Content-Encoding", "gzip")
+		h.Del("Content-Length")
+		g.gz = gzipWriters.Get().(*gzip.Writer)
+		g.gz.Reset(g.w)
+	}
+	g.w.WriteHeader(code)
+}
+
+func (g *gzipResponse) write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		if len(b) == 0 {
+			return 0, nil
+		}
+		if g.w.Header().Get("Content-Type") == "" {
+			g.w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		g.sendHeader(true)
+	}
+	if g.gz == nil {
+		return g.w.Write(b)
+	}
+	return g.gz.Write(b)
+}
+
+func (g *gzipResponse) flush() {
+	if !g.wroteHeader {
+		g.sendHeader(true)
+	}
+	if g.gz != nil {
+		_ = g.gz.Flush()
+	}
+	if f, ok := g.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipResponse) close() {
+	if !g.wroteHeader && g.code != 0 {
+		g.sendHeader(false)
+	}
+	if g.gz == nil {
+		return
+	}
+	if err := g.gz.Close(); err != nil {
+		log.Printf("closing gzip response: %v", err)
+	}
+	gzipWriters.Put(g.gz)
+	g.gz = nil
+}
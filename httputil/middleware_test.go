@@ -0,0 +1,271 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestChain(t *testing.T) {
+	var order []string
+	mw := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}), mw("first"), mw("second"))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, []string{"first", "second", "handler"}, order)
+}
+
+func TestRequestID(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	var seen string
+	h := RequestID()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestIDFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name     string
+		header   string
+		wantSame bool
+	}{
+		{"given", "abc-123", true},
+		{"missing", "", false},
+		{"too long", strings.Repeat("x", 200), false},
+		{"unprintable", "abc\x01", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, span := provider.Tracer("test").Start(context.Background(), tt.name)
+			req := httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx)
+			if tt.header != "" {
+				req.Header.Set(RequestIDHeader, tt.header)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			span.End()
+
+			require.NotEmpty(t, seen)
+			require.Equal(t, seen, w.Header().Get(RequestIDHeader))
+			require.Equal(t, tt.wantSame, seen == tt.header)
+			ended := recorder.Ended()
+			attrs := ended[len(ended)-1].Attributes()
+			require.Len(t, attrs, 1)
+			require.Equal(t, seen, attrs[0].Value.AsString())
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	buf := captureLog(t)
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte("short and stout"))
+	}), RequestID(), AccessLog())
+	req := httptest.NewRequest(http.MethodGet, "/pot?x=1", nil)
+	req.Header.Set(RequestIDHeader, "req-1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	require.Contains(t, buf.String(), "GET /pot?x=1 418 15 ")
+	require.Contains(t, buf.String(), "request_id=req-1")
+}
+
+func TestRecover(t *testing.T) {
+	buf := captureLog(t)
+
+	t.Run("before writing", func(t *testing.T) {
+		h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			panic("oops")
+		}), RequestID(), Recover())
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(RequestIDHeader, "req-2")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		require.Equal(t, http.StatusInternalServerError, w.Code)
+		var body httpError
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		require.Equal(t, "error", body.Status)
+		require.Equal(t, 500, body.Code)
+		require.Contains(t, buf.String(), "panic serving GET /: oops request_id=req-2")
+	})
+
+	t.Run("after writing", func(t *testing.T) {
+		h := Recover()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("partial"))
+			panic("oops")
+		}))
+		require.PanicsWithValue(t, http.ErrAbortHandler, func() {
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		})
+	})
+}
+
+func TestCORS(t *testing.T) {
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	tests := []struct {
+		name        string
+		conf        CORSConfig
+		method      string
+		origin      string
+		preflight   bool
+		wantOrigin  string
+		wantCalled  bool
+		wantMethods bool
+	}{
+		{"allowed origin", CORSConfig{AllowedOrigins: []string{"https://ui.example.com"}}, http.MethodGet, "https://UI.example.com", false, "https://UI.example.com", true, false},
+		{"other origin", CORSConfig{AllowedOrigins: []string{"https://ui.example.com"}}, http.MethodGet, "https://evil.example.com", false, "", true, false},
+		{"no origin", CORSConfig{AllowedOrigins: []string{"*"}}, http.MethodGet, "", false, "", true, false},
+		{"wildcard", CORSConfig{AllowedOrigins: []string{"*"}}, http.MethodGet, "https://any.example.com", false, "*", true, false},
+		{"wildcard with credentials", CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}, http.MethodGet, "https://any.example.com", false, "https://any.example.com", true, false},
+		{"preflight", CORSConfig{AllowedOrigins: []string{"*"}}, http.MethodOptions, "https://any.example.com", true, "*", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called = false
+			req := httptest.NewRequest(tt.method, "/", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPut)
+			}
+			w := httptest.NewRecorder()
+			CORS(tt.conf)(next).ServeHTTP(w, req)
+			require.Equal(t, tt.wantOrigin, w.Header().Get("Access-Control-Allow-Origin"))
+			require.Equal(t, tt.wantCalled, called)
+			require.Equal(t, tt.wantMethods, w.Header().Get("Access-Control-Allow-Methods") != "")
+			require.Contains(t, w.Header().Values("Vary"), "Origin")
+			if tt.preflight {
+				require.Equal(t, http.StatusNoContent, w.Code)
+				require.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+			}
+		})
+	}
+}
+
+func TestGzip(t *testing.T) {
+	body := strings.Repeat("hello world ", 100)
+	h := Gzip()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/encoded":
+			w.Header().Set("Content-Encoding", "br")
+		case "/empty":
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write(nil)
+			return
+		case "/stream":
+			_, _ = w.Write([]byte("data: one\n\n"))
+			w.(http.Flusher).Flush()
+			return
+		}
+		w.Header().Set("Content-Length", "1200")
+		_, _ = io.WriteString(w, body)
+	}))
+
+	get := func(path string, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	gunzip := func(t *testing.T, d []byte) string {
+		zr, err := gzip.NewReader(bytes.NewReader(d))
+		require.NoError(t, err)
+		got, err := io.ReadAll(zr)
+		require.NoError(t, err)
+		return string(got)
+	}
+
+	t.Run("compressed", func(t *testing.T) {
+		w := get("/", "deflate, gzip")
+		require.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+		require.Empty(t, w.Header().Get("Content-Length"))
+		require.Equal(t, "text/plain; charset=utf-8", w.Header().Get("Content-Type"))
+		require.Less(t, w.Body.Len(), len(body))
+		require.Equal(t, body, gunzip(t, w.Body.Bytes()))
+	})
+
+	t.Run("not accepted", func(t *testing.T) {
+		for _, ae := range []string{"", "br", "gzip;q=0"} {
+			w := get("/", ae)
+			require.Empty(t, w.Header().Get("Content-Encoding"))
+			require.Equal(t, body, w.Body.String())
+		}
+	})
+
+	t.Run("already encoded", func(t *testing.T) {
+		w := get("/encoded", "gzip")
+		require.Equal(t, "br", w.Header().Get("Content-Encoding"))
+		require.Equal(t, body, w.Body.String())
+	})
+
+	t.Run("no body", func(t *testing.T) {
+		w := get("/empty", "gzip")
+		require.Equal(t, http.StatusNoContent, w.Code)
+		require.Empty(t, w.Header().Get("Content-Encoding"))
+		require.Zero(t, w.Body.Len())
+	})
+
+	t.Run("status without body", func(t *testing.T) {
+		w := get("/created", "gzip")
+		require.Equal(t, http.StatusCreated, w.Code)
+		require.Empty(t, w.Header().Get("Content-Encoding"))
+		require.Zero(t, w.Body.Len())
+	})
+
+	t.Run("flush", func(t *testing.T) {
+		w := get("/stream", "gzip")
+		require.True(t, w.Flushed)
+		require.Equal(t, "data: one\n\n", gunzip(t, w.Body.Bytes()))
+	})
+}
@@ -0,0 +1,308 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// RetryConfig controls a retrying transport.  Backoff times are in
+// milliseconds, other times are in seconds.  If 0, a default will be used.
+//
+// The retry budget limits retries when an upstream is failing badly, so
+// retries do not multiply the load on it.  Each retry costs one token and
+// each successful request earns RetryBudgetRatio tokens, up to
+// RetryBudgetTokens.  Retries are only made while more than half of the
+// tokens remain.
+type RetryConfig struct {
+	MaxAttempts                int     `json:"maxAttempts,omitempty" yaml:"maxAttempts,omitempty"`
+	InitialBackoffMilliseconds int     `json:"initialBackoffMilliseconds,omitempty" yaml:"initialBackoffMilliseconds,omitempty"`
+	MaxBackoffMilliseconds     int     `json:"maxBackoffMilliseconds,omitempty" yaml:"maxBackoffMilliseconds,omitempty"`
+	MaxRetryAfterSeconds       int     `json:"maxRetryAfterSeconds,omitempty" yaml:"maxRetryAfterSeconds,omitempty"`
+	RetryStatusCodes           []int   `json:"retryStatusCodes,omitempty" yaml:"retryStatusCodes,omitempty"`
+	RetryBudgetTokens          int     `json:"retryBudgetTokens,omitempty" yaml:"retryBudgetTokens,omitempty"`
+	RetryBudgetRatio           float64 `json:"retryBudgetRatio,omitempty" yaml:"retryBudgetRatio,omitempty"`
+}
+
+var defaultRetryConfig = RetryConfig{
+	MaxAttempts:                3,
+	InitialBackoffMilliseconds: 100,
+	MaxBackoffMilliseconds:     5000,
+	MaxRetryAfterSeconds:       30,
+	RetryStatusCodes: []int{
+		http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	},
+	RetryBudgetTokens: 10,
+	RetryBudgetRatio:  0.1,
+}
+
+func (c *RetryConfig) applyDefaults() {
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = defaultRetryConfig.MaxAttempts
+	}
+	if c.InitialBackoffMilliseconds == 0 {
+		c.InitialBackoffMilliseconds = defaultRetryConfig.InitialBackoffMilliseconds
+	}
+	if c.MaxBackoffMilliseconds == 0 {
+		c.MaxBackoffMilliseconds = defaultRetryConfig.MaxBackoffMilliseconds
+	}
+	if c.MaxRetryAfterSeconds == 0 {
+		c.MaxRetryAfterSeconds = defaultRetryConfig.MaxRetryAfterSeconds
+	}
+	if len(c.RetryStatusCodes) == 0 {
+		c.RetryStatusCodes = defaultRetryConfig.RetryStatusCodes
+	}
+	if c.RetryBudgetTokens == 0 {
+		c.RetryBudgetTokens = defaultRetryConfig.RetryBudgetTokens
+	}
+	if c.RetryBudgetRatio == 0 {
+		c.RetryBudgetRatio = defaultRetryConfig.RetryBudgetRatio
+	}
+}
+
+type retryAllowedKey struct{}
+
+// WithRetryAllowed returns a context which marks requests made with it
+// as safe to retry, even if their method is not idempotent.  Requests
+// with an Idempotency-Key or X-Idempotency-Key header are also retried.
+func WithRetryAllowed(ctx context.Context) context.Context {
+	return context.WithValue(ctx, retryAllowedKey{}, true)
+}
+
+// WithRetry adds a retrying transport to a client.  Since it wraps the
+// tracing transport, each attempt is traced separately.  Note the
+// client's ClientTimeout covers all attempts together.
+func WithRetry(conf RetryConfig) ClientOption {
+	return WithTransportWrapper(func(next http.RoundTripper) http.RoundTripper {
+		return NewRetryTransport(next, conf)
+	})
+}
+
+// RetryTransport is an http.RoundTripper which retries failed requests
+// with exponential backoff and jitter.  A request is retried if the
+// attempt returned an error, or one of RetryStatusCodes, and:
+//
+//   - the method is GET, HEAD, OPTIONS, TRACE, PUT, or DELETE, or the
+//     request is marked as retryable, see WithRetryAllowed();
+//   - any body can be sent again using the request's GetBody;
+//   - the request's context has not been cancelled; and
+//   - the retry budget allows it.
+//
+// Requests rejected by a circuit breaker are not retried.
+//
+// A Retry-After header on the response is used instead of the backoff,
+// unless it is longer than MaxRetryAfterSeconds, in which case the
+// response is returned without retrying.
+type RetryTransport struct {
+	next  http.RoundTripper
+	conf  RetryConfig
+	sleep func(ctx context.Context, d time.Duration) error
+	now   func() time.Time
+
+	lock   sync.Mutex
+	tokens float64
+	rand   *rand.Rand
+}
+
+// NewRetryTransport returns a RetryTransport which sends requests using next.
+func NewRetryTransport(next http.RoundTripper, conf RetryConfig) *RetryTransport {
+	conf.applyDefaults()
+	return &RetryTransport{
+		next:   next,
+		conf:   conf,
+		sleep:  sleepContext,
+		now:    time.Now,
+		tokens: float64(conf.RetryBudgetTokens),
+		// #nosec G404 -- jitter does not need a secure source
+		rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (rt *RetryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	canRetry := retryable(req)
+
+	for attempt := 1; ; attempt++ {
+		attemptReq := req
+		if attempt > 1 {
+			var err error
+			if attemptReq, err = rewindRequest(req); err != nil {
+				return nil, err
+			}
+		}
+		resp, err := rt.next.RoundTrip(attemptReq)
+		if !rt.shouldRetry(resp, err) {
+			rt.succeeded()
+			return resp, err
+		}
+		if !canRetry || attempt >= rt.conf.MaxAttempts || ctx.Err() != nil {
+			return resp, err
+		}
+
+		wait := rt.backoff(attempt)
+		if resp != nil {
+			if retryAfter, found := parseRetryAfter(resp.Header.Get("retry-after"), rt.now()); found {
+				if retryAfter > time.Duration(rt.conf.MaxRetryAfterSeconds)*time.Second {
+					return resp, err
+				}
+				wait = retryAfter
+			}
+		}
+		if !rt.takeToken() {
+			return resp, err
+		}
+		if resp != nil {
+			drainBody(resp.Body)
+		}
+
+		reason := "error"
+		if resp != nil {
+			reason = strconv.Itoa(resp.StatusCode)
+		}
+		trace.SpanFromContext(ctx).AddEvent("http.retry", trace.WithAttributes(
+			attribute.Int("http.retry.attempt", attempt+1),
+			attribute.String("http.retry.reason", reason),
+			attribute.Int64("http.retry.wait_ms", wait.Milliseconds()),
+		))
+		if err := rt.sleep(ctx, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (rt *RetryTransport) shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, ErrCircuitOpen)
+	}
+	for _, code := range rt.conf.RetryStatusCodes {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff returns a random duration up to the exponential backoff for
+// the attempt which just failed.
+func (rt *RetryTransport) backoff(attempt int) time.Duration {
+	limit := float64(rt.conf.InitialBackoffMilliseconds) * math.Pow(2, float64(attempt-1))
+	if limit > float64(rt.conf.MaxBackoffMilliseconds) {
+		limit = float64(rt.conf.MaxBackoffMilliseconds)
+	}
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	return time.Duration(rt.rand.Float64() * limit * float64(time.Millisecond))
+}
+
+func (rt *RetryTransport) takeToken() bool {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	if rt.tokens <= float64(rt.conf.RetryBudgetTokens)/2 {
+		return false
+	}
+	rt.tokens--
+	return true
+}
+
+func (rt *RetryTransport) succeeded() {
+	rt.lock.Lock()
+	defer rt.lock.Unlock()
+	rt.tokens += rt.conf.RetryBudgetRatio
+	if rt.tokens > float64(rt.conf.RetryBudgetTokens) {
+		rt.tokens = float64(rt.conf.RetryBudgetTokens)
+	}
+}
+
+func retryable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	if allowed, _ := req.Context().Value(retryAllowedKey{}).(bool); allowed {
+		return true
+	}
+	return req.Header.Get("idempotency-key") != "" || req.Header.Get("x-idempotency-key") != ""
+}
+
+func rewindRequest(req *http.Request) (*http.Request, error) {
+	newReq := req.Clone(req.Context())
+	if req.Body == nil || req.Body == http.NoBody {
+		return newReq, nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	newReq.Body = body
+	return newReq, nil
+}
+
+// drainBody reads a little of a discarded response so the connection
+// can be reused, then closes it.
+func drainBody(body io.ReadCloser) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(body, 4096))
+	body.Close()
+}
+
+// parseRetryAfter understands both forms of Retry-After, a number of
+// seconds or an HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	when, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if d := when.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
@@ -0,0 +1,191 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// flakyServer fails the first `failures` requests with status, and
+// records each request body.
+type flakyServer struct {
+	failures   int32
+	status     int
+	retryAfter string
+	calls      int32
+	bodies     []string
+}
+
+func (fs *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	n := atomic.AddInt32(&fs.calls, 1)
+	body, _ := io.ReadAll(r.Body)
+	fs.bodies = append(fs.bodies, string(body))
+	if n <= fs.failures {
+		if fs.retryAfter != "" {
+			w.Header().Set("retry-after", fs.retryAfter)
+		}
+		w.WriteHeader(fs.status)
+		return
+	}
+	_, _ = w.Write([]byte("ok"))
+}
+
+func newTestRetryTransport(conf RetryConfig) (*RetryTransport, *[]time.Duration) {
+	rt := NewRetryTransport(http.DefaultTransport, conf)
+	waits := []time.Duration{}
+	rt.sleep = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return ctx.Err()
+	}
+	return rt, &waits
+}
+
+func TestRetryTransport(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		header     string
+		ctx        context.Context
+		failures   int32
+		status     int
+		retryAfter string
+		wantStatus int
+		wantCalls  int32
+	}{
+		{"GET succeeds after retries", http.MethodGet, "", context.Background(), 2, 503, "", 200, 3},
+		{"GET gives up after MaxAttempts", http.MethodGet, "", context.Background(), 5, 503, "", 503, 3},
+		{"not retried status", http.MethodGet, "", context.Background(), 1, 500, "", 500, 1},
+		{"POST not retried", http.MethodPost, "", context.Background(), 1, 503, "", 503, 1},
+		{"POST with idempotency key", http.MethodPost, "abc", context.Background(), 1, 503, "", 200, 2},
+		{"POST allowed by context", http.MethodPost, "", WithRetryAllowed(context.Background()), 1, 503, "", 200, 2},
+		{"Retry-After too long", http.MethodPut, "", context.Background(), 1, 429, "3600", 429, 1},
+		{"Retry-After honored", http.MethodPut, "", context.Background(), 1, 429, "2", 200, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := &flakyServer{failures: tt.failures, status: tt.status, retryAfter: tt.retryAfter}
+			server := httptest.NewServer(fs)
+			defer server.Close()
+
+			rt, waits := newTestRetryTransport(RetryConfig{})
+			req, err := http.NewRequestWithContext(tt.ctx, tt.method, server.URL, bytes.NewReader([]byte("payload")))
+			require.NoError(t, err)
+			if tt.header != "" {
+				req.Header.Set("idempotency-key", tt.header)
+			}
+			resp, err := rt.RoundTrip(req)
+			require.NoError(t, err)
+			resp.Body.Close()
+			require.Equal(t, tt.wantStatus, resp.StatusCode)
+			require.Equal(t, tt.wantCalls, fs.calls)
+			for _, body := range fs.bodies {
+				require.Equal(t, "payload", body)
+			}
+			require.Len(t, *waits, int(tt.wantCalls-1))
+			if tt.retryAfter == "2" {
+				require.Equal(t, []time.Duration{2 * time.Second}, *waits)
+			}
+		})
+	}
+}
+
+func TestRetryTransport_bodyWithoutGetBody(t *testing.T) {
+	fs := &flakyServer{failures: 1, status: 503}
+	server := httptest.NewServer(fs)
+	defer server.Close()
+
+	rt, _ := newTestRetryTransport(RetryConfig{})
+	req, err := http.NewRequest(http.MethodPut, server.URL, io.NopCloser(bytes.NewReader([]byte("payload"))))
+	require.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, 503, resp.StatusCode)
+	require.Equal(t, int32(1), fs.calls)
+}
+
+func TestRetryTransport_budget(t *testing.T) {
+	fs := &flakyServer{failures: 1000, status: 503}
+	server := httptest.NewServer(fs)
+	defer server.Close()
+
+	rt, _ := newTestRetryTransport(RetryConfig{MaxAttempts: 10, RetryBudgetTokens: 4})
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	require.NoError(t, err)
+	resp, err := rt.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	// Two retries use half of the four tokens.
+	require.Equal(t, int32(3), fs.calls)
+
+	resp, err = rt.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, int32(4), fs.calls)
+}
+
+func TestRetryTransport_backoff(t *testing.T) {
+	rt := NewRetryTransport(nil, RetryConfig{InitialBackoffMilliseconds: 100, MaxBackoffMilliseconds: 300})
+	for i := 0; i < 100; i++ {
+		require.LessOrEqual(t, rt.backoff(1), 100*time.Millisecond)
+		require.LessOrEqual(t, rt.backoff(2), 200*time.Millisecond)
+		require.LessOrEqual(t, rt.backoff(10), 300*time.Millisecond)
+	}
+}
+
+func Test_parseRetryAfter(t *testing.T) {
+	now := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value     string
+		want      time.Duration
+		wantFound bool
+	}{
+		{"", 0, false},
+		{"5", 5 * time.Second, true},
+		{"-1", 0, false},
+		{"Thu, 01 Sep 2022 12:00:30 GMT", 30 * time.Second, true},
+		{"Thu, 01 Sep 2022 11:00:00 GMT", 0, true},
+		{"soon", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, found := parseRetryAfter(tt.value, now)
+			require.Equal(t, tt.wantFound, found)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	fs := &flakyServer{failures: 1, status: 502}
+	server := httptest.NewServer(fs)
+	defer server.Close()
+
+	client := NewClient(WithRetry(RetryConfig{InitialBackoffMilliseconds: 1}))
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, 200, resp.StatusCode)
+	require.Equal(t, int32(2), fs.calls)
+}
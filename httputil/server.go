@@ -0,0 +1,238 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// ServerConfig defines the timeouts and limits for servers returned by
+// NewServer().  All times are in seconds.  If 0, a default will be used.
+// A negative WriteTimeout disables it, which may be needed if long-lived
+// streams are served.
+//
+// If TLS.CertFile is set, the server uses TLS, reloading the certificate
+// when it changes.  If TLS.CAFile is also set, it is used to verify client
+// certificates; whether one is required depends on the base tls.Config.
+type ServerConfig struct {
+	ListenAddress     string             `json:"listenAddress,omitempty" yaml:"listenAddress,omitempty"`
+	ReadHeaderTimeout int                `json:"readHeaderTimeout,omitempty" yaml:"readHeaderTimeout,omitempty"`
+	ReadTimeout       int                `json:"readTimeout,omitempty" yaml:"readTimeout,omitempty"`
+	WriteTimeout      int                `json:"writeTimeout,omitempty" yaml:"writeTimeout,omitempty"`
+	IdleTimeout       int                `json:"idleTimeout,omitempty" yaml:"idleTimeout,omitempty"`
+	MaxHeaderBytes    int                `json:"maxHeaderBytes,omitempty" yaml:"maxHeaderBytes,omitempty"`
+	ShutdownTimeout   int                `json:"shutdownTimeout,omitempty" yaml:"shutdownTimeout,omitempty"`
+	TLS               CertReloaderConfig `json:"tls,omitempty" yaml:"tls,omitempty"`
+}
+
+var defaultServerConfig = ServerConfig{
+	ListenAddress:     ":8080",
+	ReadHeaderTimeout: 10,
+	ReadTimeout:       60,
+	WriteTimeout:      60,
+	IdleTimeout:       120,
+	MaxHeaderBytes:    1 << 20,
+	ShutdownTimeout:   30,
+}
+
+func (c *ServerConfig) applyDefaults() {
+	if c.ListenAddress == "" {
+		c.ListenAddress = defaultServerConfig.ListenAddress
+	}
+	if c.ReadHeaderTimeout == 0 {
+		c.ReadHeaderTimeout = defaultServerConfig.ReadHeaderTimeout
+	}
+	if c.ReadTimeout == 0 {
+		c.ReadTimeout = defaultServerConfig.ReadTimeout
+	}
+	if c.WriteTimeout == 0 {
+		c.WriteTimeout = defaultServerConfig.WriteTimeout
+	}
+	if c.IdleTimeout == 0 {
+		c.IdleTimeout = defaultServerConfig.IdleTimeout
+	}
+	if c.MaxHeaderBytes == 0 {
+		c.MaxHeaderBytes = defaultServerConfig.MaxHeaderBytes
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = defaultServerConfig.ShutdownTimeout
+	}
+}
+
+// ServerOption changes how NewServer() builds a server.
+type ServerOption func(*serverOptions)
+
+type serverOptions struct {
+	config        ServerConfig
+	tlsConfig     *tls.Config
+	operationName string
+}
+
+// WithServerConfig sets the listen address, timeouts, and TLS files.
+func WithServerConfig(c ServerConfig) ServerOption {
+	return func(o *serverOptions) {
+		o.config = c
+	}
+}
+
+// WithServerTLSConfig sets the base TLS configuration, replacing the
+// global one set by SetTLSConfig().  If ServerConfig.TLS is set, the
+// certificate from it is added; otherwise tlsConfig must include one
+// for the server to use TLS.
+func WithServerTLSConfig(tlsConfig *tls.Config) ServerOption {
+	return func(o *serverOptions) {
+		o.tlsConfig = tlsConfig
+	}
+}
+
+// WithOperationName sets the name of the span created for each request.
+func WithOperationName(name string) ServerOption {
+	return func(o *serverOptions) {
+		o.operationName = name
+	}
+}
+
+// Server is an http.Server with sane timeouts, tracing, metrics, and graceful
+// shutdown.  Use NewServer() to create one.
+type Server struct {
+	conf     ServerConfig
+	server   *http.Server
+	reloader *CertReloader
+
+	shutdownOnce sync.Once
+	shutdown     chan struct{}
+}
+
+type shutdownKey struct{}
+
+// NewServer returns a Server which traces each request, records it using
+// ServerMetrics(), and passes it to handler.
+func NewServer(handler http.Handler, opts ...ServerOption) (*Server, error) {
+	_, defaultTLS := currentDefaults()
+	o := serverOptions{tlsConfig: defaultTLS, operationName: "http-server"}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.config.applyDefaults()
+
+	s := &Server{
+		conf:     o.config,
+		shutdown: make(chan struct{}),
+	}
+
+	var tlsConfig *tls.Config
+	if o.config.TLS.CertFile != "" {
+		reloader, err := NewCertReloader(o.config.TLS)
+		if err != nil {
+			return nil, fmt.Errorf("loading server certificate: %v", err)
+		}
+		s.reloader = reloader
+		tlsConfig = reloader.ServerTLSConfig(o.tlsConfig)
+	} else if o.tlsConfig != nil && (len(o.tlsConfig.Certificates) > 0 || o.tlsConfig.GetCertificate != nil) {
+		tlsConfig = o.tlsConfig.Clone()
+	}
+
+	writeTimeout := time.Duration(o.config.WriteTimeout) * time.Second
+	if writeTimeout < 0 {
+		writeTimeout = 0
+	}
+	s.server = &http.Server{
+		Addr:              o.config.ListenAddress,
+		Handler:           otelhttp.NewHandler(ServerMetrics()(handler), o.operationName, otelhttp.WithMeterProvider(noop.NewMeterProvider())),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: time.Duration(o.config.ReadHeaderTimeout) * time.Second,
+		ReadTimeout:       time.Duration(o.config.ReadTimeout) * time.Second,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       time.Duration(o.config.IdleTimeout) * time.Second,
+		MaxHeaderBytes:    o.config.MaxHeaderBytes,
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), shutdownKey{}, s.shutdown)
+		},
+	}
+	return s, nil
+}
+
+// ShuttingDown returns a channel which is closed when the Server handling
+// the request whose context is given starts to shut down.  Handlers for
+// long-lived streams should return when it is closed, as shutdown waits
+// for all handlers to finish.  If the request is not being handled by a
+// Server, the channel is never closed.
+func ShuttingDown(ctx context.Context) <-chan struct{} {
+	if c, ok := ctx.Value(shutdownKey{}).(chan struct{}); ok {
+		return c
+	}
+	return nil
+}
+
+// Run listens on ListenAddress and serves requests until ctx is done,
+// then shuts down gracefully.
+func (s *Server) Run(ctx context.Context) error {
+	l, err := net.Listen("tcp", s.conf.ListenAddress)
+	if err != nil {
+		return fmt.Errorf("listening on %s: %v", s.conf.ListenAddress, err)
+	}
+	return s.Serve(ctx, l)
+}
+
+// Serve serves requests on l until ctx is done.  New connections are
+// then refused, streams are told to finish using ShuttingDown(), and
+// in-flight requests are given ShutdownTimeout to complete before their
+// connections are closed.  It returns nil if all requests completed.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	if s.reloader != nil {
+		reloaderCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go s.reloader.Run(reloaderCtx)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		if s.server.TLSConfig != nil {
+			errc <- s.server.ServeTLS(l, "", "")
+		} else {
+			errc <- s.server.Serve(l)
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+	}
+
+	s.shutdownOnce.Do(func() { close(s.shutdown) })
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(s.conf.ShutdownTimeout)*time.Second)
+	defer cancel()
+	if err := s.server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("server did not shut down cleanly, closing remaining connections: %v", err)
+		_ = s.server.Close()
+		return fmt.Errorf("shutting down: %v", err)
+	}
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
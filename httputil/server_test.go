@@ -0,0 +1,177 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func startTestServer(t *testing.T, s *Server) (string, context.CancelFunc, chan error) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(ctx, l) }()
+	return l.Addr().String(), cancel, done
+}
+
+func TestServerConfig_applyDefaults(t *testing.T) {
+	c := ServerConfig{WriteTimeout: -1, ListenAddress: ":9000"}
+	c.applyDefaults()
+	require.Equal(t, ":9000", c.ListenAddress)
+	require.Equal(t, -1, c.WriteTimeout)
+	require.Equal(t, defaultServerConfig.ReadHeaderTimeout, c.ReadHeaderTimeout)
+
+	s, err := NewServer(http.NotFoundHandler(), WithServerConfig(c))
+	require.NoError(t, err)
+	require.Equal(t, time.Duration(0), s.server.WriteTimeout)
+	require.Equal(t, 120*time.Second, s.server.IdleTimeout)
+	require.Nil(t, s.server.TLSConfig)
+}
+
+func TestServer_drainsInFlightRequests(t *testing.T) {
+	started := make(chan struct{})
+	s, err := NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		_, _ = w.Write([]byte("done"))
+	}))
+	require.NoError(t, err)
+	addr, cancel, done := startTestServer(t, s)
+
+	type result struct {
+		body string
+		err  error
+	}
+	resultc := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		if err != nil {
+			resultc <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		resultc <- result{string(body), err}
+	}()
+
+	<-started
+	cancel()
+	got := <-resultc
+	require.NoError(t, got.err)
+	require.Equal(t, "done", got.body)
+	require.NoError(t, <-done)
+
+	_, err = http.Get("http://" + addr)
+	require.Error(t, err)
+}
+
+func TestServer_streamsToldToFinish(t *testing.T) {
+	s, err := NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case <-ShuttingDown(r.Context()):
+				_, _ = w.Write([]byte("bye"))
+				return
+			case <-time.After(10 * time.Millisecond):
+				_, _ = w.Write([]byte("."))
+			}
+		}
+	}), WithServerConfig(ServerConfig{WriteTimeout: -1}))
+	require.NoError(t, err)
+	addr, cancel, done := startTestServer(t, s)
+
+	resp, err := http.Get("http://" + addr)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	cancel()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(body), "bye")
+	require.NoError(t, <-done)
+}
+
+func TestServer_shutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	started := make(chan struct{})
+	s, err := NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}), WithServerConfig(ServerConfig{ShutdownTimeout: 1}))
+	require.NoError(t, err)
+	addr, cancel, done := startTestServer(t, s)
+
+	go func() {
+		resp, err := http.Get("http://" + addr)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+	cancel()
+	require.Error(t, <-done)
+}
+
+func TestShuttingDown_outsideServer(t *testing.T) {
+	require.Nil(t, ShuttingDown(context.Background()))
+}
+
+func TestServer_TLS(t *testing.T) {
+	dir := t.TempDir()
+	pki := newTestPKI(t, "ca")
+	certPEM, keyPEM := pki.issue(t, 7, time.Now().Add(time.Hour))
+	tlsFiles := CertReloaderConfig{
+		CertFile: filepath.Join(dir, "tls.crt"),
+		KeyFile:  filepath.Join(dir, "tls.key"),
+	}
+	writeTestFile(t, tlsFiles.CertFile, certPEM)
+	writeTestFile(t, tlsFiles.KeyFile, keyPEM)
+
+	s, err := NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("secure"))
+	}), WithServerConfig(ServerConfig{TLS: tlsFiles}), WithServerTLSConfig(&tls.Config{MinVersion: tls.VersionTLS13}))
+	require.NoError(t, err)
+	addr, cancel, done := startTestServer(t, s)
+	defer func() {
+		cancel()
+		require.NoError(t, <-done)
+	}()
+
+	overlay := TLSOverlay{}
+	require.NoError(t, overlay.AppendRootsFromPEM(pki.caPEM()))
+	clientTLS, err := MergeTLSConfig(nil, overlay)
+	require.NoError(t, err)
+	resp, err := NewClient(WithTLSConfig(clientTLS)).Get("https://" + addr)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, uint16(tls.VersionTLS13), resp.TLS.Version)
+	require.Equal(t, int64(7), resp.TLS.PeerCertificates[0].SerialNumber.Int64())
+
+	_, err = NewServer(http.NotFoundHandler(), WithServerConfig(ServerConfig{TLS: CertReloaderConfig{CertFile: "missing", KeyFile: "missing"}}))
+	require.Error(t, err)
+}
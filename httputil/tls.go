@@ -0,0 +1,142 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+)
+
+// TLSOverlay holds per-client TLS settings which are added to a base
+// tls.Config, usually the global one set by SetTLSConfig(), rather than
+// replacing it.  Zero values leave the base setting unchanged.
+type TLSOverlay struct {
+	// ExtraRoots are trusted in addition to the base RootCAs, or to
+	// the system roots if the base does not set any.
+	ExtraRoots []*x509.Certificate
+	// Certificates are offered to servers ahead of any in the base
+	// configuration, including those from a base GetClientCertificate,
+	// so the first one the server accepts is used.  The base ones are
+	// used only if the server accepts none of these.
+	Certificates []tls.Certificate
+	// ServerName replaces the base ServerName.
+	ServerName string
+	// MinVersion raises the base MinVersion.  It will not lower it.
+	MinVersion uint16
+}
+
+// AppendRootsFromPEM adds all the certificates in pemCerts to ExtraRoots.
+func (o *TLSOverlay) AppendRootsFromPEM(pemCerts []byte) error {
+	certs, err := parsePEMCertificates(pemCerts)
+	if err != nil {
+		return err
+	}
+	if len(certs) == 0 {
+		return fmt.Errorf("no certificates found in PEM data")
+	}
+	o.ExtraRoots = append(o.ExtraRoots, certs...)
+	return nil
+}
+
+// MergeTLSConfig returns a copy of base with overlay applied.  base is
+// not modified, and may be nil.
+func MergeTLSConfig(base *tls.Config, overlay TLSOverlay) (*tls.Config, error) {
+	var merged *tls.Config
+	if base == nil {
+		merged = &tls.Config{}
+	} else {
+		merged = base.Clone()
+	}
+
+	if len(overlay.ExtraRoots) > 0 {
+		var pool *x509.CertPool
+		if merged.RootCAs != nil {
+			pool = merged.RootCAs.Clone()
+		} else {
+			systemPool, err := x509.SystemCertPool()
+			if err != nil {
+				return nil, fmt.Errorf("loading system roots: %v", err)
+			}
+			pool = systemPool
+		}
+		for _, cert := range overlay.ExtraRoots {
+			pool.AddCert(cert)
+		}
+		merged.RootCAs = pool
+	}
+
+	if len(overlay.Certificates) > 0 {
+		certs := make([]tls.Certificate, 0, len(merged.Certificates)+len(overlay.Certificates))
+		certs = append(certs, overlay.Certificates...)
+		merged.Certificates = append(certs, merged.Certificates...)
+		// tls ignores Certificates if GetClientCertificate is set, as it
+		// is when the base uses a CertReloader.
+		if baseGet := merged.GetClientCertificate; baseGet != nil {
+			overlayCerts := merged.Certificates[:len(overlay.Certificates)]
+			merged.GetClientCertificate = func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				for i := range overlayCerts {
+					if cri.SupportsCertificate(&overlayCerts[i]) == nil {
+						return &overlayCerts[i], nil
+					}
+				}
+				return baseGet(cri)
+			}
+		}
+	}
+
+	if overlay.ServerName != "" {
+		merged.ServerName = overlay.ServerName
+	}
+
+	if overlay.MinVersion > merged.MinVersion {
+		merged.MinVersion = overlay.MinVersion
+	}
+	if merged.MaxVersion != 0 && merged.MaxVersion < merged.MinVersion {
+		return nil, fmt.Errorf("TLS MinVersion %#x is above MaxVersion %#x", merged.MinVersion, merged.MaxVersion)
+	}
+
+	return merged, nil
+}
+
+// MergeDefaultTLSConfig applies overlay to the global TLS configuration
+// set by SetTLSConfig().  The result is usually passed to NewClient()
+// using WithTLSConfig(), so a client can add a certificate or CA without
+// losing the global ones.
+func MergeDefaultTLSConfig(overlay TLSOverlay) (*tls.Config, error) {
+	_, defaultTLS := currentDefaults()
+	return MergeTLSConfig(defaultTLS, overlay)
+}
+
+func parsePEMCertificates(pemCerts []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for len(pemCerts) > 0 {
+		var block *pem.Block
+		block, pemCerts = pem.Decode(pemCerts)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate: %v", err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
@@ -0,0 +1,188 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func makeTestCA(t *testing.T, name string) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func makeTestClientCert(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func trusts(pool *x509.CertPool, cert *x509.Certificate) bool {
+	_, err := cert.Verify(x509.VerifyOptions{Roots: pool})
+	return err == nil
+}
+
+func TestMergeTLSConfig(t *testing.T) {
+	corporate := makeTestCA(t, "corporate")
+	partner := makeTestCA(t, "partner")
+	basePool := x509.NewCertPool()
+	basePool.AddCert(corporate)
+	base := &tls.Config{
+		RootCAs:      basePool,
+		Certificates: []tls.Certificate{{Certificate: [][]byte{{1}}}},
+		MinVersion:   tls.VersionTLS12,
+		ServerName:   "base",
+	}
+
+	t.Run("empty overlay", func(t *testing.T) {
+		merged, err := MergeTLSConfig(base, TLSOverlay{})
+		require.NoError(t, err)
+		require.NotSame(t, base, merged)
+		require.Same(t, basePool, merged.RootCAs)
+		require.Equal(t, "base", merged.ServerName)
+	})
+
+	t.Run("adds to base", func(t *testing.T) {
+		merged, err := MergeTLSConfig(base, TLSOverlay{
+			ExtraRoots:   []*x509.Certificate{partner},
+			Certificates: []tls.Certificate{{Certificate: [][]byte{{2}}}},
+			ServerName:   "partner",
+			MinVersion:   tls.VersionTLS13,
+		})
+		require.NoError(t, err)
+		require.True(t, trusts(merged.RootCAs, corporate))
+		require.True(t, trusts(merged.RootCAs, partner))
+		require.Len(t, merged.Certificates, 2)
+		require.Equal(t, []byte{2}, merged.Certificates[0].Certificate[0], "overlay certificate must be offered first")
+		require.Nil(t, merged.GetClientCertificate)
+		require.Equal(t, "partner", merged.ServerName)
+		require.Equal(t, uint16(tls.VersionTLS13), merged.MinVersion)
+
+		// base is unchanged
+		require.False(t, trusts(base.RootCAs, partner))
+		require.Len(t, base.Certificates, 1)
+		require.Equal(t, "base", base.ServerName)
+	})
+
+	t.Run("does not lower MinVersion", func(t *testing.T) {
+		merged, err := MergeTLSConfig(base, TLSOverlay{MinVersion: tls.VersionTLS10})
+		require.NoError(t, err)
+		require.Equal(t, uint16(tls.VersionTLS12), merged.MinVersion)
+	})
+
+	t.Run("MinVersion above MaxVersion", func(t *testing.T) {
+		_, err := MergeTLSConfig(&tls.Config{MaxVersion: tls.VersionTLS12}, TLSOverlay{MinVersion: tls.VersionTLS13})
+		require.Error(t, err)
+	})
+
+	t.Run("base GetClientCertificate", func(t *testing.T) {
+		baseCert := makeTestClientCert(t, "base")
+		overlayCert := makeTestClientCert(t, "overlay")
+		withCallback := &tls.Config{
+			GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &baseCert, nil
+			},
+		}
+		merged, err := MergeTLSConfig(withCallback, TLSOverlay{Certificates: []tls.Certificate{overlayCert}})
+		require.NoError(t, err)
+
+		accepting := &tls.CertificateRequestInfo{
+			Version:          tls.VersionTLS13,
+			SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		}
+		got, err := merged.GetClientCertificate(accepting)
+		require.NoError(t, err)
+		require.Equal(t, overlayCert.Certificate, got.Certificate)
+
+		// a server which cannot accept the overlay certificate gets the base one.
+		rejecting := &tls.CertificateRequestInfo{
+			Version:          tls.VersionTLS13,
+			SignatureSchemes: []tls.SignatureScheme{tls.PSSWithSHA256},
+		}
+		got, err = merged.GetClientCertificate(rejecting)
+		require.NoError(t, err)
+		require.Equal(t, baseCert.Certificate, got.Certificate)
+	})
+
+	t.Run("nil base", func(t *testing.T) {
+		merged, err := MergeTLSConfig(nil, TLSOverlay{ExtraRoots: []*x509.Certificate{partner}})
+		require.NoError(t, err)
+		require.True(t, trusts(merged.RootCAs, partner))
+	})
+}
+
+func TestMergeDefaultTLSConfig(t *testing.T) {
+	corporate := makeTestCA(t, "corporate")
+	pool := x509.NewCertPool()
+	pool.AddCert(corporate)
+	SetTLSConfig(&tls.Config{RootCAs: pool})
+	t.Cleanup(func() { SetTLSConfig(nil) })
+
+	merged, err := MergeDefaultTLSConfig(TLSOverlay{MinVersion: tls.VersionTLS13})
+	require.NoError(t, err)
+	require.True(t, trusts(merged.RootCAs, corporate))
+	require.Equal(t, uint16(tls.VersionTLS13), merged.MinVersion)
+}
+
+func TestTLSOverlay_AppendRootsFromPEM(t *testing.T) {
+	partner := makeTestCA(t, "partner")
+	pemCerts := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1}})
+	pemCerts = append(pemCerts, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: partner.Raw})...)
+
+	var o TLSOverlay
+	require.NoError(t, o.AppendRootsFromPEM(pemCerts))
+	require.Len(t, o.ExtraRoots, 1)
+	require.Equal(t, "partner", o.ExtraRoots[0].Subject.CommonName)
+
+	require.Error(t, o.AppendRootsFromPEM([]byte("nothing here")))
+	require.Error(t, o.AppendRootsFromPEM(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1}})))
+}
@@ -15,7 +15,8 @@
 package tracer
 
 // The `tracer` package provides a way to get HTTP and other
-// tracing via otel, and export to Jaeger and/or stdout.
+// tracing via otel, and export to Jaeger and/or stdout, and
+// metrics which are served for Prometheus to scrape.
 // A common pattern for using:
 //
 // jaegerEndpoint = flag.String("jaeger-endpoint", "", "Jaeger collector endpoint")
@@ -33,4 +34,9 @@ package tracer
 // util.Check(err)
 // defer tracerProvider.Shutdown(ctx)
 //
+// meterProvider, err := tracer.NewMeterProvider(ctx, version.GitHash(), appName)
+// util.Check(err)
+// defer meterProvider.Shutdown(ctx)
+// mux.Handle("/metrics", meterProvider.Handler())
+//
 // Catching signals would also be wise, so Shutdown() can be called properly.
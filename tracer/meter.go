@@ -0,0 +1,85 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
+	metricsdk "go.opentelemetry.io/otel/sdk/metric"
+)
+
+// MeterProvider holds the state for a metrics provider, and the
+// Prometheus registry it is exported through.
+type MeterProvider struct {
+	Provider *metricsdk.MeterProvider
+	registry *prometheus.Registry
+}
+
+// NewMeterProvider returns an OpenTelemetry MeterProvider, set as the
+// global one, whose metrics are served in the Prometheus text format by
+// Handler().  Go runtime and process metrics are included.
+//
+// If no error is returned, `defer provider.Shutdown(ctx)` should be set up.
+func NewMeterProvider(ctx context.Context, githash string, appname string) (*MeterProvider, error) {
+	res, err := newResource(ctx, githash, appname)
+	if err != nil {
+		return nil, fmt.Errorf("resource.New: %v", err)
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collectors.NewGoCollector()); err != nil {
+		return nil, err
+	}
+	if err := registry.Register(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{})); err != nil {
+		return nil, err
+	}
+	exp, err := otelprom.New(otelprom.WithRegisterer(registry))
+	if err != nil {
+		return nil, err
+	}
+
+	mp := metricsdk.NewMeterProvider(
+		metricsdk.WithResource(res),
+		metricsdk.WithReader(exp),
+	)
+	otel.SetMeterProvider(mp)
+	return &MeterProvider{Provider: mp, registry: registry}, nil
+}
+
+// Handler serves the metrics for scraping by Prometheus, usually on
+// /metrics.
+func (p *MeterProvider) Handler() http.Handler {
+	return promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{})
+}
+
+// Shutdown should be deferred immediately after NewMeterProvider()
+// when no error is returned.  A maximum time of 5 seconds will be
+// allowed before we give up, to prevent a hang at shutdown.
+func (p *MeterProvider) Shutdown(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+	if err := p.Provider.Shutdown(ctx); err != nil {
+		log.Printf("shutting down metrics: %v", err)
+	}
+}
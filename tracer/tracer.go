@@ -51,13 +51,7 @@ type TracerProvider struct {
 //
 // If traceToStdout is true, traces will be sent to stdout.
 func NewTracerProvider(ctx context.Context, otlpEndpoint string, traceToStdout bool, githash string, appname string, traceRatio float64) (*TracerProvider, error) {
-	res, err := resource.New(ctx,
-		// add detectors here if needed
-		resource.WithTelemetrySDK(),
-		resource.WithAttributes(
-			semconv.ServiceNameKey.String(appname),
-			semconv.ServiceVersionKey.String(githash),
-		))
+	res, err := newResource(ctx, githash, appname)
 	if err != nil {
 		log.Fatalf("resource.New: %v", err)
 	}
@@ -102,6 +96,17 @@ func NewTracerProvider(ctx context.Context, otlpEndpoint string, traceToStdout b
 	return &TracerProvider{Provider: tp}, nil
 }
 
+// newResource describes the application, for both traces and metrics.
+func newResource(ctx context.Context, githash string, appname string) (*resource.Resource, error) {
+	return resource.New(ctx,
+		// add detectors here if needed
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(
+			semconv.ServiceNameKey.String(appname),
+			semconv.ServiceVersionKey.String(githash),
+		))
+}
+
 // Shutdown should be deferred immediately after NewTracerProvider()
 // when no error is returned.  This will ensure that on app termination
 // it will flush any buffered traces, if possible.  A maximum time
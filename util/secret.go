@@ -0,0 +1,102 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const redacted = "[redacted]"
+
+// Secret holds a token, password, or other credential which must not
+// end up in logs.  Formatting it with any fmt verb, or marshalling it
+// to JSON or YAML, produces a placeholder rather than the value.  Use
+// Reveal() where the real value is needed, such as when setting an
+// Authorization header.
+//
+// A Secret can be unmarshalled from a plain JSON or YAML string, so it
+// can be used directly in configuration structs.
+type Secret struct {
+	value string
+}
+
+// NewSecret returns a Secret holding value.
+func NewSecret(value string) Secret {
+	return Secret{value: value}
+}
+
+// Reveal returns the secret value.
+func (s Secret) Reveal() string {
+	return s.value
+}
+
+// IsZero returns true if the secret is empty.
+func (s Secret) IsZero() bool {
+	return s.value == ""
+}
+
+func (s Secret) redacted() string {
+	if s.value == "" {
+		return ""
+	}
+	return redacted
+}
+
+// String implements fmt.Stringer, and returns a placeholder.
+func (s Secret) String() string {
+	return s.redacted()
+}
+
+// GoString implements fmt.GoStringer, and returns a placeholder.
+func (s Secret) GoString() string {
+	return "util.Secret(" + strconv.Quote(s.redacted()) + ")"
+}
+
+// Format implements fmt.Formatter so that every verb, including %x and
+// %#v, produces the placeholder.
+func (s Secret) Format(f fmt.State, verb rune) {
+	switch {
+	case verb == 'v' && f.Flag('#'):
+		_, _ = io.WriteString(f, s.GoString())
+	case verb == 'q':
+		_, _ = io.WriteString(f, strconv.Quote(s.redacted()))
+	default:
+		_, _ = io.WriteString(f, s.redacted())
+	}
+}
+
+// MarshalJSON implements json.Marshaler, and encodes a placeholder.
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.redacted())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &s.value)
+}
+
+// MarshalYAML implements yaml.Marshaler, and encodes a placeholder.
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return s.redacted(), nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface used by both
+// gopkg.in/yaml.v2 and v3.
+func (s *Secret) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	return unmarshal(&s.value)
+}
@@ -0,0 +1,84 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+type secretHolder struct {
+	Name  string `json:"name" yaml:"name"`
+	Token Secret `json:"token,omitempty" yaml:"token,omitempty"`
+}
+
+func TestSecret_Format(t *testing.T) {
+	s := NewSecret("hunter2")
+	h := secretHolder{Name: "foo", Token: s}
+	tests := []struct {
+		format string
+		arg    interface{}
+		want   string
+	}{
+		{"%s", s, "[redacted]"},
+		{"%v", s, "[redacted]"},
+		{"%q", s, `"[redacted]"`},
+		{"%x", s, "[redacted]"},
+		{"%#v", s, `util.Secret("[redacted]")`},
+		{"%v", h, "{foo [redacted]}"},
+		{"%+v", h, "{Name:foo Token:[redacted]}"},
+		{"%v", &h, "&{foo [redacted]}"},
+		{"%s", Secret{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			got := fmt.Sprintf(tt.format, tt.arg)
+			require.Equal(t, tt.want, got)
+			require.NotContains(t, got, "hunter2")
+		})
+	}
+	require.Equal(t, "hunter2", s.Reveal())
+	require.Equal(t, "[redacted]", s.String())
+}
+
+func TestSecret_JSON(t *testing.T) {
+	var h secretHolder
+	require.NoError(t, json.Unmarshal([]byte(`{"name":"foo","token":"hunter2"}`), &h))
+	require.Equal(t, "hunter2", h.Token.Reveal())
+
+	d, err := json.Marshal(h)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"foo","token":"[redacted]"}`, string(d))
+
+	require.Error(t, json.Unmarshal([]byte(`{"token":42}`), &h))
+}
+
+func TestSecret_YAML(t *testing.T) {
+	var h secretHolder
+	require.NoError(t, yaml.Unmarshal([]byte("name: foo\ntoken: hunter2\n"), &h))
+	require.Equal(t, "hunter2", h.Token.Reveal())
+
+	d, err := yaml.Marshal(h)
+	require.NoError(t, err)
+	require.Equal(t, "name: foo\ntoken: '[redacted]'\n", string(d))
+
+	d, err = yaml.Marshal(secretHolder{Name: "foo"})
+	require.NoError(t, err)
+	require.Equal(t, "name: foo\n", string(d))
+}
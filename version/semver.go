@@ -0,0 +1,144 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Semver is a parsed semantic version, which may also carry the
+// suffix added by `git describe` for builds made after a tag.
+//
+// For example, `v3.4.6-6-g4eee038` is version 3.4.6, with 6 commits
+// since that tag, at hash 4eee038.
+type Semver struct {
+	Major      int
+	Minor      int
+	Patch      int
+	Prerelease string
+	Commits    int
+	Hash       string
+}
+
+var semverRegexp = regexp.MustCompile(`^v?(\d+)\.(\d+)(?:\.(\d+))?(?:-([0-9A-Za-z.-]+?))??(?:-(\d+)-g([0-9a-f]+))?(?:-dirty)?$`)
+
+// ParseSemver parses a version such as `v1.2.3`, `1.2.3-rc.1`, or
+// `v1.2.3-5-g12350123`.  The leading `v` and the patch level are optional.
+func ParseSemver(s string) (Semver, error) {
+	m := semverRegexp.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return Semver{}, fmt.Errorf("cannot parse version %q", s)
+	}
+	v := Semver{
+		Prerelease: m[4],
+		Hash:       m[6],
+	}
+	var err error
+	if v.Major, err = strconv.Atoi(m[1]); err != nil {
+		return Semver{}, fmt.Errorf("cannot parse version %q: %v", s, err)
+	}
+	if v.Minor, err = strconv.Atoi(m[2]); err != nil {
+		return Semver{}, fmt.Errorf("cannot parse version %q: %v", s, err)
+	}
+	if m[3] != "" {
+		if v.Patch, err = strconv.Atoi(m[3]); err != nil {
+			return Semver{}, fmt.Errorf("cannot parse version %q: %v", s, err)
+		}
+	}
+	if m[5] != "" {
+		if v.Commits, err = strconv.Atoi(m[5]); err != nil {
+			return Semver{}, fmt.Errorf("cannot parse version %q: %v", s, err)
+		}
+	}
+	return v, nil
+}
+
+// String returns the version in `git describe` format.
+func (v Semver) String() string {
+	s := fmt.Sprintf("v%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Prerelease != "" {
+		s += "-" + v.Prerelease
+	}
+	if v.Commits > 0 || v.Hash != "" {
+		s += fmt.Sprintf("-%d-g%s", v.Commits, v.Hash)
+	}
+	return s
+}
+
+// Compare returns -1, 0, or 1 if v is older than, the same as, or newer
+// than other.  A prerelease sorts before its release, and a build with
+// commits after a tag sorts after that tag.  The hash is not compared.
+func (v Semver) Compare(other Semver) int {
+	if c := compareInt(v.Major, other.Major); c != 0 {
+		return c
+	}
+	if c := compareInt(v.Minor, other.Minor); c != 0 {
+		return c
+	}
+	if c := compareInt(v.Patch, other.Patch); c != 0 {
+		return c
+	}
+	if c := comparePrerelease(v.Prerelease, other.Prerelease); c != 0 {
+		return c
+	}
+	return compareInt(v.Commits, other.Commits)
+}
+
+func compareInt(a int, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// comparePrerelease follows the semver.org precedence rules.
+func comparePrerelease(a string, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == "" {
+		return 1
+	}
+	if b == "" {
+		return -1
+	}
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < len(aParts) && i < len(bParts); i++ {
+		aNum, aErr := strconv.Atoi(aParts[i])
+		bNum, bErr := strconv.Atoi(bParts[i])
+		switch {
+		case aErr == nil && bErr == nil:
+			if c := compareInt(aNum, bNum); c != 0 {
+				return c
+			}
+		case aErr == nil:
+			return -1
+		case bErr == nil:
+			return 1
+		default:
+			if c := strings.Compare(aParts[i], bParts[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareInt(len(aParts), len(bParts))
+}
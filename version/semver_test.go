@@ -0,0 +1,89 @@
+// Copyright 2022 OpsMx, Inc
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSemver(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    Semver
+		wantErr bool
+	}{
+		{"v1.2.3", Semver{Major: 1, Minor: 2, Patch: 3}, false},
+		{"1.2", Semver{Major: 1, Minor: 2}, false},
+		{"v3.4.6-6-g4eee038", Semver{Major: 3, Minor: 4, Patch: 6, Commits: 6, Hash: "4eee038"}, false},
+		{"v1.2.3-rc.1", Semver{Major: 1, Minor: 2, Patch: 3, Prerelease: "rc.1"}, false},
+		{"v1.2.3-rc1-3-gabc123", Semver{Major: 1, Minor: 2, Patch: 3, Prerelease: "rc1", Commits: 3, Hash: "abc123"}, false},
+		{"v1.2.3-dirty", Semver{Major: 1, Minor: 2, Patch: 3}, false},
+		{"dev", Semver{}, true},
+		{"", Semver{}, true},
+		{"v1", Semver{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, err := ParseSemver(tt.input)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSemver_Compare(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		want int
+	}{
+		{"v1.2.3", "v1.2.3", 0},
+		{"v1.2.3", "v1.2.4", -1},
+		{"v1.3.0", "v1.2.9", 1},
+		{"v2.0.0", "v1.9.9", 1},
+		{"v3.4.6-6-g4eee038", "v3.4.6", 1},
+		{"v3.4.6-6-g4eee038", "v3.4.6-7-gabcdef0", -1},
+		{"v3.4.6-6-g4eee038", "v3.4.7", -1},
+		{"v1.0.0-rc.1", "v1.0.0", -1},
+		{"v1.0.0-rc.2", "v1.0.0-rc.10", -1},
+		{"v1.0.0-alpha", "v1.0.0-beta", -1},
+		{"v1.0.0-alpha", "v1.0.0-alpha.1", -1},
+		{"v1.0.0-1", "v1.0.0-alpha", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.a+" vs "+tt.b, func(t *testing.T) {
+			a, err := ParseSemver(tt.a)
+			require.NoError(t, err)
+			b, err := ParseSemver(tt.b)
+			require.NoError(t, err)
+			require.Equal(t, tt.want, a.Compare(b))
+			require.Equal(t, -tt.want, b.Compare(a))
+		})
+	}
+}
+
+func TestSemver_String(t *testing.T) {
+	for _, s := range []string{"v1.2.3", "v3.4.6-6-g4eee038", "v1.2.3-rc.1"} {
+		v, err := ParseSemver(s)
+		require.NoError(t, err)
+		require.Equal(t, s, v.String())
+	}
+}